@@ -0,0 +1,318 @@
+package authr
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "gorm.io/gorm"
+    "sort"
+    "strings"
+    "time"
+)
+
+const (
+    defaultPageSize  = 25
+    maxPageSize      = 200
+    passwordResetTTL = time.Hour * 24
+)
+
+// AdminService user management operations, callers must check the admin role
+type AdminService interface {
+    ListUsers(c context.Context, q *UserQuery) (*UserPage, error)
+    GetUser(c context.Context, userId string) (*UserRecord, error)
+    SetRoles(c context.Context, userId string, roles []string) (*UserRecord, error)
+    SetAttributes(c context.Context, userId string, attrs map[string]interface{}) (*UserRecord, error)
+    DisableUser(c context.Context, userId string) error
+    EnableUser(c context.Context, userId string) error
+    SetStatus(c context.Context, userId string, status UserStatus) error
+    ForcePasswordReset(c context.Context, userId string) error
+    DeleteUser(c context.Context, userId string) error
+    ListSessions(c context.Context, userId string) ([]*Session, error)
+    RevokeSession(c context.Context, userId, tokenUuid string) error
+    RevokeSessions(c context.Context, userId string) error
+}
+
+// WithPasswordResetLink url of the password reset page, the token is appended as the `token` query parameter
+func WithPasswordResetLink(resetURL string) Option {
+    return func(s *service) {
+        s.resetURL = resetURL
+    }
+}
+
+// ListUsers page through users, optionally filtered by username or email
+func (s *service) ListUsers(c context.Context, q *UserQuery) (*UserPage, error) {
+    if q == nil {
+        q = &UserQuery{}
+    }
+    page, pageSize := q.Page, q.PageSize
+    if page < 1 {
+        page = 1
+    }
+    if pageSize < 1 {
+        pageSize = defaultPageSize
+    }
+    if pageSize > maxPageSize {
+        pageSize = maxPageSize
+    }
+
+    tx := s.db.WithContext(c).Model(&User{})
+    if search := strings.TrimSpace(q.Search); search != "" {
+        like := "%" + search + "%"
+        tx = tx.Where("username LIKE ? OR email LIKE ?", like, like)
+    }
+
+    var total int64
+    if err := tx.Count(&total).Error; err != nil {
+        return nil, storeErr("ListUsers", err)
+    }
+
+    var users []User
+    if err := tx.Order("created_at").Offset((page - 1) * pageSize).Limit(pageSize).Find(&users).Error; err != nil {
+        return nil, storeErr("ListUsers", err)
+    }
+
+    res := &UserPage{Users: make([]*UserRecord, 0, len(users)), Total: total, Page: page, PageSize: pageSize}
+    for i := range users {
+        res.Users = append(res.Users, users[i].Record())
+    }
+    return res, nil
+}
+
+// GetUser admin view of a single user
+func (s *service) GetUser(c context.Context, userId string) (*UserRecord, error) {
+    user, err := s.LoadUser(c, userId)
+    if err != nil {
+        return nil, err
+    }
+    return user.Record(), nil
+}
+
+// SetRoles replace the roles of a user, outstanding tokens carry the old roles and are revoked
+func (s *service) SetRoles(c context.Context, userId string, roles []string) (*UserRecord, error) {
+    user, err := s.LoadUser(c, userId)
+    if err != nil {
+        return nil, err
+    }
+
+    if user.Roles, err = joinRoles(roles); err != nil {
+        return nil, err
+    }
+    err = s.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+        if err := tx.Model(&User{}).Where("id = ?", user.ID).Update("roles", user.Roles).Error; err != nil {
+            return err
+        }
+        return s.revokeUserTokens(tx, user.ID)
+    })
+    if err != nil {
+        return nil, storeErr("SetRoles", err)
+    }
+    return user.Record(), nil
+}
+
+// SetAttributes change any attribute of a user, including the claim attributes users can not change themselves
+func (s *service) SetAttributes(c context.Context, userId string, attrs map[string]interface{}) (*UserRecord, error) {
+    user, err := s.LoadUser(c, userId)
+    if err != nil {
+        return nil, err
+    }
+
+    user.Attributes = mergeAttributes(user.Attributes, attrs)
+    if err = s.db.WithContext(c).Model(&User{}).Where("id = ?", user.ID).Update("attributes", user.Attributes).Error; err != nil {
+        return nil, storeErr("SetAttributes", err)
+    }
+    return user.Record(), nil
+}
+
+// joinRoles the comma separated form stored in Roles, blank roles are dropped
+func joinRoles(roles []string) (string, error) {
+    clean := make([]string, 0, len(roles))
+    for _, role := range roles {
+        role = strings.TrimSpace(role)
+        if role == "" {
+            continue
+        }
+        if strings.Contains(role, ",") {
+            return "", invalidf("role %q is invalid", role)
+        }
+        clean = append(clean, role)
+    }
+    return strings.Join(clean, ","), nil
+}
+
+// splitRoles the roles of the comma separated Roles, empty rather than [""] for a user without roles
+func splitRoles(roles string) []string {
+    if roles == "" {
+        return []string{}
+    }
+    return strings.Split(roles, ",")
+}
+
+// attributeNames sorted names of the changed attributes for the audit log, the values may be sensitive
+func attributeNames(attrs map[string]interface{}) string {
+    names := make([]string, 0, len(attrs))
+    for name := range attrs {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return strings.Join(names, ",")
+}
+
+// DisableUser block the user from logging in and revoke their sessions
+func (s *service) DisableUser(c context.Context, userId string) error {
+    return s.SetStatus(c, userId, StatusDisabled)
+}
+
+// EnableUser allow a disabled, locked or pending user to log in again
+func (s *service) EnableUser(c context.Context, userId string) error {
+    return s.SetStatus(c, userId, StatusActive)
+}
+
+// ForcePasswordReset invalidate the password, revoke all sessions and mail a reset link to the user
+func (s *service) ForcePasswordReset(c context.Context, userId string) error {
+    user, err := s.LoadUser(c, userId)
+    if err != nil {
+        return err
+    }
+
+    token, err := randomToken()
+    if err != nil {
+        return err
+    }
+
+    reset := PasswordReset{
+        UserId:    user.ID,
+        TokenHash: hashToken(token),
+        Expires:   time.Now().Add(passwordResetTTL),
+    }
+    err = s.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+        // an empty hash never matches, the user has to go through the reset link
+        if err := tx.Model(&User{}).Where("id = ?", user.ID).Update("password", "").Error; err != nil {
+            return err
+        }
+        if err := s.revokeUserTokens(tx, user.ID); err != nil {
+            return err
+        }
+        if err := tx.Where("user_id = ? AND used_at IS NULL", user.ID).Delete(&PasswordReset{}).Error; err != nil {
+            return err
+        }
+        return tx.Create(&reset).Error
+    })
+    if err != nil {
+        return storeErr("ForcePasswordReset", err)
+    }
+
+    if s.mailer == nil || user.Email == "" {
+        return fmt.Errorf("%w: password was reset but no email could be sent", ErrNotConfigured)
+    }
+    body := fmt.Sprintf("An administrator has reset your password. Choose a new password:\n\n%s\n", tokenLink(s.resetURL, token))
+    return s.mailer.Send(c, user.Email, "Reset your password", body)
+}
+
+// ResetPassword set a new password using a reset token, returns the id of the user
+func (s *service) ResetPassword(c context.Context, args *PasswordResetParams) (string, error) {
+    if args == nil || args.Token == "" || args.Password == "" {
+        return "", invalidf("password reset params are invalid")
+    }
+
+    reset := &PasswordReset{}
+    if err := s.db.WithContext(c).Where("token_hash = ?", hashToken(args.Token)).First(reset).Error; err != nil {
+        return "", ErrTokenInvalid
+    }
+    if reset.UsedAt != nil {
+        return "", ErrTokenUsed
+    }
+    if time.Now().After(reset.Expires) {
+        return "", ErrTokenExpired
+    }
+
+    hash, err := s.hashPassword(c, args.Password)
+    if err != nil {
+        return "", err
+    }
+
+    now := time.Now()
+    err = s.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+        // claim the token first, a concurrent reset finds it used
+        res := tx.Model(&PasswordReset{}).Where("id = ? AND used_at IS NULL", reset.ID).Update("used_at", &now)
+        if res.Error != nil {
+            return res.Error
+        }
+        if res.RowsAffected == 0 {
+            return ErrTokenUsed
+        }
+        return tx.Model(&User{}).Where("id = ?", reset.UserId).Update("password", hash).Error
+    })
+    if errors.Is(err, ErrTokenUsed) {
+        return "", err
+    }
+    if err != nil {
+        return "", storeErr("ResetPassword", err)
+    }
+    return reset.UserId, nil
+}
+
+// DeleteUser mark the user deleted, revoke their sessions and remove the row
+func (s *service) DeleteUser(c context.Context, userId string) error {
+    if err := s.SetStatus(c, userId, StatusDeleted); err != nil {
+        return err
+    }
+    return storeErr("DeleteUser", s.db.WithContext(c).Where("id = ?", userId).Delete(&User{}).Error)
+}
+
+// ListSessions tokens currently issued to a user
+func (s *service) ListSessions(c context.Context, userId string) ([]*Session, error) {
+    tokens, err := s.FetchHistory(c, userId)
+    if err != nil {
+        return nil, err
+    }
+
+    sessions := make([]*Session, 0, len(tokens))
+    for _, t := range tokens {
+        sessions = append(sessions, &Session{
+            TokenUuid: t.TokenUuid,
+            TokenType: t.TokenType,
+            Expires:   t.Expires,
+            CreatedAt: t.CreatedAt,
+        })
+    }
+    return sessions, nil
+}
+
+// RevokeSession revoke an access token of a user along with its refresh token
+func (s *service) RevokeSession(c context.Context, userId, tokenUuid string) error {
+    if tokenUuid == "" {
+        return invalidf("session is invalid")
+    }
+    tokenUuid = strings.TrimSuffix(tokenUuid, "++"+userId)
+    return s.DeleteTokens(c, &AccessDetails{TokenUuid: tokenUuid, UserId: userId})
+}
+
+// RevokeSessions revoke every token of a user
+func (s *service) RevokeSessions(c context.Context, userId string) error {
+    return storeErr("RevokeSessions", s.revokeUserTokens(s.db.WithContext(c), userId))
+}
+
+// adminAccess the admin endpoints need the admin role, an API key also needs ScopeAdmin
+func adminAccess(metadata *AccessDetails) error {
+    if metadata.KeyId != "" && !metadata.Restricted() {
+        return ErrInsufficientScope
+    }
+    if !metadata.HasRole(RoleAdmin) || metadata.Impersonated() {
+        return ErrForbidden
+    }
+    return nil
+}
+
+// Record admin view of the user
+func (u *User) Record() *UserRecord {
+    return &UserRecord{
+        ID:         u.ID,
+        Username:   u.Username,
+        Email:      u.Email,
+        Roles:      splitRoles(u.Roles),
+        Attributes: u.Attributes,
+        Status:     UserStatus(u.Status.String()),
+        CreatedAt:  u.CreatedAt,
+        UpdatedAt:  u.UpdatedAt,
+    }
+}
@@ -0,0 +1,435 @@
+package authr
+
+import (
+    "github.com/gin-gonic/gin"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// GinAdminAdapter gin admin func exposed, every handler requires the admin role
+type GinAdminAdapter interface {
+    ListUsers(c *gin.Context)
+    GetUser(c *gin.Context)
+    SetRoles(c *gin.Context)
+    SetAttributes(c *gin.Context)
+    DisableUser(c *gin.Context)
+    EnableUser(c *gin.Context)
+    SetStatus(c *gin.Context)
+    ForcePasswordReset(c *gin.Context)
+    DeleteUser(c *gin.Context)
+    ListSessions(c *gin.Context)
+    RevokeSessions(c *gin.Context)
+    Impersonate(c *gin.Context)
+    StopImpersonation(c *gin.Context)
+    AuditLog(c *gin.Context)
+    ExportAudit(c *gin.Context)
+    RegisterClient(c *gin.Context)
+    DeleteClient(c *gin.Context)
+    CreateServiceAccount(c *gin.Context)
+    ListServiceAccounts(c *gin.Context)
+    RotateServiceAccountSecret(c *gin.Context)
+    DeleteServiceAccount(c *gin.Context)
+}
+
+// NewGinAdminAdapter users are selected with the `:id` route parameter or the `id` query parameter
+func NewGinAdminAdapter(s AuthService) GinAdminAdapter {
+    return &ginAdminAdapter{s: s}
+}
+
+type ginAdminAdapter struct {
+    s AuthService
+}
+
+// admin check the request carries a live token with the admin role, restricted credentials need ScopeAdmin
+func (g *ginAdminAdapter) admin(c *gin.Context) (*AccessDetails, bool) {
+    metadata, err := g.s.AuthorizeScopes(c.Request, ScopeAdmin)
+    if err != nil {
+        abortProblem(c, err)
+        return nil, false
+    }
+    if err = adminAccess(metadata); err != nil {
+        abortProblem(c, err)
+        return nil, false
+    }
+    return metadata, true
+}
+
+func userIdParam(c *gin.Context) string {
+    if id := c.Param("id"); id != "" {
+        return id
+    }
+    return c.Query("id")
+}
+
+func clientIdParam(c *gin.Context) string {
+    if id := c.Param("client_id"); id != "" {
+        return id
+    }
+    return c.Query("client_id")
+}
+
+func (g *ginAdminAdapter) ListUsers(c *gin.Context) {
+    if _, ok := g.admin(c); !ok {
+        return
+    }
+
+    page, _ := strconv.Atoi(c.Query("page"))
+    pageSize, _ := strconv.Atoi(c.Query("page_size"))
+
+    users, err := g.s.ListUsers(c.Request.Context(), &UserQuery{Search: c.Query("search"), Page: page, PageSize: pageSize})
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, users)
+}
+
+func (g *ginAdminAdapter) GetUser(c *gin.Context) {
+    if _, ok := g.admin(c); !ok {
+        return
+    }
+
+    user, err := g.s.GetUser(c.Request.Context(), userIdParam(c))
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, user)
+}
+
+func (g *ginAdminAdapter) SetRoles(c *gin.Context) {
+    admin, ok := g.admin(c)
+    if !ok {
+        return
+    }
+
+    var rolesArgs RolesParams
+    if err := c.ShouldBindJSON(&rolesArgs); err != nil {
+        ginProblem(c, invalidf("invalid json provided"))
+        return
+    }
+
+    user, err := g.s.SetRoles(c.Request.Context(), userIdParam(c), rolesArgs.Roles)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditRoleChange, ActorId: admin.UserId, TargetId: userIdParam(c), Detail: strings.Join(rolesArgs.Roles, ",")})
+    c.JSON(http.StatusOK, user)
+}
+
+func (g *ginAdminAdapter) SetAttributes(c *gin.Context) {
+    admin, ok := g.admin(c)
+    if !ok {
+        return
+    }
+
+    var attributesArgs AttributesParams
+    if err := c.ShouldBindJSON(&attributesArgs); err != nil {
+        ginProblem(c, invalidf("invalid json provided"))
+        return
+    }
+
+    user, err := g.s.SetAttributes(c.Request.Context(), userIdParam(c), attributesArgs.Attributes)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditAttributeChange, ActorId: admin.UserId, TargetId: userIdParam(c), Detail: attributeNames(attributesArgs.Attributes)})
+    c.JSON(http.StatusOK, user)
+}
+
+func (g *ginAdminAdapter) DisableUser(c *gin.Context) {
+    admin, ok := g.admin(c)
+    if !ok {
+        return
+    }
+
+    if err := g.s.DisableUser(c.Request.Context(), userIdParam(c)); err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditStatusChange, ActorId: admin.UserId, TargetId: userIdParam(c), Detail: string(StatusDisabled)})
+    c.JSON(http.StatusOK, "User disabled")
+}
+
+func (g *ginAdminAdapter) EnableUser(c *gin.Context) {
+    admin, ok := g.admin(c)
+    if !ok {
+        return
+    }
+
+    if err := g.s.EnableUser(c.Request.Context(), userIdParam(c)); err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditStatusChange, ActorId: admin.UserId, TargetId: userIdParam(c), Detail: string(StatusActive)})
+    c.JSON(http.StatusOK, "User enabled")
+}
+
+func (g *ginAdminAdapter) SetStatus(c *gin.Context) {
+    admin, ok := g.admin(c)
+    if !ok {
+        return
+    }
+
+    var statusArgs StatusParams
+    if err := c.ShouldBindJSON(&statusArgs); err != nil {
+        ginProblem(c, invalidf("invalid json provided"))
+        return
+    }
+
+    if err := g.s.SetStatus(c.Request.Context(), userIdParam(c), statusArgs.Status); err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditStatusChange, ActorId: admin.UserId, TargetId: userIdParam(c), Detail: string(statusArgs.Status)})
+    c.JSON(http.StatusOK, "Status changed")
+}
+
+func (g *ginAdminAdapter) ForcePasswordReset(c *gin.Context) {
+    admin, ok := g.admin(c)
+    if !ok {
+        return
+    }
+
+    if err := g.s.ForcePasswordReset(c.Request.Context(), userIdParam(c)); err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditPasswordReset, ActorId: admin.UserId, TargetId: userIdParam(c)})
+    c.JSON(http.StatusOK, "Password reset")
+}
+
+func (g *ginAdminAdapter) DeleteUser(c *gin.Context) {
+    admin, ok := g.admin(c)
+    if !ok {
+        return
+    }
+
+    if err := g.s.DeleteUser(c.Request.Context(), userIdParam(c)); err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditUserDelete, ActorId: admin.UserId, TargetId: userIdParam(c)})
+    c.JSON(http.StatusOK, "User deleted")
+}
+
+func (g *ginAdminAdapter) ListSessions(c *gin.Context) {
+    if _, ok := g.admin(c); !ok {
+        return
+    }
+
+    sessions, err := g.s.ListSessions(c.Request.Context(), userIdParam(c))
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, sessions)
+}
+
+// RevokeSessions revoke the `session` query parameter, or every session of the user when omitted
+func (g *ginAdminAdapter) RevokeSessions(c *gin.Context) {
+    admin, ok := g.admin(c)
+    if !ok {
+        return
+    }
+
+    var err error
+    if session := c.Query("session"); session != "" {
+        err = g.s.RevokeSession(c.Request.Context(), userIdParam(c), session)
+    } else {
+        err = g.s.RevokeSessions(c.Request.Context(), userIdParam(c))
+    }
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.Metrics().revocation(adapterGin, "admin")
+    g.s.Reporter().Publish(&Event{Type: EventTokenRevoked, Request: c.Request, UserId: userIdParam(c), ActorId: admin.UserId, Reason: c.Query("session")})
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditSessionRevoke, ActorId: admin.UserId, TargetId: userIdParam(c), Detail: c.Query("session")})
+    c.JSON(http.StatusOK, "Sessions revoked")
+}
+
+func (g *ginAdminAdapter) Impersonate(c *gin.Context) {
+    actor, ok := g.admin(c)
+    if !ok {
+        return
+    }
+
+    targetId := userIdParam(c)
+    ts, err := g.s.Impersonate(c.Request.Context(), actor, targetId)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+
+    g.s.Reporter().Publish(&Event{Type: EventImpersonationStart, Request: c.Request, UserId: targetId, ActorId: actor.UserId})
+    g.s.Reporter().Publish(&Event{Type: EventTokenGranted, Request: c.Request, UserId: targetId, ActorId: actor.UserId, Token: ts})
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditImpersonationStart, ActorId: actor.UserId, TargetId: targetId})
+    c.JSON(http.StatusOK, ts)
+}
+
+// StopImpersonation called with the impersonated token, not the admin one
+func (g *ginAdminAdapter) StopImpersonation(c *gin.Context) {
+    session, err := g.s.Authorize(c.Request)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+
+    if err = g.s.StopImpersonation(c.Request.Context(), session); err != nil {
+        ginProblem(c, err)
+        return
+    }
+
+    g.s.Metrics().revocation(adapterGin, "impersonation")
+    g.s.Reporter().Publish(&Event{Type: EventImpersonationStop, Request: c.Request, UserId: session.UserId, ActorId: session.ActorId})
+    g.s.Reporter().Publish(&Event{Type: EventTokenRevoked, Request: c.Request, UserId: session.UserId, ActorId: session.ActorId, Token: &TokenDetails{ID: session.UserId, TokenUuid: session.TokenUuid}})
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditImpersonationStop, ActorId: session.ActorId, TargetId: session.UserId})
+    c.JSON(http.StatusOK, "Impersonation stopped")
+}
+
+func (g *ginAdminAdapter) AuditLog(c *gin.Context) {
+    if _, ok := g.admin(c); !ok {
+        return
+    }
+
+    q, err := auditQueryParams(c.Request.URL.Query())
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+
+    events, err := g.s.AuditLog(c.Request.Context(), q)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, events)
+}
+
+// ExportAudit stream the matching events as JSON Lines
+func (g *ginAdminAdapter) ExportAudit(c *gin.Context) {
+    if _, ok := g.admin(c); !ok {
+        return
+    }
+
+    q, err := auditQueryParams(c.Request.URL.Query())
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+
+    c.Header("Content-Type", "application/jsonl")
+    c.Header("Content-Disposition", `attachment; filename="audit.jsonl"`)
+    c.Status(http.StatusOK)
+    _ = g.s.ExportAudit(c.Request.Context(), q, c.Writer)
+}
+
+// RegisterClient the client secret is only shown in this response
+func (g *ginAdminAdapter) RegisterClient(c *gin.Context) {
+    admin, ok := g.admin(c)
+    if !ok {
+        return
+    }
+
+    var clientArgs ClientParams
+    if err := c.ShouldBindJSON(&clientArgs); err != nil {
+        ginProblem(c, invalidf("invalid json provided"))
+        return
+    }
+
+    reg, err := g.s.RegisterClient(c.Request.Context(), &clientArgs)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditClientRegister, ActorId: admin.UserId, Detail: reg.ClientId})
+    c.JSON(http.StatusCreated, reg)
+}
+
+// DeleteClient the client is selected with the `:client_id` route parameter or the `client_id` query parameter
+func (g *ginAdminAdapter) DeleteClient(c *gin.Context) {
+    admin, ok := g.admin(c)
+    if !ok {
+        return
+    }
+
+    clientId := clientIdParam(c)
+    if err := g.s.DeleteClient(c.Request.Context(), clientId); err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditClientDelete, ActorId: admin.UserId, Detail: clientId})
+    c.JSON(http.StatusOK, "Client deleted")
+}
+
+// CreateServiceAccount the secret is only shown in this response
+func (g *ginAdminAdapter) CreateServiceAccount(c *gin.Context) {
+    admin, ok := g.admin(c)
+    if !ok {
+        return
+    }
+
+    var accountArgs ServiceAccountParams
+    if err := c.ShouldBindJSON(&accountArgs); err != nil {
+        ginProblem(c, invalidf("invalid json provided"))
+        return
+    }
+
+    reg, err := g.s.CreateServiceAccount(c.Request.Context(), &accountArgs)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditServiceAccountCreate, ActorId: admin.UserId, Detail: reg.ClientId})
+    c.JSON(http.StatusCreated, reg)
+}
+
+func (g *ginAdminAdapter) ListServiceAccounts(c *gin.Context) {
+    if _, ok := g.admin(c); !ok {
+        return
+    }
+
+    accounts, err := g.s.ListServiceAccounts(c.Request.Context())
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, accounts)
+}
+
+// RotateServiceAccountSecret the account is selected with the `:client_id` route parameter or the `client_id` query parameter
+func (g *ginAdminAdapter) RotateServiceAccountSecret(c *gin.Context) {
+    admin, ok := g.admin(c)
+    if !ok {
+        return
+    }
+
+    clientId := clientIdParam(c)
+    reg, err := g.s.RotateServiceAccountSecret(c.Request.Context(), clientId)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditServiceAccountRotate, ActorId: admin.UserId, Detail: clientId})
+    c.JSON(http.StatusOK, reg)
+}
+
+// DeleteServiceAccount the account is selected with the `:client_id` route parameter or the `client_id` query parameter
+func (g *ginAdminAdapter) DeleteServiceAccount(c *gin.Context) {
+    admin, ok := g.admin(c)
+    if !ok {
+        return
+    }
+
+    clientId := clientIdParam(c)
+    if err := g.s.DeleteServiceAccount(c.Request.Context(), clientId); err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditServiceAccountDelete, ActorId: admin.UserId, Detail: clientId})
+    c.JSON(http.StatusOK, "Service account deleted")
+}
@@ -0,0 +1,422 @@
+package authr
+
+import (
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// HttpAdminAdapter mux admin func exposed, every handler requires the admin role
+type HttpAdminAdapter interface {
+    ListUsers(w http.ResponseWriter, r *http.Request)
+    GetUser(w http.ResponseWriter, r *http.Request)
+    SetRoles(w http.ResponseWriter, r *http.Request)
+    SetAttributes(w http.ResponseWriter, r *http.Request)
+    DisableUser(w http.ResponseWriter, r *http.Request)
+    EnableUser(w http.ResponseWriter, r *http.Request)
+    SetStatus(w http.ResponseWriter, r *http.Request)
+    ForcePasswordReset(w http.ResponseWriter, r *http.Request)
+    DeleteUser(w http.ResponseWriter, r *http.Request)
+    ListSessions(w http.ResponseWriter, r *http.Request)
+    RevokeSessions(w http.ResponseWriter, r *http.Request)
+    Impersonate(w http.ResponseWriter, r *http.Request)
+    StopImpersonation(w http.ResponseWriter, r *http.Request)
+    AuditLog(w http.ResponseWriter, r *http.Request)
+    ExportAudit(w http.ResponseWriter, r *http.Request)
+    RegisterClient(w http.ResponseWriter, r *http.Request)
+    DeleteClient(w http.ResponseWriter, r *http.Request)
+    CreateServiceAccount(w http.ResponseWriter, r *http.Request)
+    ListServiceAccounts(w http.ResponseWriter, r *http.Request)
+    RotateServiceAccountSecret(w http.ResponseWriter, r *http.Request)
+    DeleteServiceAccount(w http.ResponseWriter, r *http.Request)
+}
+
+// NewHttpAdminAdapter users are selected with the `id` query parameter
+func NewHttpAdminAdapter(s AuthService) HttpAdminAdapter {
+    return &httpAdminAdapter{s: s}
+}
+
+type httpAdminAdapter struct {
+    s AuthService
+}
+
+// admin check the request carries a live token with the admin role, restricted credentials need ScopeAdmin
+func (g *httpAdminAdapter) admin(w http.ResponseWriter, r *http.Request) (*AccessDetails, bool) {
+    metadata, err := g.s.AuthorizeScopes(r, ScopeAdmin)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return nil, false
+    }
+    if err = adminAccess(metadata); err != nil {
+        ProblemJSON(w, r, err)
+        return nil, false
+    }
+    return metadata, true
+}
+
+func (g *httpAdminAdapter) ListUsers(w http.ResponseWriter, r *http.Request) {
+    if _, ok := g.admin(w, r); !ok {
+        return
+    }
+
+    q := r.URL.Query()
+    page, _ := strconv.Atoi(q.Get("page"))
+    pageSize, _ := strconv.Atoi(q.Get("page_size"))
+
+    users, err := g.s.ListUsers(r.Context(), &UserQuery{Search: q.Get("search"), Page: page, PageSize: pageSize})
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    JSON(w, http.StatusOK, users)
+}
+
+func (g *httpAdminAdapter) GetUser(w http.ResponseWriter, r *http.Request) {
+    if _, ok := g.admin(w, r); !ok {
+        return
+    }
+
+    user, err := g.s.GetUser(r.Context(), r.URL.Query().Get("id"))
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    JSON(w, http.StatusOK, user)
+}
+
+func (g *httpAdminAdapter) SetRoles(w http.ResponseWriter, r *http.Request) {
+    admin, ok := g.admin(w, r)
+    if !ok {
+        return
+    }
+
+    var rolesArgs RolesParams
+    if err := ShouldBindJSON(r, &rolesArgs); err != nil {
+        ProblemJSON(w, r, invalidf("invalid json provided"))
+        return
+    }
+
+    user, err := g.s.SetRoles(r.Context(), r.URL.Query().Get("id"), rolesArgs.Roles)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditRoleChange, ActorId: admin.UserId, TargetId: r.URL.Query().Get("id"), Detail: strings.Join(rolesArgs.Roles, ",")})
+    JSON(w, http.StatusOK, user)
+}
+
+func (g *httpAdminAdapter) SetAttributes(w http.ResponseWriter, r *http.Request) {
+    admin, ok := g.admin(w, r)
+    if !ok {
+        return
+    }
+
+    var attributesArgs AttributesParams
+    if err := ShouldBindJSON(r, &attributesArgs); err != nil {
+        ProblemJSON(w, r, invalidf("invalid json provided"))
+        return
+    }
+
+    user, err := g.s.SetAttributes(r.Context(), r.URL.Query().Get("id"), attributesArgs.Attributes)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditAttributeChange, ActorId: admin.UserId, TargetId: r.URL.Query().Get("id"), Detail: attributeNames(attributesArgs.Attributes)})
+    JSON(w, http.StatusOK, user)
+}
+
+func (g *httpAdminAdapter) DisableUser(w http.ResponseWriter, r *http.Request) {
+    admin, ok := g.admin(w, r)
+    if !ok {
+        return
+    }
+
+    if err := g.s.DisableUser(r.Context(), r.URL.Query().Get("id")); err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditStatusChange, ActorId: admin.UserId, TargetId: r.URL.Query().Get("id"), Detail: string(StatusDisabled)})
+    JSON(w, http.StatusOK, "User disabled")
+}
+
+func (g *httpAdminAdapter) EnableUser(w http.ResponseWriter, r *http.Request) {
+    admin, ok := g.admin(w, r)
+    if !ok {
+        return
+    }
+
+    if err := g.s.EnableUser(r.Context(), r.URL.Query().Get("id")); err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditStatusChange, ActorId: admin.UserId, TargetId: r.URL.Query().Get("id"), Detail: string(StatusActive)})
+    JSON(w, http.StatusOK, "User enabled")
+}
+
+func (g *httpAdminAdapter) SetStatus(w http.ResponseWriter, r *http.Request) {
+    admin, ok := g.admin(w, r)
+    if !ok {
+        return
+    }
+
+    var statusArgs StatusParams
+    if err := ShouldBindJSON(r, &statusArgs); err != nil {
+        ProblemJSON(w, r, invalidf("invalid json provided"))
+        return
+    }
+
+    if err := g.s.SetStatus(r.Context(), r.URL.Query().Get("id"), statusArgs.Status); err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditStatusChange, ActorId: admin.UserId, TargetId: r.URL.Query().Get("id"), Detail: string(statusArgs.Status)})
+    JSON(w, http.StatusOK, "Status changed")
+}
+
+func (g *httpAdminAdapter) ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+    admin, ok := g.admin(w, r)
+    if !ok {
+        return
+    }
+
+    if err := g.s.ForcePasswordReset(r.Context(), r.URL.Query().Get("id")); err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditPasswordReset, ActorId: admin.UserId, TargetId: r.URL.Query().Get("id")})
+    JSON(w, http.StatusOK, "Password reset")
+}
+
+func (g *httpAdminAdapter) DeleteUser(w http.ResponseWriter, r *http.Request) {
+    admin, ok := g.admin(w, r)
+    if !ok {
+        return
+    }
+
+    if err := g.s.DeleteUser(r.Context(), r.URL.Query().Get("id")); err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditUserDelete, ActorId: admin.UserId, TargetId: r.URL.Query().Get("id")})
+    JSON(w, http.StatusOK, "User deleted")
+}
+
+func (g *httpAdminAdapter) ListSessions(w http.ResponseWriter, r *http.Request) {
+    if _, ok := g.admin(w, r); !ok {
+        return
+    }
+
+    sessions, err := g.s.ListSessions(r.Context(), r.URL.Query().Get("id"))
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    JSON(w, http.StatusOK, sessions)
+}
+
+// RevokeSessions revoke the `session` query parameter, or every session of the user when omitted
+func (g *httpAdminAdapter) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+    admin, ok := g.admin(w, r)
+    if !ok {
+        return
+    }
+
+    q := r.URL.Query()
+    var err error
+    if session := q.Get("session"); session != "" {
+        err = g.s.RevokeSession(r.Context(), q.Get("id"), session)
+    } else {
+        err = g.s.RevokeSessions(r.Context(), q.Get("id"))
+    }
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.Metrics().revocation(adapterHttp, "admin")
+    g.s.Reporter().Publish(&Event{Type: EventTokenRevoked, Request: r, UserId: r.URL.Query().Get("id"), ActorId: admin.UserId, Reason: q.Get("session")})
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditSessionRevoke, ActorId: admin.UserId, TargetId: r.URL.Query().Get("id"), Detail: q.Get("session")})
+    JSON(w, http.StatusOK, "Sessions revoked")
+}
+
+func (g *httpAdminAdapter) Impersonate(w http.ResponseWriter, r *http.Request) {
+    actor, ok := g.admin(w, r)
+    if !ok {
+        return
+    }
+
+    targetId := r.URL.Query().Get("id")
+    ts, err := g.s.Impersonate(r.Context(), actor, targetId)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+
+    g.s.Reporter().Publish(&Event{Type: EventImpersonationStart, Request: r, UserId: targetId, ActorId: actor.UserId})
+    g.s.Reporter().Publish(&Event{Type: EventTokenGranted, Request: r, UserId: targetId, ActorId: actor.UserId, Token: ts})
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditImpersonationStart, ActorId: actor.UserId, TargetId: targetId})
+    JSON(w, http.StatusOK, ts)
+}
+
+// StopImpersonation called with the impersonated token, not the admin one
+func (g *httpAdminAdapter) StopImpersonation(w http.ResponseWriter, r *http.Request) {
+    session, err := g.s.Authorize(r)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+
+    if err = g.s.StopImpersonation(r.Context(), session); err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+
+    g.s.Metrics().revocation(adapterHttp, "impersonation")
+    g.s.Reporter().Publish(&Event{Type: EventImpersonationStop, Request: r, UserId: session.UserId, ActorId: session.ActorId})
+    g.s.Reporter().Publish(&Event{Type: EventTokenRevoked, Request: r, UserId: session.UserId, ActorId: session.ActorId, Token: &TokenDetails{ID: session.UserId, TokenUuid: session.TokenUuid}})
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditImpersonationStop, ActorId: session.ActorId, TargetId: session.UserId})
+    JSON(w, http.StatusOK, "Impersonation stopped")
+}
+
+func (g *httpAdminAdapter) AuditLog(w http.ResponseWriter, r *http.Request) {
+    if _, ok := g.admin(w, r); !ok {
+        return
+    }
+
+    q, err := auditQueryParams(r.URL.Query())
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+
+    events, err := g.s.AuditLog(r.Context(), q)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    JSON(w, http.StatusOK, events)
+}
+
+// ExportAudit stream the matching events as JSON Lines
+func (g *httpAdminAdapter) ExportAudit(w http.ResponseWriter, r *http.Request) {
+    if _, ok := g.admin(w, r); !ok {
+        return
+    }
+
+    q, err := auditQueryParams(r.URL.Query())
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/jsonl")
+    w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+    w.WriteHeader(http.StatusOK)
+    _ = g.s.ExportAudit(r.Context(), q, w)
+}
+
+// RegisterClient the client secret is only shown in this response
+func (g *httpAdminAdapter) RegisterClient(w http.ResponseWriter, r *http.Request) {
+    admin, ok := g.admin(w, r)
+    if !ok {
+        return
+    }
+
+    var clientArgs ClientParams
+    if err := ShouldBindJSON(r, &clientArgs); err != nil {
+        ProblemJSON(w, r, invalidf("invalid json provided"))
+        return
+    }
+
+    reg, err := g.s.RegisterClient(r.Context(), &clientArgs)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditClientRegister, ActorId: admin.UserId, Detail: reg.ClientId})
+    JSON(w, http.StatusCreated, reg)
+}
+
+// DeleteClient the client is selected with the `client_id` query parameter
+func (g *httpAdminAdapter) DeleteClient(w http.ResponseWriter, r *http.Request) {
+    admin, ok := g.admin(w, r)
+    if !ok {
+        return
+    }
+
+    clientId := r.URL.Query().Get("client_id")
+    if err := g.s.DeleteClient(r.Context(), clientId); err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditClientDelete, ActorId: admin.UserId, Detail: clientId})
+    JSON(w, http.StatusOK, "Client deleted")
+}
+
+// CreateServiceAccount the secret is only shown in this response
+func (g *httpAdminAdapter) CreateServiceAccount(w http.ResponseWriter, r *http.Request) {
+    admin, ok := g.admin(w, r)
+    if !ok {
+        return
+    }
+
+    var accountArgs ServiceAccountParams
+    if err := ShouldBindJSON(r, &accountArgs); err != nil {
+        ProblemJSON(w, r, invalidf("invalid json provided"))
+        return
+    }
+
+    reg, err := g.s.CreateServiceAccount(r.Context(), &accountArgs)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditServiceAccountCreate, ActorId: admin.UserId, Detail: reg.ClientId})
+    JSON(w, http.StatusCreated, reg)
+}
+
+func (g *httpAdminAdapter) ListServiceAccounts(w http.ResponseWriter, r *http.Request) {
+    if _, ok := g.admin(w, r); !ok {
+        return
+    }
+
+    accounts, err := g.s.ListServiceAccounts(r.Context())
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    JSON(w, http.StatusOK, accounts)
+}
+
+// RotateServiceAccountSecret the account is selected with the `client_id` query parameter
+func (g *httpAdminAdapter) RotateServiceAccountSecret(w http.ResponseWriter, r *http.Request) {
+    admin, ok := g.admin(w, r)
+    if !ok {
+        return
+    }
+
+    clientId := r.URL.Query().Get("client_id")
+    reg, err := g.s.RotateServiceAccountSecret(r.Context(), clientId)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditServiceAccountRotate, ActorId: admin.UserId, Detail: clientId})
+    JSON(w, http.StatusOK, reg)
+}
+
+// DeleteServiceAccount the account is selected with the `client_id` query parameter
+func (g *httpAdminAdapter) DeleteServiceAccount(w http.ResponseWriter, r *http.Request) {
+    admin, ok := g.admin(w, r)
+    if !ok {
+        return
+    }
+
+    clientId := r.URL.Query().Get("client_id")
+    if err := g.s.DeleteServiceAccount(r.Context(), clientId); err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditServiceAccountDelete, ActorId: admin.UserId, Detail: clientId})
+    JSON(w, http.StatusOK, "Service account deleted")
+}
@@ -0,0 +1,94 @@
+package authr
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestResetPasswordConcurrentRedeem(t *testing.T) {
+    s := newTestService(t)
+    c := context.Background()
+    user := newTestUser(t, s, "ann", "secret")
+    reset := &PasswordReset{UserId: user.ID, TokenHash: hashToken("reset-token"), Expires: time.Now().Add(time.Hour)}
+    if err := s.db.Create(reset).Error; err != nil {
+        t.Fatal(err)
+    }
+
+    const attempts = 4
+    errs := make([]error, attempts)
+    var wg sync.WaitGroup
+    for i := range errs {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            _, errs[i] = s.ResetPassword(c, &PasswordResetParams{Token: "reset-token", Password: "new-secret"})
+        }(i)
+    }
+    wg.Wait()
+
+    won := 0
+    for _, err := range errs {
+        switch {
+        case err == nil:
+            won++
+        case !errors.Is(err, ErrTokenUsed):
+            t.Errorf("ResetPassword = %v, want nil or ErrTokenUsed", err)
+        }
+    }
+    if won != 1 {
+        t.Errorf("%d resets redeemed the token, want 1", won)
+    }
+}
+
+func TestRegisterDeletedUsername(t *testing.T) {
+    s := newTestService(t)
+    c := context.Background()
+    user := newTestUser(t, s, "ann", "secret")
+    if err := s.DeleteUser(c, user.ID); err != nil {
+        t.Fatal(err)
+    }
+
+    _, err := s.RegisterUser(c, &RegistrationParams{Username: "ann", Password: "secret", Email: "ann@example.com"})
+    if !errors.Is(err, ErrUserExists) {
+        t.Errorf("RegisterUser = %v, want ErrUserExists", err)
+    }
+}
+
+func TestImpersonate(t *testing.T) {
+    s := newTestService(t)
+    c := context.Background()
+    admin := newTestUser(t, s, "root", "secret", RoleAdmin.String())
+    user := newTestUser(t, s, "ann", "secret")
+    actor, err := s.Authorize(bearerRequest(newTestLogin(t, s, admin).AccessToken))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    td, err := s.Impersonate(c, actor, user.ID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if td.RefreshToken != "" || td.RtExpires != td.AtExpires {
+        t.Errorf("impersonation issued a refresh token expiring %d", td.RtExpires)
+    }
+    var tokens []AuthTokens
+    if err = s.db.Where("user_id = ?", user.ID).Find(&tokens).Error; err != nil {
+        t.Fatal(err)
+    }
+    if len(tokens) != 1 || tokens[0].ActorId != admin.ID {
+        t.Errorf("stored tokens = %+v, want one access token with actor %s", tokens, admin.ID)
+    }
+}
+
+func TestUserWithoutRoles(t *testing.T) {
+    user := &User{ID: "u1", Username: "ann"}
+    if roles := user.Record().Roles; roles == nil || len(roles) != 0 {
+        t.Errorf("Record roles = %q, want empty", roles)
+    }
+    if roles := user.Profile().Roles; roles == nil || len(roles) != 0 {
+        t.Errorf("Profile roles = %q, want empty", roles)
+    }
+}
@@ -0,0 +1,158 @@
+package authr
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/hex"
+    "errors"
+    "github.com/dgrijalva/jwt-go"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// API keys look like ak_<8 hex prefix>_<secret>, the prefix finds the row, the hash of the whole key proves it
+const (
+    apiKeyTag       = "ak_"
+    apiKeyPrefixLen = 8
+    apiKeyLen       = len(apiKeyTag) + apiKeyPrefixLen + 1 + 43
+)
+
+// ScopeAdmin scope an API key needs on the admin endpoints, on top of the admin role of its user
+const ScopeAdmin = "admin"
+
+// APIKeyService personal API keys. Unscoped keys are accepted wherever an access token is except on the
+// admin endpoints, scoped keys only by ScopedAuthMiddleware and AuthorizeScopes.
+type APIKeyService interface {
+    CreateAPIKey(c context.Context, userId string, args *APIKeyParams) (*APIKeyCreated, error)
+    ListAPIKeys(c context.Context, userId string) ([]*APIKey, error)
+    RevokeAPIKey(c context.Context, userId, keyId string) error
+}
+
+func (s *service) CreateAPIKey(c context.Context, userId string, args *APIKeyParams) (*APIKeyCreated, error) {
+    if args == nil || strings.TrimSpace(args.Name) == "" || args.ExpiresIn < 0 {
+        return nil, invalidf("api key params are invalid")
+    }
+    user, err := s.LoadUser(c, userId)
+    if err != nil {
+        return nil, err
+    }
+
+    b := make([]byte, apiKeyPrefixLen/2)
+    if _, err = rand.Read(b); err != nil {
+        return nil, err
+    }
+    secret, err := randomToken()
+    if err != nil {
+        return nil, err
+    }
+    prefix := hex.EncodeToString(b)
+    key := apiKeyTag + prefix + "_" + secret
+
+    apiKey := &APIKey{
+        UserId:  user.ID,
+        Prefix:  prefix,
+        KeyHash: hashToken(key),
+        Name:    strings.TrimSpace(args.Name),
+        Scopes:  args.Scopes,
+    }
+    if args.ExpiresIn > 0 {
+        expires := time.Now().Add(time.Duration(args.ExpiresIn) * time.Second)
+        apiKey.Expires = &expires
+    }
+    if err = s.db.WithContext(c).Create(apiKey).Error; err != nil {
+        return nil, storeErr("CreateAPIKey", err)
+    }
+    return &APIKeyCreated{APIKey: apiKey, Key: key}, nil
+}
+
+func (s *service) ListAPIKeys(c context.Context, userId string) ([]*APIKey, error) {
+    var keys []*APIKey
+    if err := s.db.WithContext(c).Where("user_id = ?", userId).Order("created_at").Find(&keys).Error; err != nil {
+        return nil, storeErr("ListAPIKeys", err)
+    }
+    return keys, nil
+}
+
+// RevokeAPIKey keys of other users are reported as not found
+func (s *service) RevokeAPIKey(c context.Context, userId, keyId string) error {
+    res := s.db.WithContext(c).Where("user_id = ? AND prefix = ?", userId, keyId).Delete(&APIKey{})
+    if res.Error != nil {
+        return storeErr("RevokeAPIKey", res.Error)
+    }
+    if res.RowsAffected == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
+
+// isAPIKey tell API keys from JWTs and session ids before any lookup
+func isAPIKey(token string) bool {
+    return len(token) == apiKeyLen && strings.HasPrefix(token, apiKeyTag) && token[len(apiKeyTag)+apiKeyPrefixLen] == '_'
+}
+
+// apiKeyMetadata resolve an API key to the AccessDetails a token of its user would yield
+func (s *service) apiKeyMetadata(c context.Context, key string) (*AccessDetails, error) {
+    prefix := key[len(apiKeyTag) : len(apiKeyTag)+apiKeyPrefixLen]
+    apiKey := &APIKey{}
+    err := s.db.WithContext(c).Where("prefix = ?", prefix).First(apiKey).Error
+    if err != nil {
+        if err = storeErr("apiKeyMetadata", err); errors.Is(err, ErrNotFound) {
+            return nil, ErrTokenInvalid
+        }
+        return nil, err
+    }
+    if subtle.ConstantTimeCompare([]byte(apiKey.KeyHash), []byte(hashToken(key))) != 1 {
+        return nil, ErrTokenInvalid
+    }
+    now := time.Now()
+    if apiKey.Expires != nil && now.After(*apiKey.Expires) {
+        return nil, ErrTokenExpired
+    }
+    // at most one write a minute per key
+    if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > time.Minute {
+        err = s.db.WithContext(c).Model(apiKey).Update("last_used_at", &now).Error
+        if err != nil {
+            return nil, storeErr("apiKeyMetadata", err)
+        }
+    }
+
+    user, err := s.LoadUser(c, apiKey.UserId)
+    if err != nil {
+        return nil, err
+    }
+
+    claims := jwt.MapClaims{
+        JwtAccessUuid: apiKey.Prefix,
+        JwtUserId:     user.ID,
+        JwtRole:       user.Roles,
+    }
+    for k, v := range s.projectAttributes(user) {
+        claims[k] = v
+    }
+    if len(apiKey.Scopes) > 0 {
+        claims[JwtScope] = strings.Join(apiKey.Scopes, " ")
+    }
+    if apiKey.Expires != nil {
+        claims[JwtExpires] = apiKey.Expires.Unix()
+    }
+
+    return &AccessDetails{
+        TokenUuid: apiKey.Prefix,
+        UserId:    user.ID,
+        Role:      user.Roles,
+        Principal: PrincipalUser,
+        KeyId:     apiKey.Prefix,
+        Claims:    claims,
+    }, nil
+}
+
+// requestAPIKey the API key carried by r, "" when it carries a token, a session id or nothing
+func (s *service) requestAPIKey(r *http.Request) string {
+    token, err := s.requestExtractors(r).ExtractToken(r)
+    if err != nil || !isAPIKey(token) {
+        return ""
+    }
+    return token
+}
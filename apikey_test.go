@@ -0,0 +1,80 @@
+package authr
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestAPIKeyScopes(t *testing.T) {
+    tests := []struct {
+        name      string
+        scopes    []string
+        authorize error
+        read      error
+        write     error
+    }{
+        {"unscoped key", nil, nil, nil, nil},
+        {"read key", []string{"read"}, ErrInsufficientScope, nil, ErrInsufficientScope},
+        {"read write key", []string{"read", "write"}, ErrInsufficientScope, nil, nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := newTestService(t)
+            user := newTestUser(t, s, "ann", "secret")
+            key, err := s.CreateAPIKey(context.Background(), user.ID, &APIKeyParams{Name: "ci", Scopes: tt.scopes})
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            if _, err = s.Authorize(bearerRequest(key.Key)); !errors.Is(err, tt.authorize) {
+                t.Errorf("Authorize = %v, want %v", err, tt.authorize)
+            }
+            if _, err = s.AuthorizeScopes(bearerRequest(key.Key), "read"); !errors.Is(err, tt.read) {
+                t.Errorf("AuthorizeScopes read = %v, want %v", err, tt.read)
+            }
+            if _, err = s.AuthorizeScopes(bearerRequest(key.Key), "write"); !errors.Is(err, tt.write) {
+                t.Errorf("AuthorizeScopes write = %v, want %v", err, tt.write)
+            }
+        })
+    }
+}
+
+func TestAdminEndpointCredentials(t *testing.T) {
+    tests := []struct {
+        name   string
+        role   string
+        key    bool
+        scopes []string
+        want   int
+    }{
+        {"admin token", "ROLE_ADMIN", false, nil, http.StatusOK},
+        {"user token", "ROLE_USER", false, nil, http.StatusForbidden},
+        {"unscoped admin key", "ROLE_ADMIN", true, nil, http.StatusForbidden},
+        {"admin key without admin scope", "ROLE_ADMIN", true, []string{"read"}, http.StatusForbidden},
+        {"admin key with admin scope", "ROLE_ADMIN", true, []string{ScopeAdmin}, http.StatusOK},
+        {"user key with admin scope", "ROLE_USER", true, []string{ScopeAdmin}, http.StatusForbidden},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := newTestService(t)
+            user := newTestUser(t, s, "ann", "secret", tt.role)
+            token := newTestLogin(t, s, user).AccessToken
+            if tt.key {
+                key, err := s.CreateAPIKey(context.Background(), user.ID, &APIKeyParams{Name: "ci", Scopes: tt.scopes})
+                if err != nil {
+                    t.Fatal(err)
+                }
+                token = key.Key
+            }
+
+            w := httptest.NewRecorder()
+            NewHttpAdminAdapter(s).ListUsers(w, bearerRequest(token))
+            if w.Code != tt.want {
+                t.Errorf("ListUsers status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+            }
+        })
+    }
+}
@@ -0,0 +1,179 @@
+package authr
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "gorm.io/gorm"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+)
+
+type AuditEventType string
+
+const (
+    AuditLoginSuccess         AuditEventType = "login_success"
+    AuditLoginFailure         AuditEventType = "login_failure"
+    AuditRegister             AuditEventType = "register"
+    AuditRefresh              AuditEventType = "refresh"
+    AuditLogout               AuditEventType = "logout"
+    AuditRoleChange           AuditEventType = "role_change"
+    AuditAttributeChange      AuditEventType = "attribute_change"
+    AuditStatusChange         AuditEventType = "status_change"
+    AuditPasswordChange       AuditEventType = "password_change"
+    AuditPasswordReset        AuditEventType = "password_reset"
+    AuditUserDelete           AuditEventType = "user_delete"
+    AuditSessionRevoke        AuditEventType = "session_revoke"
+    AuditImpersonationStart   AuditEventType = "impersonation_start"
+    AuditImpersonationStop    AuditEventType = "impersonation_stop"
+    AuditOAuthConsent         AuditEventType = "oauth_consent"
+    AuditOAuthToken           AuditEventType = "oauth_token"
+    AuditClientRegister       AuditEventType = "client_register"
+    AuditClientDelete         AuditEventType = "client_delete"
+    AuditServiceAccountCreate AuditEventType = "service_account_create"
+    AuditServiceAccountRotate AuditEventType = "service_account_rotate"
+    AuditServiceAccountDelete AuditEventType = "service_account_delete"
+    AuditAPIKeyCreate         AuditEventType = "api_key_create"
+    AuditAPIKeyRevoke         AuditEventType = "api_key_revoke"
+    AuditIdentityLink         AuditEventType = "identity_link"
+    AuditIdentityUnlink       AuditEventType = "identity_unlink"
+)
+
+const maxAuditLimit = 1000
+
+var errAuditAppendOnly = errors.New("audit log is append-only")
+
+// BeforeUpdate audit events can never be changed
+func (e *AuditEvent) BeforeUpdate(tx *gorm.DB) error {
+    return errAuditAppendOnly
+}
+
+// BeforeDelete audit events can never be removed
+func (e *AuditEvent) BeforeDelete(tx *gorm.DB) error {
+    return errAuditAppendOnly
+}
+
+// RecordAudit append an event, the time, ip and user agent are taken from the request
+func (s *service) RecordAudit(r *http.Request, ev *AuditEvent) error {
+    if ev.Time.IsZero() {
+        ev.Time = time.Now()
+    }
+    if r != nil {
+        ev.IP = clientIP(r)
+        ev.UserAgent = r.UserAgent()
+    }
+    tx := s.db
+    if r != nil {
+        tx = tx.WithContext(r.Context())
+    }
+    if err := tx.Create(ev).Error; err != nil {
+        s.log.Warn("RecordAudit", "type", ev.Type, "target_id", ev.TargetId, "err", err)
+        return storeErr("RecordAudit", err)
+    }
+    return nil
+}
+
+// AuditLog events matching the query, newest first
+func (s *service) AuditLog(c context.Context, q *AuditQuery) ([]*AuditEvent, error) {
+    if q == nil {
+        q = &AuditQuery{}
+    }
+    limit := q.Limit
+    if limit < 1 || limit > maxAuditLimit {
+        limit = maxAuditLimit
+    }
+
+    var events []*AuditEvent
+    err := s.auditQuery(c, q).Offset(q.Offset).Limit(limit).Find(&events).Error
+    if err != nil {
+        return nil, storeErr("AuditLog", err)
+    }
+    return events, nil
+}
+
+// ExportAudit write every event matching the query as JSON Lines
+func (s *service) ExportAudit(c context.Context, q *AuditQuery, w io.Writer) error {
+    if q == nil {
+        q = &AuditQuery{}
+    }
+
+    tx := s.auditQuery(c, q).Offset(q.Offset)
+    if q.Limit > 0 {
+        tx = tx.Limit(q.Limit)
+    }
+    rows, err := tx.Rows()
+    if err != nil {
+        return storeErr("ExportAudit", err)
+    }
+    defer rows.Close()
+
+    enc := json.NewEncoder(w)
+    for rows.Next() {
+        var ev AuditEvent
+        if err = s.db.ScanRows(rows, &ev); err != nil {
+            return err
+        }
+        if err = enc.Encode(&ev); err != nil {
+            return err
+        }
+    }
+    return rows.Err()
+}
+
+func (s *service) auditQuery(c context.Context, q *AuditQuery) *gorm.DB {
+    tx := s.db.WithContext(c).Model(&AuditEvent{}).Order("time desc, id desc")
+    if q.UserId != "" {
+        tx = tx.Where("actor_id = ? OR target_id = ?", q.UserId, q.UserId)
+    }
+    if q.Type != "" {
+        tx = tx.Where("type = ?", q.Type)
+    }
+    if !q.From.IsZero() {
+        tx = tx.Where("time >= ?", q.From)
+    }
+    if !q.To.IsZero() {
+        tx = tx.Where("time < ?", q.To)
+    }
+    return tx
+}
+
+// auditQueryParams parse user_id, type, from, to (RFC 3339), limit and offset
+func auditQueryParams(v url.Values) (*AuditQuery, error) {
+    q := &AuditQuery{UserId: v.Get("user_id"), Type: AuditEventType(v.Get("type"))}
+
+    var err error
+    if from := v.Get("from"); from != "" {
+        if q.From, err = time.Parse(time.RFC3339, from); err != nil {
+            return nil, invalidf("from is invalid")
+        }
+    }
+    if to := v.Get("to"); to != "" {
+        if q.To, err = time.Parse(time.RFC3339, to); err != nil {
+            return nil, invalidf("to is invalid")
+        }
+    }
+    q.Limit, _ = strconv.Atoi(v.Get("limit"))
+    q.Offset, _ = strconv.Atoi(v.Get("offset"))
+    return q, nil
+}
+
+// actorOf the user behind a session, the admin for impersonated sessions
+func actorOf(a *AccessDetails) string {
+    if a.Impersonated() {
+        return a.ActorId
+    }
+    return a.UserId
+}
+
+// clientIP remote address of the request without the port, proxy headers are not trusted
+func clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
@@ -4,12 +4,12 @@ import (
     "context"
     "errors"
     "fmt"
-    "github.com/davecgh/go-spew/spew"
     "github.com/dgrijalva/jwt-go"
+    "go.opentelemetry.io/otel/trace"
     "golang.org/x/crypto/bcrypt"
     "gorm.io/gorm"
+    "io"
     "net/http"
-    "os"
     "time"
 )
 
@@ -22,93 +22,205 @@ type AuthService interface {
     SaveAuth(context.Context, string, *TokenDetails) error
     FetchAuth(context.Context, string) (*AuthTokens, error)
     DeleteRefresh(context.Context, string) error
+    RotateRefresh(c context.Context, refreshUuid, userId string, td *TokenDetails) error
     DeleteTokens(context.Context, *AccessDetails) error
     RegisterUser(context.Context, *RegistrationParams) (*User, error)
     LoginUser(c context.Context, args *LoginParams) (*User, error)
+    GetProfile(c context.Context, userId string) (*Profile, error)
+    UpdateProfile(c context.Context, userId string, args *ProfileParams) (*Profile, error)
+    RequestEmailChange(c context.Context, userId string, args *EmailChangeParams) error
+    ConfirmEmailChange(c context.Context, token string) error
+    RevertEmailChange(c context.Context, token string) error
+    ResetPassword(c context.Context, args *PasswordResetParams) (string, error)
+    Authorize(r *http.Request) (*AccessDetails, error)
+    AuthorizeScopes(r *http.Request, scopes ...string) (*AccessDetails, error)
+    ChangePassword(c context.Context, userId string, args *ChangePasswordParams) error
+    Impersonate(c context.Context, actor *AccessDetails, targetId string) (*TokenDetails, error)
+    StopImpersonation(c context.Context, session *AccessDetails) error
+    Reporter() *AuthReporter
+    Metrics() *Metrics
+    Tracer() trace.Tracer
+    Cookies() *CookieConfig
+    RecordAudit(r *http.Request, ev *AuditEvent) error
+    AuditLog(c context.Context, q *AuditQuery) ([]*AuditEvent, error)
+    ExportAudit(c context.Context, q *AuditQuery, w io.Writer) error
+    AdminService
+    OAuthService
+    OIDCService
+    ServiceAccountService
+    APIKeyService
+    FederationService
+    SAMLService
 
     // proxied token calls
-    CreateToken(u *User) (*TokenDetails, error)
-    RefreshToken(u *User, claims jwt.MapClaims) (*TokenDetails, error)
+    CreateToken(c context.Context, u *User) (*TokenDetails, error)
+    RefreshToken(c context.Context, u *User, claims jwt.MapClaims) (*TokenDetails, error)
     ExtractTokenMetadata(*http.Request) (*AccessDetails, error)
     RefreshSecret() string
     TokenValid(r *http.Request) error
 }
 
-type LoginFailure func(*http.Request, string)
-type TokenGranted func(*http.Request, *TokenDetails)
-type TokenRevoked func(*http.Request, *TokenDetails)
-
-type AuthReporter struct {
-    loginFailure LoginFailure
-    tokenGranted TokenGranted
-    tokenRevoked TokenRevoked
+type service struct {
+    ts                TokenInterface
+    db                *gorm.DB
+    r                 *AuthReporter
+    claimAttributes   []string
+    registrationRoles []string
+    mailer            Mailer
+    confirmURL        string
+    revertURL         string
+    resetURL          string
+    log               Logger
+    metrics           *Metrics
+    tracer            trace.Tracer
+    cookies           *CookieConfig
+    extractors        []TokenExtractor
+    sessions          *SessionConfig
+    deviceURL         string
+    providers         map[string]*federatedProvider
+    ldap              *LDAPConfig
+    authenticators    []Authenticator
+    saml              *samlProvider
+    oidc              *OIDCConfig
 }
 
-type service struct {
-    ts TokenInterface
-    db *gorm.DB
-    r  *AuthReporter
+// Option configures optional behaviour of the auth service
+type Option func(*service)
+
+// WithClaimAttributes allow-list of User.Attributes keys that are projected into the JWT claims.
+// Relying parties trust these claims, so users can not change them with UpdateProfile, admins set them with SetAttributes.
+func WithClaimAttributes(names ...string) Option {
+    return func(s *service) {
+        s.claimAttributes = append(s.claimAttributes, names...)
+    }
 }
 
 // NewAuthService create new auth service
-func NewAuthService(ts TokenInterface, db *gorm.DB, r *AuthReporter) (AuthService, error) {
-    s := &service{ts: ts, db: db, r: r}
-    err := s.InitialMigration()
-    return s, err
+func NewAuthService(ts TokenInterface, db *gorm.DB, r *AuthReporter, opts ...Option) (AuthService, error) {
+    s := &service{ts: ts, db: db, r: r, log: nopLogger{}, tracer: defaultTracer()}
+    for _, opt := range opts {
+        opt(s)
+    }
+    if s.sessions != nil && s.cookies == nil {
+        WithCookies(CookieConfig{})(s)
+    }
+    if s.oidc != nil && (s.oidc.Issuer == "" || s.oidc.SigningKey == nil) {
+        return nil, fmt.Errorf("%w: WithOIDC needs an Issuer and a SigningKey", ErrNotConfigured)
+    }
+    if err := s.validateChain(); err != nil {
+        return nil, err
+    }
+    if s.saml != nil {
+        if err := s.saml.validate(); err != nil {
+            return nil, err
+        }
+    }
+    for _, p := range s.providers {
+        if err := p.validate(); err != nil {
+            return nil, err
+        }
+    }
+    if err := s.InitialMigration(); err != nil {
+        return nil, err
+    }
+    return s, nil
 }
 
-// SaveAuth metadata to Redis
-func (s *service) SaveAuth(c context.Context, userId string, td *TokenDetails) error {
+// SaveAuth store the access and refresh token in one transaction
+func (s *service) SaveAuth(c context.Context, userId string, td *TokenDetails) (err error) {
+    defer s.metrics.observeDB("SaveAuth", time.Now())
+    c, span := s.startSpan(c, "authr.SaveAuth", attrUserId.String(userId))
+    defer func() { endSpan(span, err) }()
 
+    err = s.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+        return s.saveAuth(tx, userId, td)
+    })
+    if err != nil {
+        s.log.Error("SaveAuth", "user_id", userId, "err", err)
+        return storeErr("SaveAuth", err)
+    }
+
+    s.log.Debug("SaveAuth saved", "user_id", userId, "token_uuid", td.TokenUuid)
+    return nil
+}
+
+func (s *service) saveAuth(tx *gorm.DB, userId string, td *TokenDetails) error {
     at := AuthTokens{
         Expires:   time.Unix(td.AtExpires, 0),
         TokenUuid: td.TokenUuid,
         TokenType: 0,
         UserId:    userId,
+        ActorId:   td.actorId,
+        ClientId:  td.clientId,
+        Backend:   td.backend,
+    }
+    if td.session {
+        at.TokenType = tokenTypeSession
+    }
+    if err := tx.Create(&at).Error; err != nil {
+        return err
+    }
+
+    //sessions have no refresh token
+    if td.RefreshUuid == "" {
+        return nil
     }
     rt := AuthTokens{
         Expires:   time.Unix(td.RtExpires, 0),
         TokenUuid: td.RefreshUuid,
         TokenType: 1,
         UserId:    userId,
+        ClientId:  td.clientId,
     }
+    return tx.Create(&rt).Error
+}
 
-    err := s.db.Create(&at).Error
-    if err != nil {
-        fmt.Printf("SaveAuth at error: %v\n", err)
-        os.Exit(1)
+// RotateRefresh atomically replace a refresh token by a new token pair, ErrTokenReused if it was already rotated
+func (s *service) RotateRefresh(c context.Context, refreshUuid, userId string, td *TokenDetails) (err error) {
+    defer s.metrics.observeDB("RotateRefresh", time.Now())
+    c, span := s.startSpan(c, "authr.RotateRefresh", attrUserId.String(userId))
+    defer func() { endSpan(span, err) }()
+
+    err = s.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+        res := tx.Where("token_uuid = ?", refreshUuid).Delete(&AuthTokens{})
+        if res.Error != nil {
+            return res.Error
+        }
+        // a concurrent refresh already consumed the token
+        if res.RowsAffected == 0 {
+            return ErrTokenReused
+        }
+        return s.saveAuth(tx, userId, td)
+    })
+    if errors.Is(err, ErrTokenReused) {
         return err
     }
-
-    err = s.db.Create(&rt).Error
     if err != nil {
-        fmt.Printf("SaveAuth rt error: %v\n", err)
-        os.Exit(2)
-        return err
+        s.log.Error("RotateRefresh", "user_id", userId, "err", err)
+        return storeErr("RotateRefresh", err)
     }
-
-    fmt.Printf("SaveAuth saved\n")
     return nil
 }
 
 // FetchAuth Check the metadata saved
-func (s *service) FetchAuth(c context.Context, tokenUuid string) (*AuthTokens, error) {
+func (s *service) FetchAuth(c context.Context, tokenUuid string) (info *AuthTokens, err error) {
+    defer s.metrics.observeDB("FetchAuth", time.Now())
+    c, span := s.startSpan(c, "authr.FetchAuth")
+    defer func() { endSpan(span, err) }()
 
-    info := &AuthTokens{}
+    info = &AuthTokens{}
 
-    if err := s.db.Where("token_uuid = ?", tokenUuid).First(info).Error; err != nil {
-        fmt.Printf("FetchAuth at error: %v\n", err)
-        return nil, err
+    if err = s.db.WithContext(c).Where("token_uuid = ?", tokenUuid).First(info).Error; err != nil {
+        s.log.Debug("FetchAuth not found", "token_uuid", tokenUuid, "err", err)
+        return nil, storeErr("FetchAuth", err)
     }
 
     now := time.Now()
     if now.After(info.Expires) {
-        fmt.Printf("FetchAuth token is expired\n")
-        return nil, errors.New("token is expired")
+        s.log.Debug("FetchAuth token is expired", "token_uuid", tokenUuid)
+        return nil, ErrTokenExpired
     }
 
-    spew.Dump(info)
-    fmt.Printf("FetchAuth valid\n")
     return info, nil
 }
 
@@ -116,46 +228,44 @@ func (s *service) FetchAuth(c context.Context, tokenUuid string) (*AuthTokens, e
 func (s *service) FetchHistory(c context.Context, UserId string) ([]AuthTokens, error) {
     var tokens []AuthTokens
 
-    if err := s.db.Where("user_id = ?", UserId).Find(tokens).Error; err != nil {
-        fmt.Printf("FetchHistory error: %v\n", err)
-        return nil, err
+    if err := s.db.WithContext(c).Where("user_id = ?", UserId).Find(&tokens).Error; err != nil {
+        s.log.Error("FetchHistory", "user_id", UserId, "err", err)
+        return nil, storeErr("FetchHistory", err)
     }
 
-    spew.Dump(tokens)
-    fmt.Printf("FetchHistory valid\n")
     return tokens, nil
 }
 
-// DeleteTokens Once a user row in the token table
+// DeleteTokens remove the access token and its refresh token in one transaction
 func (s *service) DeleteTokens(c context.Context, authD *AccessDetails) error {
     //get the refresh uuid
     refreshUuid := fmt.Sprintf("%s++%s", authD.TokenUuid, authD.UserId)
-    //delete access token
-    err := s.db.Where("token_uuid = ?", authD.TokenUuid).Delete(&AuthTokens{}).Error
-    if err != nil {
-        fmt.Printf("DeleteTokens TokenUuid error: %v\n", err)
-        return err
-    }
-    //delete refresh token
-    err = s.db.Where("token_uuid = ?", refreshUuid).Delete(&AuthTokens{}).Error
+    err := s.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+        //delete access token
+        if err := tx.Where("token_uuid = ?", authD.TokenUuid).Delete(&AuthTokens{}).Error; err != nil {
+            return err
+        }
+        //delete refresh token
+        return tx.Where("token_uuid = ?", refreshUuid).Delete(&AuthTokens{}).Error
+    })
     if err != nil {
-        fmt.Printf("DeleteTokens refreshUuid error: %v\n", err)
-        return err
+        s.log.Error("DeleteTokens", "token_uuid", authD.TokenUuid, "err", err)
+        return storeErr("DeleteTokens", err)
     }
-    fmt.Printf("DeleteTokens valid\n")
+    s.log.Debug("DeleteTokens deleted", "user_id", authD.UserId, "token_uuid", authD.TokenUuid)
     return nil
 }
 
 // DeleteRefresh remove refresh token
 func (s *service) DeleteRefresh(c context.Context, refreshUuid string) error {
     //delete refresh token
-    err := s.db.Where("token_uuid = ?", refreshUuid).Delete(&AuthTokens{}).Error
+    err := s.db.WithContext(c).Where("token_uuid = ?", refreshUuid).Delete(&AuthTokens{}).Error
     if err != nil {
-        fmt.Printf("DeleteRefresh refreshUuid error: %v\n", err)
-        return err
+        s.log.Error("DeleteRefresh", "refresh_uuid", refreshUuid, "err", err)
+        return storeErr("DeleteRefresh", err)
     }
 
-    fmt.Printf("DeleteRefresh valid\n")
+    s.log.Debug("DeleteRefresh deleted", "refresh_uuid", refreshUuid)
     return nil
 }
 
@@ -171,20 +281,77 @@ func CheckPasswordHash(password, hash string) bool {
     return err == nil
 }
 
+func (s *service) Reporter() *AuthReporter {
+    return s.r
+}
+
+// Metrics nil when the service was created without WithMetrics
+func (s *service) Metrics() *Metrics {
+    return s.metrics
+}
+
 func (s *service) ExtractTokenMetadata(r *http.Request) (*AccessDetails, error) {
+    if key := s.requestAPIKey(r); key != "" {
+        return s.apiKeyMetadata(r.Context(), key)
+    }
+    if s.sessionRequest(r) {
+        return s.sessionMetadata(r)
+    }
+    r, err := s.tokenRequest(r)
+    if err != nil {
+        return nil, err
+    }
     return s.ts.ExtractTokenMetadata(r)
 }
 
-func (s *service) CreateToken(u *User) (*TokenDetails, error) {
+func (s *service) CreateToken(c context.Context, u *User) (*TokenDetails, error) {
+    _, span := s.startSpan(c, "authr.CreateToken", attrUserId.String(u.ID))
+    u.details = s.projectAttributes(u)
+    if u.details == nil {
+        u.details = map[string]interface{}{}
+    }
+    // carried through refreshes, the auth_time of ID tokens
+    u.details[JwtAuthTime] = time.Now().Unix()
+    if u.authBackend != "" {
+        u.details[JwtAuthBackend] = u.authBackend
+    }
+    td, err := s.createToken(u)
+    if td != nil {
+        td.backend = u.authBackend
+    }
+    endSpan(span, err)
+    return td, err
+}
+
+// createToken a session in session mode, a JWT pair otherwise
+func (s *service) createToken(u *User) (*TokenDetails, error) {
+    if s.sessions != nil {
+        return s.newSession(u)
+    }
     return s.ts.CreateToken(u)
 }
-func (s *service) RefreshToken(u *User, claims jwt.MapClaims) (*TokenDetails, error) {
-    return s.ts.RefreshToken(u, claims)
+func (s *service) RefreshToken(c context.Context, u *User, claims jwt.MapClaims) (*TokenDetails, error) {
+    _, span := s.startSpan(c, "authr.RefreshToken", attrUserId.String(u.ID))
+    td, err := s.ts.RefreshToken(u, claims)
+    endSpan(span, err)
+    return td, err
 }
 
 func (s *service) RefreshSecret() string {
     return s.ts.RefreshSecret()
 }
 func (s *service) TokenValid(r *http.Request) error {
+    if key := s.requestAPIKey(r); key != "" {
+        _, err := s.apiKeyMetadata(r.Context(), key)
+        return err
+    }
+    if s.sessionRequest(r) {
+        _, err := s.sessionMetadata(r)
+        return err
+    }
+    r, err := s.tokenRequest(r)
+    if err != nil {
+        return err
+    }
     return s.ts.TokenValid(r)
 }
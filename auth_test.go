@@ -0,0 +1,151 @@
+package authr
+
+import (
+    "context"
+    "errors"
+    "github.com/dgrijalva/jwt-go"
+    "gorm.io/driver/sqlite"
+    "gorm.io/gorm"
+    "gorm.io/gorm/logger"
+    "path/filepath"
+    "sync"
+    "testing"
+)
+
+func TestRotateRefresh(t *testing.T) {
+    tests := []struct {
+        name    string
+        rotate  int
+        wantErr error
+    }{
+        {"first rotation", 0, nil},
+        {"rotated token", 1, ErrTokenReused},
+        {"rotated twice", 2, ErrTokenReused},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := newTestService(t)
+            c := context.Background()
+            user := newTestUser(t, s, "ann", "secret")
+            td := newTestLogin(t, s, user)
+
+            for i := 0; i < tt.rotate; i++ {
+                next, err := s.CreateToken(c, user)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                _ = s.RotateRefresh(c, td.RefreshUuid, user.ID, next)
+            }
+
+            next, err := s.CreateToken(c, user)
+            if err != nil {
+                t.Fatal(err)
+            }
+            err = s.RotateRefresh(c, td.RefreshUuid, user.ID, next)
+            if !errors.Is(err, tt.wantErr) {
+                t.Fatalf("RotateRefresh = %v, want %v", err, tt.wantErr)
+            }
+            _, err = s.FetchAuth(c, next.RefreshUuid)
+            if tt.wantErr == nil && err != nil {
+                t.Errorf("new refresh token not stored: %v", err)
+            }
+            if tt.wantErr != nil && !errors.Is(err, ErrNotFound) {
+                t.Errorf("FetchAuth of refused pair = %v, want ErrNotFound", err)
+            }
+        })
+    }
+}
+
+func TestRotateRefreshConcurrentReuse(t *testing.T) {
+    s := newTestService(t)
+    c := context.Background()
+    user := newTestUser(t, s, "ann", "secret")
+    td := newTestLogin(t, s, user)
+
+    const attempts = 8
+    pairs := make([]*TokenDetails, attempts)
+    for i := range pairs {
+        next, err := s.CreateToken(c, user)
+        if err != nil {
+            t.Fatal(err)
+        }
+        pairs[i] = next
+    }
+
+    errs := make([]error, attempts)
+    var wg sync.WaitGroup
+    for i := range pairs {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            errs[i] = s.RotateRefresh(c, td.RefreshUuid, user.ID, pairs[i])
+        }(i)
+    }
+    wg.Wait()
+
+    won := 0
+    for i, err := range errs {
+        switch {
+        case err == nil:
+            won++
+            if _, err = s.FetchAuth(c, pairs[i].RefreshUuid); err != nil {
+                t.Errorf("winning pair not stored: %v", err)
+            }
+        case errors.Is(err, ErrTokenReused):
+            if _, err = s.FetchAuth(c, pairs[i].RefreshUuid); !errors.Is(err, ErrNotFound) {
+                t.Errorf("losing pair stored, FetchAuth = %v", err)
+            }
+        default:
+            t.Errorf("RotateRefresh = %v, want nil or ErrTokenReused", err)
+        }
+    }
+    if won != 1 {
+        t.Errorf("%d rotations succeeded, want exactly 1", won)
+    }
+}
+
+func TestRefreshTokenRoles(t *testing.T) {
+    s := newTestService(t)
+    c := context.Background()
+    user := newTestUser(t, s, "ann", "secret", RoleAdmin.String())
+    td := newTestLogin(t, s, user)
+
+    claims := jwt.MapClaims{}
+    if _, _, err := new(jwt.Parser).ParseUnverified(td.RefreshToken, claims); err != nil {
+        t.Fatal(err)
+    }
+    user.Roles = "ROLE_USER"
+    next, err := s.RefreshToken(c, user, claims)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err = s.SaveAuth(c, user.ID, next); err != nil {
+        t.Fatal(err)
+    }
+
+    metadata, err := s.Authorize(bearerRequest(next.AccessToken))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if metadata.Role != "ROLE_USER" {
+        t.Errorf("refreshed role = %q, want ROLE_USER", metadata.Role)
+    }
+}
+
+func TestNewAuthServiceMigrationError(t *testing.T) {
+    db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "authr.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    sqlDB, err := db.DB()
+    if err != nil {
+        t.Fatal(err)
+    }
+    sqlDB.Close()
+
+    _, err = NewAuthService(NewTokenService("access-secret", "refresh-secret"), db, NewAuthReporter())
+    var storeErr *StoreError
+    if !errors.As(err, &storeErr) || storeErr.Op != "InitialMigration" {
+        t.Errorf("NewAuthService = %v, want the StoreError of InitialMigration", err)
+    }
+}
@@ -0,0 +1,272 @@
+package authr
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "github.com/twinj/uuid"
+    "go.opentelemetry.io/otel/attribute"
+    "strings"
+)
+
+// BackendLocal name of the authenticator of the users with a password in the local database, stored as an empty Backend
+const BackendLocal = "local"
+
+// Authenticator login backend of LoginUser
+type Authenticator interface {
+    // Name stored as the Backend of the users it provisions and as the auth_backend claim of their tokens
+    Name() string
+    // Authenticate check the password, local is nil on the first login of the username. ErrInvalidCredentials
+    // passes the login to the next backend of the chain, any other error ends the login.
+    Authenticate(c context.Context, args *LoginParams, local *User) (*AuthIdentity, error)
+}
+
+// UserLookup implemented by an Authenticator that can tell whether it knows a username without its password.
+// RegisterUser refuses the usernames a backend of the chain resolves, otherwise anybody could register the
+// local account a directory user signs in to. Usernames of backends without it are not protected.
+type UserLookup interface {
+    LookupUser(c context.Context, username string) (bool, error)
+}
+
+// AuthIdentity the user an Authenticator vouches for, backends other than local create or update the
+// local user from it on every login
+type AuthIdentity struct {
+    Email string
+    // Groups input of MapRoles
+    Groups []string
+    // Roles replace the roles of the local user
+    Roles []string
+}
+
+// WithAuthenticators the ordered login chain, defaults to LocalAuthenticator followed by the directory of WithLDAP.
+// A user that exists locally is only checked by the backend that owns it, see User.Backend, so an unknown
+// username is the only login that walks the chain.
+func WithAuthenticators(chain ...Authenticator) Option {
+    return func(s *service) {
+        s.authenticators = chain
+    }
+}
+
+// LocalAuthenticator the bcrypt password of the local user, roles are managed with the admin API
+func LocalAuthenticator() Authenticator {
+    return localAuthenticator{check: func(c context.Context, password, hash string) bool {
+        return CheckPasswordHash(password, hash)
+    }}
+}
+
+type localAuthenticator struct {
+    // check compares the password, the checkPassword of the service once the authenticator is in its chain
+    check func(c context.Context, password, hash string) bool
+}
+
+// dummyPasswordHash compared when there is no local password, so unknown usernames cost the same bcrypt work as wrong passwords
+const dummyPasswordHash = "$2a$14$IXkZ4k1FO12hWrA83UHPme98s01w2Q7/T8X2z00moEFzM1u8pVW2."
+
+func (localAuthenticator) Name() string {
+    return BackendLocal
+}
+
+func (a localAuthenticator) Authenticate(c context.Context, args *LoginParams, local *User) (*AuthIdentity, error) {
+    // users provisioned by federated login have no password
+    if local == nil || local.Password == "" {
+        a.check(c, args.Password, dummyPasswordHash)
+        return nil, ErrInvalidCredentials
+    }
+    if !a.check(c, args.Password, local.Password) {
+        return nil, ErrInvalidCredentials
+    }
+    return &AuthIdentity{Email: local.Email}, nil
+}
+
+// AuthenticatorFunc adapt a function to an Authenticator of the given name
+func AuthenticatorFunc(name string, fn func(c context.Context, args *LoginParams, local *User) (*AuthIdentity, error)) Authenticator {
+    return &funcAuthenticator{name: name, fn: fn}
+}
+
+type funcAuthenticator struct {
+    name string
+    fn   func(c context.Context, args *LoginParams, local *User) (*AuthIdentity, error)
+}
+
+func (a *funcAuthenticator) Name() string {
+    return a.name
+}
+
+func (a *funcAuthenticator) Authenticate(c context.Context, args *LoginParams, local *User) (*AuthIdentity, error) {
+    return a.fn(c, args, local)
+}
+
+// MapRoles per backend role mapping, the roles of the identity become defaultRoles plus the roles of its
+// groups. groupRoles is keyed by the group name, or for DNs also by their cn, compared case insensitive.
+func MapRoles(a Authenticator, groupRoles map[string]string, defaultRoles ...string) Authenticator {
+    return &roleMapper{Authenticator: a, groupRoles: groupRoles, defaultRoles: defaultRoles}
+}
+
+type roleMapper struct {
+    Authenticator
+    groupRoles   map[string]string
+    defaultRoles []string
+}
+
+func (m *roleMapper) Authenticate(c context.Context, args *LoginParams, local *User) (*AuthIdentity, error) {
+    identity, err := m.Authenticator.Authenticate(c, args, local)
+    if err != nil {
+        return nil, err
+    }
+    identity.Roles = mapRoles(identity.Groups, m.groupRoles, m.defaultRoles)
+    return identity, nil
+}
+
+func (m *roleMapper) validate() error {
+    return validateAuthenticator(m.Authenticator)
+}
+
+// mapRoles defaultRoles and the roles of the mapped groups, without duplicates
+func mapRoles(groups []string, groupRoles map[string]string, defaultRoles []string) []string {
+    var roles StringList
+    add := func(role string) {
+        if role != "" && !roles.Contains(role) {
+            roles = append(roles, role)
+        }
+    }
+    for _, role := range defaultRoles {
+        add(role)
+    }
+    for _, group := range groups {
+        cn := groupCN(group)
+        for key, role := range groupRoles {
+            if strings.EqualFold(key, group) || (cn != "" && strings.EqualFold(key, cn)) {
+                add(role)
+            }
+        }
+    }
+    return roles
+}
+
+func validateAuthenticator(a Authenticator) error {
+    if v, ok := a.(interface{ validate() error }); ok {
+        return v.validate()
+    }
+    return nil
+}
+
+// authenticate walk the chain, the user returned carries the name of the backend for the token claims
+func (s *service) authenticate(c context.Context, local *User, args *LoginParams) (*User, error) {
+    owner := BackendLocal
+    if local != nil && local.Backend != "" {
+        owner = local.Backend
+    }
+
+    for _, a := range s.authenticators {
+        name := a.Name()
+        if local != nil && name != owner {
+            continue
+        }
+
+        _, span := s.startSpan(c, "authr.Authenticate", attribute.String("authr.backend", name))
+        identity, err := a.Authenticate(c, args, local)
+        endSpan(span, err)
+        if errors.Is(err, ErrInvalidCredentials) {
+            continue
+        }
+        if err != nil {
+            s.log.Error("LoginUser backend failed", "backend", name, "err", err)
+            return nil, err
+        }
+
+        // an inactive user keeps the email and roles it had
+        if local != nil {
+            if err = statusError(local.Status); err != nil {
+                return nil, err
+            }
+        }
+        user, err := s.syncBackendUser(c, local, name, args.Username, identity)
+        if err != nil {
+            return nil, err
+        }
+        user.authBackend = name
+        return user, nil
+    }
+    return nil, ErrInvalidCredentials
+}
+
+// backendUsername ErrUserExists when a backend other than local resolves username
+func (s *service) backendUsername(c context.Context, username string) error {
+    for _, a := range s.authenticators {
+        lookup, ok := a.(UserLookup)
+        if !ok || a.Name() == BackendLocal {
+            continue
+        }
+        found, err := lookup.LookupUser(c, username)
+        if err != nil {
+            s.log.Error("backendUsername lookup", "backend", a.Name(), "err", err)
+            return err
+        }
+        if found {
+            return ErrUserExists
+        }
+    }
+    return nil
+}
+
+// syncBackendUser create or update the local user of a backend other than local
+func (s *service) syncBackendUser(c context.Context, local *User, backend, username string, identity *AuthIdentity) (*User, error) {
+    if backend == BackendLocal {
+        return local, nil
+    }
+    roles, err := joinRoles(identity.Roles)
+    if err != nil {
+        return nil, err
+    }
+
+    if local == nil {
+        user := &User{
+            ID:       uuid.NewV4().String(),
+            Username: username,
+            Email:    identity.Email,
+            Roles:    roles,
+            Status:   StatusActive,
+            Backend:  backend,
+        }
+        if err = s.db.WithContext(c).Create(user).Error; err != nil {
+            return nil, storeErr("LoginUser", err)
+        }
+        s.log.Debug("LoginUser provisioned", "user_id", user.ID, "backend", backend)
+        return user, nil
+    }
+
+    local.Email = identity.Email
+    local.Roles = roles
+    err = s.db.WithContext(c).Model(&User{}).Where("id = ?", local.ID).
+        Updates(map[string]interface{}{"email": local.Email, "roles": local.Roles}).Error
+    if err != nil {
+        return nil, storeErr("LoginUser", err)
+    }
+    return local, nil
+}
+
+// validateChain every backend is valid and names are unique, the chain defaults when WithAuthenticators was not given
+func (s *service) validateChain() error {
+    if s.authenticators == nil {
+        s.authenticators = []Authenticator{LocalAuthenticator()}
+        if s.ldap != nil {
+            s.authenticators = append(s.authenticators, s.ldap)
+        }
+    }
+    names := map[string]bool{}
+    for i, a := range s.authenticators {
+        // local logins are checked under the span of checkPassword
+        if _, ok := a.(localAuthenticator); ok {
+            a = localAuthenticator{check: s.checkPassword}
+            s.authenticators[i] = a
+        }
+        if names[a.Name()] {
+            return fmt.Errorf("%w: authenticator %q is in the chain twice", ErrNotConfigured, a.Name())
+        }
+        names[a.Name()] = true
+        if err := validateAuthenticator(a); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,165 @@
+package authr
+
+import (
+    "net/http"
+    "time"
+)
+
+// CookieConfig cookie transport of the tokens, empty fields take the defaults of WithCookies
+type CookieConfig struct {
+    AccessName  string
+    RefreshName string
+    CSRFName    string
+    CSRFHeader  string
+    Domain      string
+    // Path of the access cookie
+    Path string
+    // RefreshPath the refresh cookie is only sent to the refresh endpoint
+    RefreshPath string
+    SameSite    http.SameSite
+    // Insecure drop the Secure attribute, only for local development over plain http
+    Insecure bool
+}
+
+// WithCookies Login, Register and Refresh set HttpOnly token cookies and the default extractor chain
+// accepts the access cookie. Requests authenticated by cookie must repeat the CSRF cookie in the CSRF header
+// (double-submit) unless the method is safe.
+func WithCookies(cfg CookieConfig) Option {
+    return func(s *service) {
+        if cfg.AccessName == "" {
+            cfg.AccessName = "authr_access"
+        }
+        if cfg.RefreshName == "" {
+            cfg.RefreshName = "authr_refresh"
+        }
+        if cfg.CSRFName == "" {
+            cfg.CSRFName = "authr_csrf"
+        }
+        if cfg.CSRFHeader == "" {
+            cfg.CSRFHeader = "X-CSRF-Token"
+        }
+        if cfg.Path == "" {
+            cfg.Path = "/"
+        }
+        if cfg.RefreshPath == "" {
+            cfg.RefreshPath = "/refresh"
+        }
+        if cfg.SameSite == 0 {
+            cfg.SameSite = http.SameSiteLaxMode
+        }
+        s.cookies = &cfg
+    }
+}
+
+// Cookies nil when the service was created without WithCookies
+func (s *service) Cookies() *CookieConfig {
+    return s.cookies
+}
+
+// issue set the token and CSRF cookies, returns the response body with the tokens removed.
+// A nil config returns td unchanged.
+func (cfg *CookieConfig) issue(w http.ResponseWriter, td *TokenDetails) (*TokenDetails, error) {
+    if cfg == nil {
+        return td, nil
+    }
+    csrf, err := randomToken()
+    if err != nil {
+        return nil, err
+    }
+
+    if td.RefreshToken == "" {
+        // server side session, the store enforces the idle timeout and RtExpires is the absolute expiry
+        http.SetCookie(w, cfg.cookie(cfg.AccessName, td.AccessToken, cfg.Path, time.Unix(td.RtExpires, 0), true))
+    } else {
+        http.SetCookie(w, cfg.cookie(cfg.AccessName, td.AccessToken, cfg.Path, time.Unix(td.AtExpires, 0), true))
+        http.SetCookie(w, cfg.cookie(cfg.RefreshName, td.RefreshToken, cfg.RefreshPath, time.Unix(td.RtExpires, 0), true))
+    }
+    // readable by the page so it can be echoed in the CSRF header, on / so every endpoint receives it
+    http.SetCookie(w, cfg.cookie(cfg.CSRFName, csrf, "/", time.Unix(td.RtExpires, 0), false))
+
+    body := *td
+    body.AccessToken = ""
+    body.RefreshToken = ""
+    return &body, nil
+}
+
+// clear expire the token and CSRF cookies
+func (cfg *CookieConfig) clear(w http.ResponseWriter) {
+    if cfg == nil {
+        return
+    }
+    for _, c := range []*http.Cookie{
+        cfg.cookie(cfg.AccessName, "", cfg.Path, time.Unix(0, 0), true),
+        cfg.cookie(cfg.RefreshName, "", cfg.RefreshPath, time.Unix(0, 0), true),
+        cfg.cookie(cfg.CSRFName, "", "/", time.Unix(0, 0), false),
+    } {
+        c.MaxAge = -1
+        http.SetCookie(w, c)
+    }
+}
+
+const (
+    // federationCookie state of a pending federated login, it binds the provider callback to the browser.
+    // SameSite lax so the top level redirect back from the provider carries it.
+    federationCookie = "authr_federation"
+    // samlCookie state of a pending SAML login, SameSite none because the identity provider posts the response cross site
+    samlCookie = "authr_saml"
+)
+
+// setState state cookie of a pending login, works without WithCookies
+func (cfg *CookieConfig) setState(w http.ResponseWriter, name, state string, maxAge int, sameSite http.SameSite) {
+    c := &http.Cookie{Name: name, Value: state, Path: "/", MaxAge: maxAge, Secure: true, HttpOnly: true, SameSite: sameSite}
+    if cfg != nil {
+        c.Domain = cfg.Domain
+        c.Secure = !cfg.Insecure
+    }
+    if maxAge < 0 {
+        c.Expires = time.Unix(0, 0)
+    }
+    http.SetCookie(w, c)
+}
+
+func (cfg *CookieConfig) cookie(name, value, path string, expires time.Time, httpOnly bool) *http.Cookie {
+    return &http.Cookie{
+        Name:     name,
+        Value:    value,
+        Path:     path,
+        Domain:   cfg.Domain,
+        Expires:  expires,
+        Secure:   !cfg.Insecure,
+        HttpOnly: httpOnly,
+        SameSite: cfg.SameSite,
+    }
+}
+
+func (cfg *CookieConfig) value(r *http.Request, name string) string {
+    c, err := r.Cookie(name)
+    if err != nil {
+        return ""
+    }
+    return c.Value
+}
+
+func (cfg *CookieConfig) accessToken(r *http.Request) string {
+    if cfg == nil {
+        return ""
+    }
+    return cfg.value(r, cfg.AccessName)
+}
+
+func (cfg *CookieConfig) refreshToken(r *http.Request) string {
+    if cfg == nil {
+        return ""
+    }
+    return cfg.value(r, cfg.RefreshName)
+}
+
+// checkCSRF safe methods pass, anything else must echo the CSRF cookie in the CSRF header
+func (cfg *CookieConfig) checkCSRF(r *http.Request) error {
+    return checkCSRF(r, cfg.CSRFName, cfg.CSRFHeader)
+}
+
+// Extractor reads the access cookie, guarded by the CSRF token
+func (cfg *CookieConfig) Extractor() TokenExtractor {
+    return CookieExtractor(cfg.AccessName, cfg.CSRFName, cfg.CSRFHeader)
+}
@@ -0,0 +1,93 @@
+package authr
+
+import (
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestCheckCSRF(t *testing.T) {
+    tests := []struct {
+        name   string
+        method string
+        cookie string
+        header string
+        want   error
+    }{
+        {"safe method without token", http.MethodGet, "", "", nil},
+        {"head without token", http.MethodHead, "", "", nil},
+        {"matching token", http.MethodPost, "abc", "abc", nil},
+        {"missing header", http.MethodPost, "abc", "", ErrCSRF},
+        {"missing cookie", http.MethodPost, "", "abc", ErrCSRF},
+        {"both missing", http.MethodDelete, "", "", ErrCSRF},
+        {"mismatch", http.MethodPut, "abc", "abd", ErrCSRF},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(tt.method, "/", nil)
+            if tt.cookie != "" {
+                r.AddCookie(&http.Cookie{Name: "authr_csrf", Value: tt.cookie})
+            }
+            if tt.header != "" {
+                r.Header.Set("X-CSRF-Token", tt.header)
+            }
+            if err := checkCSRF(r, "authr_csrf", "X-CSRF-Token"); !errors.Is(err, tt.want) {
+                t.Errorf("checkCSRF = %v, want %v", err, tt.want)
+            }
+        })
+    }
+}
+
+func TestCookieAuthorizeCSRF(t *testing.T) {
+    tests := []struct {
+        name   string
+        method string
+        bearer bool
+        csrf   string
+        want   error
+    }{
+        {"cookie on GET", http.MethodGet, false, "", nil},
+        {"cookie on POST with token", http.MethodPost, false, "issued", nil},
+        {"cookie on POST without token", http.MethodPost, false, "", ErrCSRF},
+        {"cookie on POST with forged token", http.MethodPost, false, "forged", ErrCSRF},
+        {"bearer on POST needs no token", http.MethodPost, true, "", nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := newTestService(t, WithCookies(CookieConfig{}))
+            user := newTestUser(t, s, "ann", "secret")
+            td := newTestLogin(t, s, user)
+
+            w := httptest.NewRecorder()
+            if _, err := s.Cookies().issue(w, td); err != nil {
+                t.Fatal(err)
+            }
+            cookies := map[string]string{}
+            for _, c := range w.Result().Cookies() {
+                cookies[c.Name] = c.Value
+            }
+            if cookies["authr_access"] == "" || cookies["authr_csrf"] == "" {
+                t.Fatalf("issue set cookies %v", cookies)
+            }
+
+            r := httptest.NewRequest(tt.method, "/", nil)
+            if tt.bearer {
+                r.Header.Set("Authorization", "Bearer "+td.AccessToken)
+            } else {
+                r.AddCookie(&http.Cookie{Name: "authr_access", Value: cookies["authr_access"]})
+                r.AddCookie(&http.Cookie{Name: "authr_csrf", Value: cookies["authr_csrf"]})
+            }
+            switch tt.csrf {
+            case "issued":
+                r.Header.Set("X-CSRF-Token", cookies["authr_csrf"])
+            case "forged":
+                r.Header.Set("X-CSRF-Token", "forged")
+            }
+
+            if _, err := s.Authorize(r); !errors.Is(err, tt.want) {
+                t.Errorf("Authorize = %v, want %v", err, tt.want)
+            }
+        })
+    }
+}
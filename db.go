@@ -3,118 +3,133 @@ package authr
 import (
     "context"
     "errors"
-    "fmt"
-    "github.com/davecgh/go-spew/spew"
     "github.com/twinj/uuid"
     _ "gorm.io/driver/mysql"
     _ "gorm.io/driver/sqlite"
-    "gorm.io/gorm"
 )
 
 //-------------DATABASE FUNCTIONS---------------------
 
 func (s *service) LoadUser(c context.Context, ID string) (*User, error) {
     if ID == "" {
-        return nil, errors.New("ID is invalid")
+        return nil, invalidf("ID is invalid")
     }
 
-    users := make([]User, 0)
-    // Get all records
-    _ = s.db.Find(&users)
-    // SELECT * FROM users;
-
-    //fmt.Printf("users: %d\n", len(users))
-    spew.Dump(users)
     var authUser User
-    //fmt.Printf("1\n")
-    dbRresult := s.db.Limit(1).Where("ID =   ?", ID).Find(&authUser)
-    //fmt.Printf("2\n")
-    if errors.Is(dbRresult.Error, gorm.ErrRecordNotFound) {
-        return nil, errors.New("ID not found")
+    dbRresult := s.db.WithContext(c).Limit(1).Where("ID =   ?", ID).Find(&authUser)
+    if dbRresult.Error != nil {
+        return nil, storeErr("LoadUser", dbRresult.Error)
     }
-    //fmt.Printf("3\n")
     if authUser.Username == "" {
-        //fmt.Printf("4a\n")
-        return nil, errors.New("record empty")
+        s.log.Debug("LoadUser not found", "user_id", ID)
+        return nil, ErrNotFound
     }
 
-    //fmt.Printf("6\n------------------------------------\n")
-    //spew.Dump(authUser)
     return &authUser, nil
 }
 
-func (s *service) LoginUser(c context.Context, loginParams *LoginParams) (*User, error) {
+func (s *service) LoginUser(c context.Context, loginParams *LoginParams) (user *User, err error) {
+    c, span := s.startSpan(c, "authr.LoginUser")
+    defer func() {
+        if user != nil {
+            span.SetAttributes(attrUserId.String(user.ID))
+        }
+        endSpan(span, err)
+    }()
+
     if loginParams.Username == "" || loginParams.Password == "" {
-        return nil, errors.New("login params are invalid")
+        return nil, invalidf("login params are invalid")
     }
 
-    users := make([]User, 0)
-    // Get all records
-    _ = s.db.Find(&users)
-    // SELECT * FROM users;
-
-    //fmt.Printf("users: %d\n", len(users))
-    spew.Dump(users)
     var authUser User
-    //fmt.Printf("1\n")
-    dbRresult := s.db.Limit(1).Where("Username =   ?", loginParams.Username).Find(&authUser)
-    //fmt.Printf("2\n")
-    if errors.Is(dbRresult.Error, gorm.ErrRecordNotFound) {
-        return nil, errors.New("username or Password is incorrect - nf")
+    dbRresult := s.db.WithContext(c).Limit(1).Where("Username =   ?", loginParams.Username).Find(&authUser)
+    if dbRresult.Error != nil {
+        return nil, storeErr("LoginUser", dbRresult.Error)
     }
-    //fmt.Printf("3\n")
-    if authUser.Username == "" {
-        //fmt.Printf("4a\n")
-        return nil, errors.New("username or Password is incorrect")
+    var local *User
+    if authUser.Username != "" {
+        local = &authUser
     }
 
-    //fmt.Printf("4b\n")
-    //fmt.Printf("4b\n")
-    check := CheckPasswordHash(loginParams.Password, authUser.Password)
-    //fmt.Printf("5\n")
-    if !check {
-        fmt.Printf("5a\n")
-        return nil, errors.New("username or password is incorrect")
+    user, err = s.authenticate(c, local, loginParams)
+    if errors.Is(err, ErrInvalidCredentials) {
+        if local == nil {
+            s.log.Info("LoginUser unknown username", "username", loginParams.Username)
+            return nil, err
+        }
+        s.log.Info("LoginUser wrong password", "user_id", authUser.ID)
+        return nil, err
+    }
+    if err != nil {
+        return nil, err
+    }
+    if local == nil {
+        s.log.Debug("LoginUser success", "user_id", user.ID)
+        return user, nil
     }
 
-    //fmt.Printf("6\n------------------------------------\n")
-    //spew.Dump(authUser)
-    return &authUser, nil
+    if err := statusError(authUser.Status); err != nil {
+        s.log.Info("LoginUser inactive account", "user_id", authUser.ID, "status", authUser.Status)
+        return nil, err
+    }
+
+    s.log.Debug("LoginUser success", "user_id", authUser.ID)
+    return user, nil
+}
+
+// WithRegistrationRoles roles of self registered users, none by default. Admins are made with SetRoles.
+func WithRegistrationRoles(roles ...string) Option {
+    return func(s *service) {
+        s.registrationRoles = roles
+    }
 }
 
 func (s *service) RegisterUser(c context.Context, regParams *RegistrationParams) (*User, error) {
     if regParams.Username == "" || regParams.Password == "" {
-        return nil, errors.New("registration params are invalid")
+        return nil, invalidf("registration params are invalid")
     }
 
-    fmt.Printf("E0.1\n")
-    fmt.Printf("E0.3\n")
-    var dbuser User
-    s.db.Where("username = ?", regParams.Username).First(&dbuser)
-    fmt.Printf("E0.4\n")
-    //check email is already registered or not
-    if dbuser.Username != "" {
-        fmt.Printf("E1\n")
-        return nil, errors.New("username already in use")
+    // deleted users keep their row and with it the unique username
+    var count int64
+    if err := s.db.WithContext(c).Model(&User{}).Unscoped().Where("username = ?", regParams.Username).Count(&count).Error; err != nil {
+        return nil, storeErr("RegisterUser", err)
+    }
+    //check username is already registered or not
+    if count > 0 {
+        s.log.Info("RegisterUser username in use", "username", regParams.Username)
+        return nil, ErrUserExists
+    }
+    if err := s.backendUsername(c, regParams.Username); err != nil {
+        if errors.Is(err, ErrUserExists) {
+            s.log.Info("RegisterUser username owned by a backend", "username", regParams.Username)
+        }
+        return nil, err
     }
 
-    var err error
+    roles, err := joinRoles(s.registrationRoles)
+    if err != nil {
+        return nil, err
+    }
     user := User{Username: regParams.Username, Email: regParams.Email, ID: uuid.NewV4().String()}
-    user.Password, err = GeneratePasswordHash(regParams.Password)
+    user.Password, err = s.hashPassword(c, regParams.Password)
     if err != nil {
-        fmt.Printf("E2\n")
+        s.log.Error("RegisterUser hash password", "err", err)
         return nil, err
     }
 
-    user.Roles = "ROLE_ADMIN,ROLE_MODERATOR"
-    fmt.Printf("E3\n")
+    user.Roles = roles
+    user.Status = StatusActive
     //insert user details in database
-    s.db.Create(&user)
+    if err = s.db.WithContext(c).Create(&user).Error; err != nil {
+        s.log.Error("RegisterUser create", "username", user.Username, "err", err)
+        return nil, storeErr("RegisterUser", err)
+    }
+
+    s.log.Debug("RegisterUser created", "user_id", user.ID)
     return &user, nil
 }
 
 // InitialMigration create user table in userdb
 func (s *service) InitialMigration() error {
-    s.db.AutoMigrate(User{}, AuthTokens{})
-    return nil
+    return storeErr("InitialMigration", s.db.AutoMigrate(User{}, AuthTokens{}, EmailChange{}, PasswordReset{}, AuditEvent{}, OAuthClient{}, OAuthCode{}, OAuthConsent{}, ServiceAccount{}, APIKey{}, OAuthDeviceCode{}, ExternalIdentity{}, FederatedLogin{}))
 }
@@ -0,0 +1,215 @@
+package authr
+
+import (
+    "context"
+    "crypto/rand"
+    "errors"
+    "fmt"
+    "gorm.io/gorm"
+    "math/big"
+    "net/url"
+    "strings"
+    "time"
+)
+
+// GrantTypeDeviceCode grant_type of the device polling the token endpoint
+const GrantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+const (
+    deviceCodeTTL      = time.Minute * 10
+    devicePollInterval = 5
+    // userCodeAlphabet no vowels and no look-alike characters, RFC 8628 section 6.1
+    userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+    userCodeLen      = 8
+)
+
+// WithDeviceVerificationLink url of the page where users enter the code shown by a device, the code is
+// appended as the `user_code` query parameter for verification_uri_complete
+func WithDeviceVerificationLink(verifyURL string) Option {
+    return func(s *service) {
+        s.deviceURL = verifyURL
+    }
+}
+
+// AuthorizeDevice start a device authorization, the device shows the user code and polls the token endpoint
+func (s *service) AuthorizeDevice(c context.Context, args *DeviceAuthorizationParams) (*DeviceAuthorization, error) {
+    if s.deviceURL == "" {
+        return nil, fmt.Errorf("%w: device verification link", ErrNotConfigured)
+    }
+    client, err := s.authenticateClient(c, args.ClientId, args.ClientSecret)
+    if err != nil {
+        return nil, err
+    }
+    scopes, ok := grantScopes(client.Scopes, args.Scope)
+    if !ok {
+        return nil, oauthErr(OAuthInvalidScope, "scope is not allowed for this client")
+    }
+
+    deviceCode, err := randomToken()
+    if err != nil {
+        return nil, err
+    }
+    userCode, err := randomUserCode()
+    if err != nil {
+        return nil, err
+    }
+    err = s.db.WithContext(c).Create(&OAuthDeviceCode{
+        DeviceCodeHash: hashToken(deviceCode),
+        UserCode:       userCode,
+        ClientId:       client.ClientId,
+        Scope:          strings.Join(scopes, " "),
+        Interval:       devicePollInterval,
+        Expires:        time.Now().Add(deviceCodeTTL),
+    }).Error
+    if err != nil {
+        return nil, storeErr("AuthorizeDevice", err)
+    }
+
+    display := userCode[:userCodeLen/2] + "-" + userCode[userCodeLen/2:]
+    return &DeviceAuthorization{
+        DeviceCode:              deviceCode,
+        UserCode:                display,
+        VerificationURI:         s.deviceURL,
+        VerificationURIComplete: withQuery(s.deviceURL, url.Values{"user_code": {display}}),
+        ExpiresIn:               int64(deviceCodeTTL.Seconds()),
+        Interval:                devicePollInterval,
+    }, nil
+}
+
+// VerifyDevice the logged in user looks up a user code, without Consent the prompt to show is returned
+func (s *service) VerifyDevice(c context.Context, session *AccessDetails, args *DeviceVerifyParams) (*ConsentPrompt, error) {
+    device := &OAuthDeviceCode{}
+    err := s.db.WithContext(c).Where("user_code = ?", normalizeUserCode(args.UserCode)).First(device).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return nil, invalidf("user code is invalid")
+    }
+    if err != nil {
+        return nil, storeErr("VerifyDevice", err)
+    }
+    if device.UserId != "" || device.Denied || time.Now().After(device.Expires) {
+        return nil, invalidf("user code is expired")
+    }
+
+    client, err := s.GetClient(c, device.ClientId)
+    if err != nil {
+        return nil, err
+    }
+    user, err := s.LoadUser(c, session.UserId)
+    if err != nil {
+        return nil, err
+    }
+    if err = statusError(user.Status); err != nil {
+        return nil, err
+    }
+    scopes := strings.Fields(device.Scope)
+
+    var updates map[string]interface{}
+    switch args.Consent {
+    case "deny":
+        updates = map[string]interface{}{"denied": true}
+    case "allow":
+        if err = s.saveConsent(c, user.ID, client.ClientId, scopes); err != nil {
+            return nil, err
+        }
+        updates = map[string]interface{}{"user_id": user.ID, "auth_time": claimInt(session.Claims, JwtAuthTime)}
+    default:
+        return &ConsentPrompt{ClientId: client.ClientId, ClientName: client.Name, Scopes: scopes}, nil
+    }
+
+    // the code can be answered once, a concurrent answer loses
+    res := s.db.WithContext(c).Model(&OAuthDeviceCode{}).Where("id = ? AND user_id = '' AND denied = ?", device.ID, false).Updates(updates)
+    if res.Error != nil {
+        return nil, storeErr("VerifyDevice", res.Error)
+    }
+    if res.RowsAffected == 0 {
+        return nil, invalidf("user code is expired")
+    }
+    return nil, nil
+}
+
+// deviceGrant the device polls until the user answered, RFC 8628 section 3.4
+func (s *service) deviceGrant(c context.Context, client *OAuthClient, args *TokenParams) (*OAuthToken, error) {
+    if args.DeviceCode == "" {
+        return nil, oauthErr(OAuthInvalidRequest, "device_code is required")
+    }
+
+    device := &OAuthDeviceCode{}
+    err := s.db.WithContext(c).Where("device_code_hash = ?", hashToken(args.DeviceCode)).First(device).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && device.ClientId != client.ClientId) {
+        return nil, oauthErr(OAuthInvalidGrant, "device_code is invalid")
+    }
+    if err != nil {
+        return nil, storeErr("ExchangeToken", err)
+    }
+
+    now := time.Now()
+    if device.UsedAt != nil {
+        return nil, oauthErr(OAuthInvalidGrant, "device_code already used")
+    }
+    if now.After(device.Expires) {
+        return nil, oauthErr(OAuthExpiredToken, "device_code is expired")
+    }
+    if device.Denied {
+        return nil, oauthErr(OAuthAccessDenied, "the user denied the request")
+    }
+
+    if device.UserId == "" {
+        updates := map[string]interface{}{"last_polled_at": &now}
+        tooSoon := device.LastPolledAt != nil && now.Sub(*device.LastPolledAt) < time.Duration(device.Interval)*time.Second
+        if tooSoon {
+            updates["interval"] = device.Interval + devicePollInterval
+        }
+        if err = s.db.WithContext(c).Model(device).Updates(updates).Error; err != nil {
+            return nil, storeErr("ExchangeToken", err)
+        }
+        if tooSoon {
+            return nil, oauthErr(OAuthSlowDown, "poll less frequently")
+        }
+        return nil, oauthErr(OAuthAuthorizationPending, "the user has not answered yet")
+    }
+
+    res := s.db.WithContext(c).Model(&OAuthDeviceCode{}).Where("id = ? AND used_at IS NULL", device.ID).Update("used_at", &now)
+    if res.Error != nil {
+        return nil, storeErr("ExchangeToken", res.Error)
+    }
+    if res.RowsAffected == 0 {
+        return nil, oauthErr(OAuthInvalidGrant, "device_code already used")
+    }
+
+    user, err := s.LoadUser(c, device.UserId)
+    if err != nil || statusError(user.Status) != nil {
+        return nil, oauthErr(OAuthInvalidGrant, "user can not authenticate")
+    }
+    tok, err := s.issueOAuthToken(c, user, client.ClientId, device.Scope, device.AuthTime)
+    if err != nil {
+        return nil, err
+    }
+    if tok.IDToken, err = s.idToken(user, client.ClientId, device.Scope, "", device.AuthTime); err != nil {
+        return nil, err
+    }
+    return tok, nil
+}
+
+func randomUserCode() (string, error) {
+    b := make([]byte, userCodeLen)
+    max := big.NewInt(int64(len(userCodeAlphabet)))
+    for i := range b {
+        n, err := rand.Int(rand.Reader, max)
+        if err != nil {
+            return "", err
+        }
+        b[i] = userCodeAlphabet[n.Int64()]
+    }
+    return string(b), nil
+}
+
+// normalizeUserCode users may type the code in lower case, with or without the dash
+func normalizeUserCode(code string) string {
+    code = strings.ToUpper(code)
+    return strings.Map(func(r rune) rune {
+        if r == '-' || r == ' ' {
+            return -1
+        }
+        return r
+    }, code)
+}
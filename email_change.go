@@ -0,0 +1,227 @@
+package authr
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "gorm.io/gorm"
+    "net/mail"
+    "net/url"
+    "time"
+)
+
+const (
+    emailConfirmTTL = time.Hour * 24
+    emailRevertTTL  = time.Hour * 24 * 7
+)
+
+// Mailer delivers transactional emails
+type Mailer interface {
+    Send(c context.Context, to, subject, body string) error
+}
+
+// WithMailer mailer used to deliver email change confirmation and notices
+func WithMailer(m Mailer) Option {
+    return func(s *service) {
+        s.mailer = m
+    }
+}
+
+// WithEmailLinks urls of the confirm and revert handlers, the token is appended as the `token` query parameter
+func WithEmailLinks(confirmURL, revertURL string) Option {
+    return func(s *service) {
+        s.confirmURL = confirmURL
+        s.revertURL = revertURL
+    }
+}
+
+// RequestEmailChange send a confirm link to the new address and a revert link to the old one
+func (s *service) RequestEmailChange(c context.Context, userId string, args *EmailChangeParams) error {
+    if args == nil {
+        return invalidf("email change params are invalid")
+    }
+    user, err := s.LoadUser(c, userId)
+    if err != nil {
+        return err
+    }
+    email, err := s.newEmail(user, args.Email)
+    if err != nil {
+        return err
+    }
+    return s.startEmailChange(c, user, email)
+}
+
+// newEmail validate the requested address, nothing is stored or sent
+func (s *service) newEmail(user *User, email string) (string, error) {
+    if s.mailer == nil {
+        return "", fmt.Errorf("%w: mailer", ErrNotConfigured)
+    }
+    addr, err := mail.ParseAddress(email)
+    if err != nil {
+        return "", invalidf("email is invalid")
+    }
+    if addr.Address == user.Email {
+        return "", invalidf("email is unchanged")
+    }
+    return addr.Address, nil
+}
+
+// startEmailChange store the pending change and mail both addresses
+func (s *service) startEmailChange(c context.Context, user *User, email string) error {
+    confirmToken, err := randomToken()
+    if err != nil {
+        return err
+    }
+    revertToken, err := randomToken()
+    if err != nil {
+        return err
+    }
+
+    change := EmailChange{
+        UserId:      user.ID,
+        OldEmail:    user.Email,
+        NewEmail:    email,
+        ConfirmHash: hashToken(confirmToken),
+        RevertHash:  hashToken(revertToken),
+        Expires:     time.Now().Add(emailConfirmTTL),
+    }
+
+    err = s.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+        // only the latest request can be confirmed
+        err := tx.Where("user_id = ? AND confirmed_at IS NULL AND reverted_at IS NULL", user.ID).Delete(&EmailChange{}).Error
+        if err != nil {
+            return err
+        }
+        return tx.Create(&change).Error
+    })
+    if err != nil {
+        return storeErr("RequestEmailChange", err)
+    }
+
+    body := fmt.Sprintf("Confirm the change of your email address to %s:\n\n%s\n", change.NewEmail, tokenLink(s.confirmURL, confirmToken))
+    if err = s.mailer.Send(c, change.NewEmail, "Confirm your new email address", body); err != nil {
+        s.log.Error("RequestEmailChange send confirm", "user_id", user.ID, "err", err)
+        return err
+    }
+
+    if change.OldEmail != "" {
+        body = fmt.Sprintf("A change of your email address to %s was requested. If this was not you, revert the change:\n\n%s\n", change.NewEmail, tokenLink(s.revertURL, revertToken))
+        if err = s.mailer.Send(c, change.OldEmail, "Your email address is being changed", body); err != nil {
+            s.log.Error("RequestEmailChange send notice", "user_id", user.ID, "err", err)
+            return err
+        }
+    }
+    return nil
+}
+
+// ConfirmEmailChange swap the user email once the new address is confirmed
+func (s *service) ConfirmEmailChange(c context.Context, token string) error {
+    change := &EmailChange{}
+    if err := s.db.WithContext(c).Where("confirm_hash = ?", hashToken(token)).First(change).Error; err != nil {
+        return ErrTokenInvalid
+    }
+    if change.ConfirmedAt != nil || change.RevertedAt != nil {
+        return ErrTokenUsed
+    }
+    if time.Now().After(change.Expires) {
+        return ErrTokenExpired
+    }
+
+    now := time.Now()
+    err := s.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+        // claim the change first, a concurrent confirmation or revert finds it taken
+        res := tx.Model(&EmailChange{}).Where("id = ? AND confirmed_at IS NULL AND reverted_at IS NULL", change.ID).Update("confirmed_at", &now)
+        if res.Error != nil {
+            return res.Error
+        }
+        if res.RowsAffected == 0 {
+            return ErrTokenUsed
+        }
+        return tx.Model(&User{}).Where("id = ?", change.UserId).Updates(map[string]interface{}{"email": change.NewEmail, "email_verified": true}).Error
+    })
+    if errors.Is(err, ErrTokenUsed) {
+        return err
+    }
+    return storeErr("ConfirmEmailChange", err)
+}
+
+// RevertEmailChange cancel a pending change, or restore the old email and revoke all sessions of the user
+func (s *service) RevertEmailChange(c context.Context, token string) error {
+    change := &EmailChange{}
+    if err := s.db.WithContext(c).Where("revert_hash = ?", hashToken(token)).First(change).Error; err != nil {
+        return ErrTokenInvalid
+    }
+    if change.RevertedAt != nil {
+        return ErrTokenUsed
+    }
+    if time.Since(change.CreatedAt) > emailRevertTTL {
+        return ErrTokenExpired
+    }
+
+    now := time.Now()
+    err := s.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+        res := tx.Model(&EmailChange{}).Where("id = ? AND reverted_at IS NULL", change.ID).Update("reverted_at", &now)
+        if res.Error != nil {
+            return res.Error
+        }
+        if res.RowsAffected == 0 {
+            return ErrTokenUsed
+        }
+        // read again inside the transaction, a confirmation may have won the race since
+        if err := tx.Where("id = ?", change.ID).First(change).Error; err != nil {
+            return err
+        }
+        if change.ConfirmedAt != nil {
+            if err := tx.Model(&User{}).Where("id = ?", change.UserId).Updates(map[string]interface{}{"email": change.OldEmail, "email_verified": false}).Error; err != nil {
+                return err
+            }
+        }
+        // the account may be compromised, force a new login everywhere
+        return s.revokeUserTokens(tx, change.UserId)
+    })
+    if errors.Is(err, ErrTokenUsed) {
+        return err
+    }
+    return storeErr("RevertEmailChange", err)
+}
+
+// revokeUserTokens delete every access and refresh token and every API key of a user
+func (s *service) revokeUserTokens(tx *gorm.DB, userId string) error {
+    if err := tx.Where("user_id = ?", userId).Delete(&APIKey{}).Error; err != nil {
+        return err
+    }
+    return tx.Where("user_id = ?", userId).Delete(&AuthTokens{}).Error
+}
+
+// randomToken url safe random token
+func randomToken() (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken tokens are only stored hashed
+func hashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+func tokenLink(base, token string) string {
+    if base == "" {
+        return token
+    }
+    u, err := url.Parse(base)
+    if err != nil {
+        return token
+    }
+    q := u.Query()
+    q.Set("token", token)
+    u.RawQuery = q.Encode()
+    return u.String()
+}
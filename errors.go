@@ -0,0 +1,214 @@
+package authr
+
+import (
+    "errors"
+    "fmt"
+    "github.com/dgrijalva/jwt-go"
+    "gorm.io/gorm"
+    "net/http"
+)
+
+var (
+    // ErrInvalidRequest the parameters are missing or malformed, the detail says which
+    ErrInvalidRequest = errors.New("authr: invalid request")
+    // ErrInvalidCredentials the username is unknown or the password is wrong, deliberately not told apart
+    ErrInvalidCredentials = errors.New("authr: username or password is incorrect")
+    // ErrUserExists the username is already taken
+    ErrUserExists = errors.New("authr: username already in use")
+    // ErrUnauthorized the request carries no usable credentials
+    ErrUnauthorized = errors.New("authr: unauthorized")
+    // ErrForbidden the caller is authenticated but not allowed
+    ErrForbidden = errors.New("authr: forbidden")
+    // ErrInsufficientScope the credential is restricted to scopes that do not cover the request
+    ErrInsufficientScope = errors.New("authr: insufficient scope")
+    // ErrImpersonated the operation is not allowed on an impersonated session
+    ErrImpersonated = errors.New("authr: not allowed while impersonating")
+    // ErrNotFound the user or token does not exist
+    ErrNotFound = errors.New("authr: not found")
+    // ErrTokenInvalid the token is malformed, badly signed or missing claims
+    ErrTokenInvalid = errors.New("authr: token is invalid")
+    // ErrTokenExpired the token is past its expiry
+    ErrTokenExpired = errors.New("authr: token is expired")
+    // ErrTokenRevoked the token is well formed but no longer in the token store
+    ErrTokenRevoked = errors.New("authr: token is revoked")
+    // ErrTokenReused the refresh token was already rotated
+    ErrTokenReused = errors.New("authr: refresh token already used")
+    // ErrTokenUsed the one time email or password reset token was already used
+    ErrTokenUsed = errors.New("authr: token already used")
+    // ErrAccountPending the account is pending activation
+    ErrAccountPending = errors.New("authr: account is pending activation")
+    // ErrAccountLocked the account is locked
+    ErrAccountLocked = errors.New("authr: account is locked")
+    // ErrAccountDisabled the account is disabled
+    ErrAccountDisabled = errors.New("authr: account is disabled")
+    // ErrAccountInactive the account is in any other status that can not authenticate
+    ErrAccountInactive = errors.New("authr: account is not active")
+    // ErrCSRF a cookie authenticated request did not carry a matching CSRF token
+    ErrCSRF = errors.New("authr: CSRF token missing or invalid")
+    // ErrNotConfigured the operation needs an option that was not given to NewAuthService
+    ErrNotConfigured = errors.New("authr: not configured")
+    // ErrProvider an external identity provider failed or answered with something unusable
+    ErrProvider = errors.New("authr: identity provider failed")
+    // ErrStore the database failed, the cause is wrapped
+    ErrStore = errors.New("authr: store failure")
+)
+
+// StoreError database failure of an operation, matches ErrStore and unwraps to the cause
+type StoreError struct {
+    Op  string
+    Err error
+}
+
+func (e *StoreError) Error() string {
+    return fmt.Sprintf("authr: %s: %v", e.Op, e.Err)
+}
+
+func (e *StoreError) Unwrap() error { return e.Err }
+
+func (e *StoreError) Is(target error) bool { return target == ErrStore }
+
+// storeErr translate a gorm error, record not found becomes ErrNotFound
+func storeErr(op string, err error) error {
+    switch {
+    case err == nil:
+        return nil
+    case errors.Is(err, gorm.ErrRecordNotFound):
+        return ErrNotFound
+    default:
+        return &StoreError{Op: op, Err: err}
+    }
+}
+
+// requestError matches ErrInvalidRequest, Detail is safe to show to the client
+type requestError struct {
+    Detail string
+}
+
+func (e *requestError) Error() string {
+    return ErrInvalidRequest.Error() + ": " + e.Detail
+}
+
+func (e *requestError) Is(target error) bool { return target == ErrInvalidRequest }
+
+// invalidf ErrInvalidRequest with a detail for the problem response
+func invalidf(format string, args ...interface{}) error {
+    return &requestError{Detail: fmt.Sprintf(format, args...)}
+}
+
+// tokenErr classify a jwt parse error as ErrTokenExpired or ErrTokenInvalid
+func tokenErr(err error) error {
+    var ve *jwt.ValidationError
+    if errors.As(err, &ve) && ve.Errors&jwt.ValidationErrorExpired != 0 {
+        return fmt.Errorf("%w: %v", ErrTokenExpired, err)
+    }
+    return fmt.Errorf("%w: %v", ErrTokenInvalid, err)
+}
+
+// ErrorCode stable machine readable code of a problem response
+type ErrorCode string
+
+const (
+    CodeInvalidRequest     ErrorCode = "invalid_request"
+    CodeInvalidCredentials ErrorCode = "invalid_credentials"
+    CodeUserExists         ErrorCode = "user_exists"
+    CodeUnauthorized       ErrorCode = "unauthorized"
+    CodeForbidden          ErrorCode = "forbidden"
+    CodeInsufficientScope  ErrorCode = "insufficient_scope"
+    CodeImpersonated       ErrorCode = "impersonated"
+    CodeNotFound           ErrorCode = "not_found"
+    CodeTokenInvalid       ErrorCode = "token_invalid"
+    CodeTokenExpired       ErrorCode = "token_expired"
+    CodeTokenRevoked       ErrorCode = "token_revoked"
+    CodeTokenReused        ErrorCode = "token_reused"
+    CodeTokenUsed          ErrorCode = "token_used"
+    CodeAccountPending     ErrorCode = "account_pending"
+    CodeAccountLocked      ErrorCode = "account_locked"
+    CodeAccountDisabled    ErrorCode = "account_disabled"
+    CodeAccountInactive    ErrorCode = "account_inactive"
+    CodeCSRF               ErrorCode = "csrf_failed"
+    CodeNotConfigured      ErrorCode = "not_configured"
+    CodeProvider           ErrorCode = "provider_error"
+    CodeInternal           ErrorCode = "internal_error"
+)
+
+// problemTypePrefix the problem type URI is the prefix followed by the code
+const problemTypePrefix = "urn:authr:problem:"
+
+// ProblemContentType media type of RFC 7807 responses
+const ProblemContentType = "application/problem+json"
+
+// Problem RFC 7807 problem details, Code is the stable extension member clients switch on
+type Problem struct {
+    Type     string    `json:"type"`
+    Title    string    `json:"title"`
+    Status   int       `json:"status"`
+    Detail   string    `json:"detail,omitempty"`
+    Instance string    `json:"instance,omitempty"`
+    Code     ErrorCode `json:"code"`
+}
+
+func (p *Problem) Error() string {
+    if p.Detail != "" {
+        return p.Detail
+    }
+    return p.Title
+}
+
+// problemKinds in match order, an error matching none is an internal error
+var problemKinds = []struct {
+    err    error
+    code   ErrorCode
+    status int
+    title  string
+}{
+    {ErrInvalidRequest, CodeInvalidRequest, http.StatusUnprocessableEntity, "Invalid request"},
+    {ErrInvalidCredentials, CodeInvalidCredentials, http.StatusUnauthorized, "Username or password is incorrect"},
+    {ErrUserExists, CodeUserExists, http.StatusConflict, "Username already in use"},
+    {ErrUnauthorized, CodeUnauthorized, http.StatusUnauthorized, "Unauthorized"},
+    {ErrForbidden, CodeForbidden, http.StatusForbidden, "Forbidden"},
+    {ErrInsufficientScope, CodeInsufficientScope, http.StatusForbidden, "Insufficient scope"},
+    {ErrImpersonated, CodeImpersonated, http.StatusForbidden, "Not allowed while impersonating"},
+    {ErrNotFound, CodeNotFound, http.StatusNotFound, "Not found"},
+    {ErrTokenInvalid, CodeTokenInvalid, http.StatusUnauthorized, "Token is invalid"},
+    {ErrTokenExpired, CodeTokenExpired, http.StatusUnauthorized, "Token is expired"},
+    {ErrTokenRevoked, CodeTokenRevoked, http.StatusUnauthorized, "Token is revoked"},
+    {ErrTokenReused, CodeTokenReused, http.StatusUnauthorized, "Refresh token already used"},
+    {ErrTokenUsed, CodeTokenUsed, http.StatusGone, "Token already used"},
+    {ErrAccountPending, CodeAccountPending, http.StatusForbidden, "Account is pending activation"},
+    {ErrAccountLocked, CodeAccountLocked, http.StatusForbidden, "Account is locked"},
+    {ErrAccountDisabled, CodeAccountDisabled, http.StatusForbidden, "Account is disabled"},
+    {ErrAccountInactive, CodeAccountInactive, http.StatusForbidden, "Account is not active"},
+    {ErrCSRF, CodeCSRF, http.StatusForbidden, "CSRF token missing or invalid"},
+    {ErrNotConfigured, CodeNotConfigured, http.StatusNotImplemented, "Not configured"},
+    {ErrProvider, CodeProvider, http.StatusBadGateway, "Identity provider failed"},
+}
+
+// NewProblem map err to its problem details, only invalid requests carry a detail
+// so store failures and credential checks never leak to the client
+func NewProblem(err error) *Problem {
+    var p *Problem
+    if errors.As(err, &p) {
+        return p
+    }
+    for _, k := range problemKinds {
+        if errors.Is(err, k.err) {
+            p = &Problem{Type: problemTypePrefix + string(k.code), Title: k.title, Status: k.status, Code: k.code}
+            var re *requestError
+            if errors.As(err, &re) {
+                p.Detail = re.Detail
+            }
+            return p
+        }
+    }
+    return &Problem{
+        Type:   problemTypePrefix + string(CodeInternal),
+        Title:  "Internal error",
+        Status: http.StatusInternalServerError,
+        Code:   CodeInternal,
+    }
+}
+
+// ErrorCodeOf stable code of err, CodeInternal when err is not an authr error
+func ErrorCodeOf(err error) ErrorCode {
+    return NewProblem(err).Code
+}
@@ -0,0 +1,158 @@
+package authr
+
+import (
+    "context"
+    "crypto/subtle"
+    "net/http"
+    "strings"
+)
+
+// TokenExtractor finds the raw access token of a request, "" and nil when the request carries none.
+// An error stops the chain.
+type TokenExtractor interface {
+    ExtractToken(r *http.Request) (string, error)
+}
+
+// TokenExtractorFunc adapts a function to a TokenExtractor
+type TokenExtractorFunc func(r *http.Request) (string, error)
+
+func (f TokenExtractorFunc) ExtractToken(r *http.Request) (string, error) {
+    return f(r)
+}
+
+// ExtractorChain tries the extractors in order, the first token found wins
+type ExtractorChain []TokenExtractor
+
+func (c ExtractorChain) ExtractToken(r *http.Request) (string, error) {
+    for _, e := range c {
+        token, err := e.ExtractToken(r)
+        if err != nil || token != "" {
+            return token, err
+        }
+    }
+    return "", nil
+}
+
+// BearerExtractor `Authorization: Bearer <token>`, any other scheme is ignored
+func BearerExtractor() TokenExtractor {
+    return TokenExtractorFunc(bearerToken)
+}
+
+func bearerToken(r *http.Request) (string, error) {
+    scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+    if !ok || !strings.EqualFold(scheme, "Bearer") {
+        return "", nil
+    }
+    return strings.TrimSpace(token), nil
+}
+
+// HeaderExtractor the whole value of a custom header, e.g. X-Auth-Token
+func HeaderExtractor(name string) TokenExtractor {
+    return TokenExtractorFunc(func(r *http.Request) (string, error) {
+        return strings.TrimSpace(r.Header.Get(name)), nil
+    })
+}
+
+// QueryExtractor a query parameter, for SSE and WebSocket upgrades that can not set headers
+func QueryExtractor(param string) TokenExtractor {
+    return TokenExtractorFunc(func(r *http.Request) (string, error) {
+        return r.URL.Query().Get(param), nil
+    })
+}
+
+// FormExtractor a field of a url encoded or multipart form body
+func FormExtractor(field string) TokenExtractor {
+    return TokenExtractorFunc(func(r *http.Request) (string, error) {
+        return r.PostFormValue(field), nil
+    })
+}
+
+// CookieExtractor a cookie. Cookies are sent by the browser on cross site requests, so unless
+// csrfCookie is empty a request with an unsafe method must repeat the csrfCookie value in csrfHeader.
+func CookieExtractor(name, csrfCookie, csrfHeader string) TokenExtractor {
+    return TokenExtractorFunc(func(r *http.Request) (string, error) {
+        c, err := r.Cookie(name)
+        if err != nil || c.Value == "" {
+            return "", nil
+        }
+        if csrfCookie != "" {
+            if err := checkCSRF(r, csrfCookie, csrfHeader); err != nil {
+                return "", err
+            }
+        }
+        return c.Value, nil
+    })
+}
+
+// checkCSRF safe methods pass, anything else must echo the CSRF cookie in the CSRF header
+func checkCSRF(r *http.Request, csrfCookie, csrfHeader string) error {
+    switch r.Method {
+    case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+        return nil
+    }
+    var cookie string
+    if c, err := r.Cookie(csrfCookie); err == nil {
+        cookie = c.Value
+    }
+    header := r.Header.Get(csrfHeader)
+    if cookie == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) != 1 {
+        return ErrCSRF
+    }
+    return nil
+}
+
+// WithTokenExtractors replace the default chain of the service, bearer header then the access cookie
+// when WithCookies is set. The middleware of an adapter can override it per instance.
+func WithTokenExtractors(extractors ...TokenExtractor) Option {
+    return func(s *service) {
+        s.extractors = extractors
+    }
+}
+
+// extractors the default chain
+func (s *service) tokenExtractors() ExtractorChain {
+    if s.extractors != nil {
+        return s.extractors
+    }
+    chain := ExtractorChain{BearerExtractor()}
+    if s.cookies != nil {
+        chain = append(chain, s.cookies.Extractor())
+    }
+    return chain
+}
+
+type extractorsKey struct{}
+
+// withExtractors request carrying the extractor chain of a middleware instance
+func withExtractors(r *http.Request, extractors []TokenExtractor) *http.Request {
+    if len(extractors) == 0 {
+        return r
+    }
+    return r.WithContext(context.WithValue(r.Context(), extractorsKey{}, ExtractorChain(extractors)))
+}
+
+// requestExtractors the chain of the middleware that handled r, else the default chain
+func (s *service) requestExtractors(r *http.Request) ExtractorChain {
+    if chain, ok := r.Context().Value(extractorsKey{}).(ExtractorChain); ok {
+        return chain
+    }
+    return s.tokenExtractors()
+}
+
+// tokenRequest present the extracted token as a bearer token to the token service
+func (s *service) tokenRequest(r *http.Request) (*http.Request, error) {
+    token, err := s.requestExtractors(r).ExtractToken(r)
+    if err != nil {
+        return nil, err
+    }
+    if token == "" {
+        return nil, ErrUnauthorized
+    }
+    if r.Header.Get("Authorization") == "Bearer "+token {
+        return r, nil
+    }
+    r2 := r.WithContext(r.Context())
+    r2.Header = r.Header.Clone()
+    r2.Header.Set("Authorization", "Bearer "+token)
+    return r2, nil
+}
@@ -0,0 +1,639 @@
+package authr
+
+import (
+    "context"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/dgrijalva/jwt-go"
+    "github.com/twinj/uuid"
+    "gorm.io/gorm"
+    "io"
+    "math/big"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    federatedLoginTTL = time.Minute * 10
+    // jwksRefreshInterval an unknown kid refetches the provider keys at most this often
+    jwksRefreshInterval = time.Minute
+)
+
+// FederatedProvider external OAuth 2.0 or OpenID Connect identity provider users can sign in with
+type FederatedProvider struct {
+    // Name key of the provider in the adapters and of the linked identities, e.g. "google"
+    Name         string
+    ClientId     string
+    ClientSecret string
+    // RedirectURL callback of this service as registered at the provider
+    RedirectURL string
+    Scopes      []string
+    // Issuer OpenID Connect issuer, endpoints left empty are read from its discovery document and the
+    // ID token of the callback is verified. Plain OAuth 2.0 providers leave it empty and set the endpoints.
+    Issuer      string
+    AuthURL     string
+    TokenURL    string
+    UserInfoURL string
+    JWKSURL     string
+    // claim names of the ID token or userinfo response, default to sub, email, email_verified and preferred_username
+    SubjectClaim       string
+    EmailClaim         string
+    EmailVerifiedClaim string
+    UsernameClaim      string
+    // LinkByEmail sign in to the existing user with the same address when both sides verified it,
+    // otherwise an unknown identity always provisions a new user
+    LinkByEmail bool
+    // Roles of the users provisioned on their first sign in
+    Roles []string
+    // Client defaults to a client with a 10 second timeout
+    Client *http.Client
+}
+
+// GoogleProvider Google sign in, an OpenID Connect provider
+func GoogleProvider(clientId, clientSecret, redirectURL string) FederatedProvider {
+    return FederatedProvider{
+        Name:         "google",
+        ClientId:     clientId,
+        ClientSecret: clientSecret,
+        RedirectURL:  redirectURL,
+        Scopes:       []string{ScopeOpenID, "email", "profile"},
+        Issuer:       "https://accounts.google.com",
+    }
+}
+
+// GitHubProvider GitHub sign in, plain OAuth 2.0 with the profile of the REST API. GitHub does not say
+// whether the public email is verified so LinkByEmail never matches.
+func GitHubProvider(clientId, clientSecret, redirectURL string) FederatedProvider {
+    return FederatedProvider{
+        Name:          "github",
+        ClientId:      clientId,
+        ClientSecret:  clientSecret,
+        RedirectURL:   redirectURL,
+        Scopes:        []string{"read:user", "user:email"},
+        AuthURL:       "https://github.com/login/oauth/authorize",
+        TokenURL:      "https://github.com/login/oauth/access_token",
+        UserInfoURL:   "https://api.github.com/user",
+        SubjectClaim:  "id",
+        UsernameClaim: "login",
+    }
+}
+
+// WithFederatedProviders sign in with external identity providers, see FederationService
+func WithFederatedProviders(providers ...FederatedProvider) Option {
+    return func(s *service) {
+        if s.providers == nil {
+            s.providers = map[string]*federatedProvider{}
+        }
+        for _, p := range providers {
+            p.Issuer = strings.TrimSuffix(p.Issuer, "/")
+            if p.SubjectClaim == "" {
+                p.SubjectClaim = "sub"
+            }
+            if p.EmailClaim == "" {
+                p.EmailClaim = "email"
+            }
+            if p.EmailVerifiedClaim == "" {
+                p.EmailVerifiedClaim = "email_verified"
+            }
+            if p.UsernameClaim == "" {
+                p.UsernameClaim = "preferred_username"
+            }
+            if p.Client == nil {
+                p.Client = &http.Client{Timeout: time.Second * 10}
+            }
+            s.providers[p.Name] = &federatedProvider{FederatedProvider: p}
+        }
+    }
+}
+
+// FederationService sign in with external identity providers. A first sign in provisions a user without a
+// password, signed in users can link further providers to their account.
+type FederationService interface {
+    BeginFederatedLogin(c context.Context, provider, linkUserId string) (*FederatedRedirect, error)
+    CompleteFederatedLogin(c context.Context, provider string, args *FederatedCallbackParams) (*FederatedLoginResult, error)
+    ListIdentities(c context.Context, userId string) ([]*ExternalIdentity, error)
+    UnlinkIdentity(c context.Context, userId, provider string) error
+}
+
+// BeginFederatedLogin redirect to the provider, a non empty linkUserId links the identity to that user
+// instead of signing in. The adapters keep State in a cookie to bind the callback to the browser.
+func (s *service) BeginFederatedLogin(c context.Context, provider, linkUserId string) (*FederatedRedirect, error) {
+    p, err := s.provider(provider)
+    if err != nil {
+        return nil, err
+    }
+    if err = p.discover(c); err != nil {
+        return nil, err
+    }
+
+    var state, nonce, verifier string
+    for _, v := range []*string{&state, &nonce, &verifier} {
+        if *v, err = randomToken(); err != nil {
+            return nil, err
+        }
+    }
+    err = s.db.WithContext(c).Create(&FederatedLogin{
+        StateHash:    hashToken(state),
+        Provider:     p.Name,
+        Nonce:        nonce,
+        CodeVerifier: verifier,
+        LinkUserId:   linkUserId,
+        Expires:      time.Now().Add(federatedLoginTTL),
+    }).Error
+    if err != nil {
+        return nil, storeErr("BeginFederatedLogin", err)
+    }
+
+    sum := sha256.Sum256([]byte(verifier))
+    params := url.Values{
+        "response_type":         {"code"},
+        "client_id":             {p.ClientId},
+        "redirect_uri":          {p.RedirectURL},
+        "scope":                 {strings.Join(p.Scopes, " ")},
+        "state":                 {state},
+        "code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+        "code_challenge_method": {"S256"},
+    }
+    if p.Issuer != "" {
+        params.Set("nonce", nonce)
+    }
+    return &FederatedRedirect{URL: withQuery(p.AuthURL, params), State: state}, nil
+}
+
+// CompleteFederatedLogin redeem the code of the provider callback and resolve the user behind the identity.
+// The caller issues the tokens unless the result is a link to an already signed in user.
+func (s *service) CompleteFederatedLogin(c context.Context, provider string, args *FederatedCallbackParams) (*FederatedLoginResult, error) {
+    p, err := s.provider(provider)
+    if err != nil {
+        return nil, err
+    }
+    login, err := s.consumeFederatedLogin(c, p.Name, args.State, args.BrowserState)
+    if err != nil {
+        return nil, err
+    }
+
+    if args.Error != "" {
+        return nil, fmt.Errorf("%w: %s answered %s", ErrProvider, p.Name, args.Error)
+    }
+    if args.Code == "" {
+        return nil, invalidf("code is required")
+    }
+    if err = p.discover(c); err != nil {
+        return nil, err
+    }
+    claims, err := p.claims(c, args.Code, login)
+    if err != nil {
+        s.log.Error("CompleteFederatedLogin", "provider", p.Name, "err", err)
+        return nil, err
+    }
+    subject := claimString(claims, p.SubjectClaim)
+    if subject == "" {
+        return nil, fmt.Errorf("%w: %s returned no %s claim", ErrProvider, p.Name, p.SubjectClaim)
+    }
+
+    result, err := s.federatedUser(c, p, login.LinkUserId, subject, claims)
+    if err != nil {
+        return nil, err
+    }
+    if err = statusError(result.User.Status); err != nil {
+        return nil, err
+    }
+    result.User.authBackend = "federated:" + p.Name
+    return result, nil
+}
+
+// consumeFederatedLogin the state must match the state cookie of the browser and is single use, a replayed callback loses
+func (s *service) consumeFederatedLogin(c context.Context, provider, state, browserState string) (*FederatedLogin, error) {
+    if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(browserState)) != 1 {
+        return nil, ErrCSRF
+    }
+
+    login := &FederatedLogin{}
+    err := s.db.WithContext(c).Where("state_hash = ? AND provider = ?", hashToken(state), provider).First(login).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return nil, invalidf("federated login state is invalid")
+    }
+    if err != nil {
+        return nil, storeErr("consumeFederatedLogin", err)
+    }
+    now := time.Now()
+    res := s.db.WithContext(c).Model(&FederatedLogin{}).Where("id = ? AND used_at IS NULL", login.ID).Update("used_at", &now)
+    if res.Error != nil {
+        return nil, storeErr("consumeFederatedLogin", res.Error)
+    }
+    if res.RowsAffected == 0 || now.After(login.Expires) {
+        return nil, invalidf("federated login state is expired")
+    }
+    return login, nil
+}
+
+// federatedUser link the identity to the signed in user, or find the user it belongs to, or provision one
+func (s *service) federatedUser(c context.Context, p *federatedProvider, linkUserId, subject string, claims map[string]interface{}) (*FederatedLoginResult, error) {
+    email := claimString(claims, p.EmailClaim)
+    identity := &ExternalIdentity{Provider: p.Name, Subject: subject, Email: email}
+    result := &FederatedLoginResult{Identity: identity, Linked: linkUserId != ""}
+
+    err := s.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+        existing := &ExternalIdentity{}
+        err := tx.Where("provider = ? AND subject = ?", p.Name, subject).First(existing).Error
+        if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+            return err
+        }
+        found := err == nil
+
+        user := &User{}
+        switch {
+        case linkUserId != "":
+            if found {
+                if existing.UserId != linkUserId {
+                    return invalidf("the %s account is linked to another user", p.Name)
+                }
+                result.Identity = existing
+                result.User = user
+                return tx.Where("id = ?", linkUserId).First(user).Error
+            }
+            var count int64
+            if err = tx.Model(&ExternalIdentity{}).Where("user_id = ? AND provider = ?", linkUserId, p.Name).Count(&count).Error; err != nil {
+                return err
+            }
+            if count > 0 {
+                return invalidf("a %s account is already linked", p.Name)
+            }
+            if err = tx.Where("id = ?", linkUserId).First(user).Error; err != nil {
+                return err
+            }
+        case found:
+            result.Identity = existing
+            result.User = user
+            return tx.Where("id = ?", existing.UserId).First(user).Error
+        case p.LinkByEmail && email != "" && claimBool(claims, p.EmailVerifiedClaim):
+            // both sides verified the address, an unverified local account could have been registered by anyone
+            err = tx.Where("lower(email) = lower(?) AND email_verified = ?", email, true).First(user).Error
+            if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+                return err
+            }
+            if err != nil {
+                user, err = s.provisionUser(tx, p, subject, claims)
+                result.Created = true
+            }
+            if err != nil {
+                return err
+            }
+        default:
+            if user, err = s.provisionUser(tx, p, subject, claims); err != nil {
+                return err
+            }
+            result.Created = true
+        }
+
+        result.User = user
+        identity.UserId = user.ID
+        result.NewIdentity = true
+        return tx.Create(identity).Error
+    })
+    if err != nil {
+        return nil, storeErr("CompleteFederatedLogin", err)
+    }
+    return result, nil
+}
+
+// provisionUser just in time user without a password, the username is made unique among the local users
+// and the names other backends resolve
+func (s *service) provisionUser(tx *gorm.DB, p *federatedProvider, subject string, claims map[string]interface{}) (*User, error) {
+    roles, err := joinRoles(p.Roles)
+    if err != nil {
+        return nil, err
+    }
+    email := claimString(claims, p.EmailClaim)
+    base := claimString(claims, p.UsernameClaim)
+    if base == "" && email != "" {
+        base = email[:strings.IndexByte(email+"@", '@')]
+    }
+    if base == "" {
+        base = p.Name + "-" + subject
+    }
+
+    username := base
+    for i := 0; ; i++ {
+        var count int64
+        if err = tx.Model(&User{}).Unscoped().Where("username = ?", username).Count(&count).Error; err != nil {
+            return nil, err
+        }
+        if count == 0 {
+            err = s.backendUsername(tx.Statement.Context, username)
+            if err == nil {
+                break
+            }
+            if !errors.Is(err, ErrUserExists) {
+                return nil, err
+            }
+        }
+        if i == 5 {
+            return nil, ErrUserExists
+        }
+        suffix, err := randomToken()
+        if err != nil {
+            return nil, err
+        }
+        username = base + "-" + strings.ToLower(hashToken(suffix)[:6])
+    }
+
+    user := &User{
+        ID:            uuid.NewV4().String(),
+        Username:      username,
+        Email:         email,
+        EmailVerified: email != "" && claimBool(claims, p.EmailVerifiedClaim),
+        Roles:         roles,
+        Status:        StatusActive,
+    }
+    if err = tx.Create(user).Error; err != nil {
+        return nil, err
+    }
+    s.log.Debug("CompleteFederatedLogin provisioned", "user_id", user.ID, "provider", p.Name)
+    return user, nil
+}
+
+func (s *service) ListIdentities(c context.Context, userId string) ([]*ExternalIdentity, error) {
+    var identities []*ExternalIdentity
+    if err := s.db.WithContext(c).Where("user_id = ?", userId).Order("provider").Find(&identities).Error; err != nil {
+        return nil, storeErr("ListIdentities", err)
+    }
+    return identities, nil
+}
+
+// UnlinkIdentity refused when it would leave a user without a password and without any identity
+func (s *service) UnlinkIdentity(c context.Context, userId, provider string) error {
+    return storeErr("UnlinkIdentity", s.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+        user := &User{}
+        if err := tx.Where("id = ?", userId).First(user).Error; err != nil {
+            return err
+        }
+        var count int64
+        if err := tx.Model(&ExternalIdentity{}).Where("user_id = ?", userId).Count(&count).Error; err != nil {
+            return err
+        }
+        if user.Password == "" && count <= 1 {
+            return invalidf("the last sign in method can not be removed")
+        }
+        res := tx.Where("user_id = ? AND provider = ?", userId, provider).Delete(&ExternalIdentity{})
+        if res.Error != nil {
+            return res.Error
+        }
+        if res.RowsAffected == 0 {
+            return gorm.ErrRecordNotFound
+        }
+        return nil
+    }))
+}
+
+func (s *service) provider(name string) (*federatedProvider, error) {
+    if len(s.providers) == 0 {
+        return nil, fmt.Errorf("%w: federated providers", ErrNotConfigured)
+    }
+    p, ok := s.providers[name]
+    if !ok {
+        return nil, ErrNotFound
+    }
+    return p, nil
+}
+
+// federatedProvider a configured provider with the endpoints and keys fetched from its issuer
+type federatedProvider struct {
+    FederatedProvider
+    mu         sync.Mutex
+    discovered bool
+    keys       map[string]*rsa.PublicKey
+    keysAt     time.Time
+}
+
+func (p *federatedProvider) validate() error {
+    if p.Name == "" || p.ClientId == "" || p.RedirectURL == "" {
+        return fmt.Errorf("%w: federated provider %q needs a Name, ClientId and RedirectURL", ErrNotConfigured, p.Name)
+    }
+    if p.Issuer == "" && (p.AuthURL == "" || p.TokenURL == "" || p.UserInfoURL == "") {
+        return fmt.Errorf("%w: federated provider %q needs an Issuer or the auth, token and userinfo URLs", ErrNotConfigured, p.Name)
+    }
+    return nil
+}
+
+// discover fill the endpoints left empty from the discovery document of the issuer, once
+func (p *federatedProvider) discover(c context.Context) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.Issuer == "" || p.discovered {
+        return nil
+    }
+
+    doc := &OIDCDiscovery{}
+    if err := p.getJSON(c, p.Issuer+"/.well-known/openid-configuration", "", doc); err != nil {
+        return err
+    }
+    if doc.Issuer != p.Issuer {
+        return fmt.Errorf("%w: %s discovery issuer %q does not match", ErrProvider, p.Name, doc.Issuer)
+    }
+    if p.AuthURL == "" {
+        p.AuthURL = doc.AuthorizationEndpoint
+    }
+    if p.TokenURL == "" {
+        p.TokenURL = doc.TokenEndpoint
+    }
+    if p.UserInfoURL == "" {
+        p.UserInfoURL = doc.UserinfoEndpoint
+    }
+    if p.JWKSURL == "" {
+        p.JWKSURL = doc.JWKSURI
+    }
+    p.discovered = true
+    return nil
+}
+
+// claims redeem the code and merge the verified ID token with the userinfo response
+func (p *federatedProvider) claims(c context.Context, code string, login *FederatedLogin) (map[string]interface{}, error) {
+    form := url.Values{
+        "grant_type":    {"authorization_code"},
+        "code":          {code},
+        "redirect_uri":  {p.RedirectURL},
+        "client_id":     {p.ClientId},
+        "client_secret": {p.ClientSecret},
+        "code_verifier": {login.CodeVerifier},
+    }
+    req, err := http.NewRequestWithContext(c, http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrProvider, err)
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    tok := struct {
+        AccessToken      string `json:"access_token"`
+        IDToken          string `json:"id_token"`
+        Error            string `json:"error"`
+        ErrorDescription string `json:"error_description"`
+    }{}
+    if err = p.do(req, &tok); err != nil {
+        return nil, err
+    }
+    if tok.Error != "" || tok.AccessToken == "" {
+        return nil, fmt.Errorf("%w: %s token endpoint answered %q %s", ErrProvider, p.Name, tok.Error, tok.ErrorDescription)
+    }
+
+    claims := map[string]interface{}{}
+    if p.Issuer != "" {
+        if claims, err = p.verifyIDToken(c, tok.IDToken, login.Nonce); err != nil {
+            return nil, err
+        }
+    }
+    if p.UserInfoURL != "" {
+        info := map[string]interface{}{}
+        if err = p.getJSON(c, p.UserInfoURL, tok.AccessToken, &info); err != nil {
+            return nil, err
+        }
+        if sub, ok := claims["sub"]; ok && fmt.Sprint(sub) != claimString(info, "sub") {
+            return nil, fmt.Errorf("%w: %s userinfo subject does not match the ID token", ErrProvider, p.Name)
+        }
+        for k, v := range info {
+            claims[k] = v
+        }
+    }
+    return claims, nil
+}
+
+// verifyIDToken RS256 signature by a key of the issuer, issuer, audience, expiry and nonce
+func (p *federatedProvider) verifyIDToken(c context.Context, raw, nonce string) (map[string]interface{}, error) {
+    if raw == "" {
+        return nil, fmt.Errorf("%w: %s returned no ID token", ErrProvider, p.Name)
+    }
+    token, err := jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+        if token.Method != jwt.SigningMethodRS256 {
+            return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+        }
+        kid, _ := token.Header["kid"].(string)
+        return p.key(c, kid)
+    })
+    if err != nil {
+        return nil, fmt.Errorf("%w: %s ID token: %v", ErrProvider, p.Name, err)
+    }
+    claims := token.Claims.(jwt.MapClaims)
+
+    aud := false
+    switch v := claims["aud"].(type) {
+    case string:
+        aud = v == p.ClientId
+    case []interface{}:
+        for _, a := range v {
+            aud = aud || a == p.ClientId
+        }
+    }
+    switch {
+    case !claims.VerifyIssuer(p.Issuer, true):
+        err = errors.New("issuer does not match")
+    case !aud:
+        err = errors.New("audience does not match")
+    case claims["exp"] == nil:
+        err = errors.New("exp is missing")
+    case subtle.ConstantTimeCompare([]byte(claimString(claims, "nonce")), []byte(nonce)) != 1:
+        err = errors.New("nonce does not match")
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%w: %s ID token: %v", ErrProvider, p.Name, err)
+    }
+    return claims, nil
+}
+
+// key public key of the issuer by kid, an unknown kid refetches the JWKS after a key rotation
+func (p *federatedProvider) key(c context.Context, kid string) (*rsa.PublicKey, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if key, ok := p.keys[kid]; ok {
+        return key, nil
+    }
+    if p.JWKSURL == "" || time.Since(p.keysAt) < jwksRefreshInterval {
+        return nil, fmt.Errorf("unknown key %q", kid)
+    }
+
+    set := &JSONWebKeySet{}
+    if err := p.getJSON(c, p.JWKSURL, "", set); err != nil {
+        return nil, err
+    }
+    p.keysAt = time.Now()
+    p.keys = map[string]*rsa.PublicKey{}
+    for _, k := range set.Keys {
+        n, errN := base64.RawURLEncoding.DecodeString(k.N)
+        e, errE := base64.RawURLEncoding.DecodeString(k.E)
+        if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") || errN != nil || errE != nil {
+            continue
+        }
+        p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+    }
+    if key, ok := p.keys[kid]; ok {
+        return key, nil
+    }
+    return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func (p *federatedProvider) getJSON(c context.Context, target, accessToken string, v interface{}) error {
+    req, err := http.NewRequestWithContext(c, http.MethodGet, target, nil)
+    if err != nil {
+        return fmt.Errorf("%w: %v", ErrProvider, err)
+    }
+    if accessToken != "" {
+        req.Header.Set("Authorization", "Bearer "+accessToken)
+    }
+    return p.do(req, v)
+}
+
+// do send the request and decode the JSON answer, numbers are kept as json.Number so ids do not lose digits
+func (p *federatedProvider) do(req *http.Request, v interface{}) error {
+    req.Header.Set("Accept", "application/json")
+    resp, err := p.Client.Do(req)
+    if err != nil {
+        return fmt.Errorf("%w: %s: %v", ErrProvider, p.Name, err)
+    }
+    defer resp.Body.Close()
+
+    dec := json.NewDecoder(io.LimitReader(resp.Body, 1<<20))
+    dec.UseNumber()
+    if err = dec.Decode(v); err != nil && resp.StatusCode < 300 {
+        return fmt.Errorf("%w: %s %s: %v", ErrProvider, p.Name, req.URL.Path, err)
+    }
+    // the token endpoint answers errors with 400 and a JSON body the caller reports
+    tokenErr := req.Method == http.MethodPost && resp.StatusCode == http.StatusBadRequest && err == nil
+    if resp.StatusCode >= 300 && !tokenErr {
+        return fmt.Errorf("%w: %s %s answered %s", ErrProvider, p.Name, req.URL.Path, resp.Status)
+    }
+    return nil
+}
+
+// claimString claims of external providers, numeric ids are formatted without exponent
+func claimString(claims map[string]interface{}, name string) string {
+    switch v := claims[name].(type) {
+    case string:
+        return v
+    case json.Number:
+        return v.String()
+    case float64:
+        return strconv.FormatFloat(v, 'f', -1, 64)
+    case bool:
+        return strconv.FormatBool(v)
+    }
+    return ""
+}
+
+// claimBool some providers send booleans as strings
+func claimBool(claims map[string]interface{}, name string) bool {
+    switch v := claims[name].(type) {
+    case bool:
+        return v
+    case string:
+        b, _ := strconv.ParseBool(v)
+        return b
+    }
+    return false
+}
@@ -0,0 +1,267 @@
+package authr
+
+import (
+    "context"
+    "crypto/rsa"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "github.com/dgrijalva/jwt-go"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "testing"
+    "time"
+)
+
+const testProviderClientId = "authr-client"
+
+// testIdP OpenID Connect provider answering every code with an ID token of claims
+type testIdP struct {
+    *httptest.Server
+    // signer signs the ID tokens, the JWKS publishes testRSAKey 0
+    signer *rsa.PrivateKey
+    claims jwt.MapClaims
+    nonce  string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+    idp := &testIdP{signer: testRSAKey(t, 0)}
+    mux := http.NewServeMux()
+    mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(&OIDCDiscovery{
+            Issuer:                idp.URL,
+            AuthorizationEndpoint: idp.URL + "/authorize",
+            TokenEndpoint:         idp.URL + "/token",
+            UserinfoEndpoint:      idp.URL + "/userinfo",
+            JWKSURI:               idp.URL + "/jwks",
+        })
+    })
+    mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+        pub := testRSAKey(t, 0).PublicKey
+        json.NewEncoder(w).Encode(&JSONWebKeySet{Keys: []JSONWebKey{{
+            Kty: "RSA",
+            Use: "sig",
+            Alg: "RS256",
+            Kid: "k1",
+            N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+            E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+        }}})
+    })
+    mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+        claims := jwt.MapClaims{
+            "iss":   idp.URL,
+            "aud":   testProviderClientId,
+            "sub":   "subject-1",
+            "iat":   time.Now().Unix(),
+            "exp":   time.Now().Add(time.Minute).Unix(),
+            "nonce": idp.nonce,
+        }
+        for k, v := range idp.claims {
+            claims[k] = v
+        }
+        token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+        token.Header["kid"] = "k1"
+        signed, err := token.SignedString(idp.signer)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        json.NewEncoder(w).Encode(map[string]string{"access_token": "provider-access", "id_token": signed})
+    })
+    mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+        sub, ok := idp.claims["sub"]
+        if !ok {
+            sub = "subject-1"
+        }
+        json.NewEncoder(w).Encode(map[string]interface{}{"sub": sub})
+    })
+    idp.Server = httptest.NewServer(mux)
+    t.Cleanup(idp.Close)
+    return idp
+}
+
+// provider configuration of the test IdP as "test"
+func (idp *testIdP) provider(linkByEmail bool) FederatedProvider {
+    return FederatedProvider{
+        Name:        "test",
+        ClientId:    testProviderClientId,
+        RedirectURL: "https://authr.example.com/callback",
+        Scopes:      []string{ScopeOpenID, "email"},
+        Issuer:      idp.URL,
+        LinkByEmail: linkByEmail,
+    }
+}
+
+// federate a complete round trip through the IdP, linking to linkUserId unless empty
+func (idp *testIdP) federate(t *testing.T, s *service, linkUserId string) (*FederatedLoginResult, error) {
+    t.Helper()
+    redirect, err := s.BeginFederatedLogin(context.Background(), "test", linkUserId)
+    if err != nil {
+        t.Fatal(err)
+    }
+    u, err := url.Parse(redirect.URL)
+    if err != nil {
+        t.Fatal(err)
+    }
+    idp.nonce = u.Query().Get("nonce")
+    return s.CompleteFederatedLogin(context.Background(), "test", &FederatedCallbackParams{
+        State:        redirect.State,
+        Code:         "code",
+        BrowserState: redirect.State,
+    })
+}
+
+func TestFederatedLoginState(t *testing.T) {
+    tests := []struct {
+        name    string
+        state   func(state string) (string, string)
+        replay  bool
+        wantErr error
+    }{
+        {"matching state", func(s string) (string, string) { return s, s }, false, nil},
+        {"browser state mismatch", func(s string) (string, string) { return s, "other" }, false, ErrCSRF},
+        {"no browser state", func(s string) (string, string) { return s, "" }, false, ErrCSRF},
+        {"no state", func(s string) (string, string) { return "", "" }, false, ErrCSRF},
+        {"unknown state", func(s string) (string, string) { return "forged", "forged" }, false, ErrInvalidRequest},
+        {"replayed state", func(s string) (string, string) { return s, s }, true, ErrInvalidRequest},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            idp := newTestIdP(t)
+            s := newTestService(t, WithFederatedProviders(idp.provider(false)))
+            c := context.Background()
+            redirect, err := s.BeginFederatedLogin(c, "test", "")
+            if err != nil {
+                t.Fatal(err)
+            }
+            u, _ := url.Parse(redirect.URL)
+            idp.nonce = u.Query().Get("nonce")
+
+            state, browser := tt.state(redirect.State)
+            args := &FederatedCallbackParams{State: state, Code: "code", BrowserState: browser}
+            if tt.replay {
+                if _, err = s.CompleteFederatedLogin(c, "test", args); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            if _, err = s.CompleteFederatedLogin(c, "test", args); !errors.Is(err, tt.wantErr) {
+                t.Errorf("CompleteFederatedLogin = %v, want %v", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestFederatedIDToken(t *testing.T) {
+    tests := []struct {
+        name    string
+        claims  jwt.MapClaims
+        other   bool
+        wantErr error
+    }{
+        {"valid", nil, false, nil},
+        {"nonce mismatch", jwt.MapClaims{"nonce": "replayed"}, false, ErrProvider},
+        {"issuer mismatch", jwt.MapClaims{"iss": "https://evil.example.com"}, false, ErrProvider},
+        {"audience mismatch", jwt.MapClaims{"aud": "another-client"}, false, ErrProvider},
+        {"audience list", jwt.MapClaims{"aud": []string{"another-client", testProviderClientId}}, false, nil},
+        {"expired", jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}, false, ErrProvider},
+        {"signed by another key", nil, true, ErrProvider},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            idp := newTestIdP(t)
+            idp.claims = tt.claims
+            if tt.other {
+                idp.signer = testRSAKey(t, 1)
+            }
+            s := newTestService(t, WithFederatedProviders(idp.provider(false)))
+
+            result, err := idp.federate(t, s, "")
+            if !errors.Is(err, tt.wantErr) {
+                t.Fatalf("CompleteFederatedLogin = %v, want %v", err, tt.wantErr)
+            }
+            if err == nil && (!result.Created || result.Identity.Subject != "subject-1") {
+                t.Errorf("result = %+v, want a user provisioned for subject-1", result)
+            }
+        })
+    }
+}
+
+func TestFederatedLinkByEmail(t *testing.T) {
+    tests := []struct {
+        name          string
+        linkByEmail   bool
+        localVerified bool
+        idpVerified   bool
+        wantLinked    bool
+    }{
+        {"both verified", true, true, true, true},
+        {"local unverified", true, false, true, false},
+        {"provider unverified", true, true, false, false},
+        {"link by email off", false, true, true, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            idp := newTestIdP(t)
+            idp.claims = jwt.MapClaims{"email": "ann@example.com", "email_verified": tt.idpVerified}
+            s := newTestService(t, WithFederatedProviders(idp.provider(tt.linkByEmail)))
+            local := newTestUser(t, s, "ann", "secret")
+            if err := s.db.Model(local).Update("email_verified", tt.localVerified).Error; err != nil {
+                t.Fatal(err)
+            }
+
+            result, err := idp.federate(t, s, "")
+            if err != nil {
+                t.Fatal(err)
+            }
+            if linked := result.User.ID == local.ID; linked != tt.wantLinked {
+                t.Errorf("signed in to the local user = %v, want %v", linked, tt.wantLinked)
+            }
+            if result.Created == tt.wantLinked {
+                t.Errorf("Created = %v, want %v", result.Created, !tt.wantLinked)
+            }
+        })
+    }
+}
+
+func TestFederatedLinkConflicts(t *testing.T) {
+    tests := []struct {
+        name    string
+        subject string
+        link    func(owner, other *User) string
+        wantErr error
+    }{
+        {"identity of another user", "subject-1", func(owner, other *User) string { return other.ID }, ErrInvalidRequest},
+        {"second identity of the same provider", "subject-2", func(owner, other *User) string { return owner.ID }, ErrInvalidRequest},
+        {"relink of the own identity", "subject-1", func(owner, other *User) string { return owner.ID }, nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            idp := newTestIdP(t)
+            s := newTestService(t, WithFederatedProviders(idp.provider(false)))
+            owner := newTestUser(t, s, "ann", "secret")
+            other := newTestUser(t, s, "bob", "secret")
+            if _, err := idp.federate(t, s, owner.ID); err != nil {
+                t.Fatal(err)
+            }
+
+            idp.claims = jwt.MapClaims{"sub": tt.subject}
+            result, err := idp.federate(t, s, tt.link(owner, other))
+            if !errors.Is(err, tt.wantErr) {
+                t.Fatalf("CompleteFederatedLogin = %v, want %v", err, tt.wantErr)
+            }
+            if err == nil && (result.User.ID != owner.ID || result.NewIdentity) {
+                t.Errorf("result = %+v, want the existing identity of the owner", result)
+            }
+
+            identities, err := s.ListIdentities(context.Background(), other.ID)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(identities) != 0 {
+                t.Errorf("other user has identities %v", identities)
+            }
+        })
+    }
+}
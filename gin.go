@@ -1,9 +1,11 @@
 package authr
 
 import (
+    "errors"
     "fmt"
     "github.com/dgrijalva/jwt-go"
     "github.com/gin-gonic/gin"
+    "go.opentelemetry.io/otel/trace"
 
     "net/http"
 )
@@ -16,7 +18,25 @@ type GinAdapter interface {
     Refresh(c *gin.Context)
     Whoami(c *gin.Context)
     Sessions(c *gin.Context)
-    TokenAuthMiddleware() gin.HandlerFunc
+    Profile(c *gin.Context)
+    UpdateProfile(c *gin.Context)
+    RequestEmailChange(c *gin.Context)
+    ConfirmEmailChange(c *gin.Context)
+    RevertEmailChange(c *gin.Context)
+    ResetPassword(c *gin.Context)
+    ChangePassword(c *gin.Context)
+    CreateAPIKey(c *gin.Context)
+    ListAPIKeys(c *gin.Context)
+    RevokeAPIKey(c *gin.Context)
+    FederatedRedirect(c *gin.Context)
+    FederatedCallback(c *gin.Context)
+    ListIdentities(c *gin.Context)
+    UnlinkIdentity(c *gin.Context)
+    SAMLMetadata(c *gin.Context)
+    SAMLLogin(c *gin.Context)
+    SAMLACS(c *gin.Context)
+    TokenAuthMiddleware(extractors ...TokenExtractor) gin.HandlerFunc
+    ScopedAuthMiddleware(scopes []string, extractors ...TokenExtractor) gin.HandlerFunc
 }
 
 type ginAdapter struct {
@@ -33,103 +53,148 @@ func (g *ginAdapter) Login(c *gin.Context) {
 
     metadata, _ := g.s.ExtractTokenMetadata(c.Request)
     if metadata != nil {
-        deleteErr := g.s.DeleteTokens(c, metadata)
+        deleteErr := g.s.DeleteTokens(c.Request.Context(), metadata)
         if deleteErr != nil {
-            c.JSON(http.StatusBadRequest, deleteErr.Error())
+            ginProblem(c, deleteErr)
             return
         }
     }
 
     var loginArgs LoginParams
     if err := c.ShouldBindJSON(&loginArgs); err != nil {
-        c.JSON(http.StatusUnprocessableEntity, "Invalid json provided")
+        g.s.Metrics().login(adapterGin, withReason("invalid_request", err))
+        ginProblem(c, invalidf("invalid json provided"))
         return
     }
 
-    user, err := g.s.LoginUser(c, &loginArgs)
+    user, err := g.s.LoginUser(c.Request.Context(), &loginArgs)
     if err != nil {
-        c.JSON(http.StatusUnprocessableEntity, err.Error())
+        g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditLoginFailure, Detail: loginArgs.Username})
+        g.s.Metrics().login(adapterGin, err)
+        g.s.Reporter().Publish(&Event{Type: EventLoginFailure, Request: c.Request, Username: loginArgs.Username, Reason: err.Error()})
+        if errors.Is(err, ErrAccountLocked) {
+            g.s.Reporter().Publish(&Event{Type: EventLockedLogin, Request: c.Request, Username: loginArgs.Username})
+        }
+        ginProblem(c, err)
         return
     }
 
     //compare the user from the request, with the one we defined:
     if user == nil {
-        c.JSON(http.StatusUnauthorized, "Please provide valid login details")
+        ginProblem(c, ErrInvalidCredentials)
         return
     }
-    ts, err := g.s.CreateToken(user)
+    ts, err := g.s.CreateToken(c.Request.Context(), user)
     if err != nil {
-        c.JSON(http.StatusUnprocessableEntity, err.Error())
+        ginProblem(c, err)
         return
     }
-    saveErr := g.s.SaveAuth(c, user.ID, ts)
+    saveErr := g.s.SaveAuth(c.Request.Context(), user.ID, ts)
     if saveErr != nil {
-        c.JSON(http.StatusUnprocessableEntity, saveErr.Error())
+        ginProblem(c, saveErr)
         return
     }
 
-    c.JSON(http.StatusOK, ts)
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditLoginSuccess, ActorId: user.ID, TargetId: user.ID})
+    g.s.Metrics().login(adapterGin, nil)
+    g.s.Reporter().Publish(&Event{Type: EventLoginSuccess, Request: c.Request, UserId: user.ID, Username: user.Username})
+    g.s.Reporter().Publish(&Event{Type: EventTokenGranted, Request: c.Request, UserId: user.ID, Token: ts})
+    body, err := g.s.Cookies().issue(c.Writer, ts)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, body)
 }
 
 func (g *ginAdapter) Register(c *gin.Context) {
 
     metadata, _ := g.s.ExtractTokenMetadata(c.Request)
     if metadata != nil {
-        c.JSON(http.StatusUnauthorized, "unable to register - user is logged in")
+        ginProblem(c, invalidf("unable to register - user is logged in"))
         return
     }
 
     var regArgs RegistrationParams
     if err := c.ShouldBindJSON(&regArgs); err != nil {
-        c.JSON(http.StatusUnprocessableEntity, "Invalid json provided")
+        ginProblem(c, invalidf("invalid json provided"))
         return
     }
 
-    user, err := g.s.RegisterUser(c, &regArgs)
+    user, err := g.s.RegisterUser(c.Request.Context(), &regArgs)
     if err != nil {
-        c.JSON(http.StatusUnprocessableEntity, "error occurred")
+        g.s.Metrics().registration(adapterGin, err)
+        ginProblem(c, err)
         return
     }
 
     if user == nil {
-        c.JSON(http.StatusUnauthorized, "Please provide valid registration details")
+        ginProblem(c, invalidf("registration params are invalid"))
         return
     }
 
-    ts, err := g.s.CreateToken(user)
+    ts, err := g.s.CreateToken(c.Request.Context(), user)
     if err != nil {
-        c.JSON(http.StatusUnprocessableEntity, err.Error())
+        ginProblem(c, err)
         return
     }
-    saveErr := g.s.SaveAuth(c, user.ID, ts)
+    saveErr := g.s.SaveAuth(c.Request.Context(), user.ID, ts)
     if saveErr != nil {
-        c.JSON(http.StatusUnprocessableEntity, saveErr.Error())
+        ginProblem(c, saveErr)
         return
     }
 
-    c.JSON(http.StatusOK, ts)
+    g.s.Metrics().registration(adapterGin, nil)
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditRegister, ActorId: user.ID, TargetId: user.ID})
+    g.s.Reporter().Publish(&Event{Type: EventRegister, Request: c.Request, UserId: user.ID, Username: user.Username})
+    g.s.Reporter().Publish(&Event{Type: EventTokenGranted, Request: c.Request, UserId: user.ID, Token: ts})
+    body, err := g.s.Cookies().issue(c.Writer, ts)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, body)
 }
 
 func (g *ginAdapter) Logout(c *gin.Context) {
     //If metadata is passed and the tokens valid, delete them from the redis store
     metadata, _ := g.s.ExtractTokenMetadata(c.Request)
     if metadata != nil {
-        deleteErr := g.s.DeleteTokens(c, metadata)
+        deleteErr := g.s.DeleteTokens(c.Request.Context(), metadata)
         if deleteErr != nil {
-            c.JSON(http.StatusBadRequest, deleteErr.Error())
+            ginProblem(c, deleteErr)
             return
         }
+        g.s.Metrics().revocation(adapterGin, "logout")
+        g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditLogout, ActorId: actorOf(metadata), TargetId: metadata.UserId})
+        g.s.Reporter().Publish(&Event{Type: EventLogout, Request: c.Request, UserId: metadata.UserId, ActorId: metadata.ActorId})
+        g.s.Reporter().Publish(&Event{Type: EventTokenRevoked, Request: c.Request, UserId: metadata.UserId, Token: &TokenDetails{ID: metadata.UserId, TokenUuid: metadata.TokenUuid}})
     }
+    g.s.Cookies().clear(c.Writer)
     c.JSON(http.StatusOK, "Successfully logged out")
 }
 
 func (g *ginAdapter) Refresh(c *gin.Context) {
-    mapToken := map[string]string{}
-    if err := c.ShouldBindJSON(&mapToken); err != nil {
-        c.JSON(http.StatusUnprocessableEntity, err.Error())
-        return
+    var refreshErr error
+    defer func() { g.s.Metrics().refresh(adapterGin, refreshErr) }()
+
+    //in cookie mode the refresh token comes from its cookie, guarded by the CSRF token
+    refreshToken := g.s.Cookies().refreshToken(c.Request)
+    if refreshToken != "" {
+        if err := g.s.Cookies().checkCSRF(c.Request); err != nil {
+            refreshErr = withReason("csrf", errRefreshFailed)
+            ginProblem(c, err)
+            return
+        }
+    } else {
+        mapToken := map[string]string{}
+        if err := c.ShouldBindJSON(&mapToken); err != nil {
+            refreshErr = withReason("invalid_request", errRefreshFailed)
+            ginProblem(c, invalidf("invalid json provided"))
+            return
+        }
+        refreshToken = mapToken["refresh_token"]
     }
-    refreshToken := mapToken["refresh_token"]
 
     //verify the token
     token, err := jwt.Parse(refreshToken, func(token *jwt.Token) (interface{}, error) {
@@ -140,12 +205,14 @@ func (g *ginAdapter) Refresh(c *gin.Context) {
     })
     //if there is an error, the token must have expired
     if err != nil {
-        c.JSON(http.StatusUnauthorized, "Refresh token expired")
+        refreshErr = withReason("expired", errRefreshFailed)
+        ginProblem(c, tokenErr(err))
         return
     }
     //is token valid?
     if _, ok := token.Claims.(jwt.Claims); !ok && !token.Valid {
-        c.JSON(http.StatusUnauthorized, err)
+        refreshErr = withReason("invalid", errRefreshFailed)
+        ginProblem(c, ErrTokenInvalid)
         return
     }
     //Since token is valid, get the uuid:
@@ -153,43 +220,82 @@ func (g *ginAdapter) Refresh(c *gin.Context) {
     if ok && token.Valid {
         refreshUuid, ok := claims[JwtRefreshUuid].(string) //convert the interface to string
         if !ok {
-            c.JSON(http.StatusUnprocessableEntity, err)
+            refreshErr = withReason("invalid", errRefreshFailed)
+            ginProblem(c, ErrTokenInvalid)
             return
         }
-        userId, roleOk := claims[JwtAccessUuid].(string)
+        //OAuth refresh tokens are redeemed at the token endpoint, which authenticates their client
+        if _, oauth := claims[JwtClientId]; oauth {
+            refreshErr = withReason("invalid", errRefreshFailed)
+            ginProblem(c, ErrTokenInvalid)
+            return
+        }
+        userId, roleOk := claims[JwtUserId].(string)
         if roleOk == false {
-            c.JSON(http.StatusUnprocessableEntity, "unauthorized")
+            refreshErr = withReason("invalid", errRefreshFailed)
+            ginProblem(c, ErrTokenInvalid)
             return
         }
-        //Delete the previous Refresh Token
-        delErr := g.s.DeleteRefresh(c, refreshUuid)
-        if delErr != nil { //if any goes wrong
-            c.JSON(http.StatusUnauthorized, "unauthorized")
+        //A refresh token that is no longer stored was already rotated, treat it as stolen
+        if _, fetchErr := g.s.FetchAuth(c.Request.Context(), refreshUuid); errors.Is(fetchErr, ErrNotFound) {
+            g.s.Reporter().Publish(&Event{Type: EventTokenReuse, Request: c.Request, UserId: userId})
+            _ = g.s.RevokeSessions(c.Request.Context(), userId)
+            g.s.Metrics().revocation(adapterGin, "reuse")
+            refreshErr = withReason("reuse", errRefreshFailed)
+            ginProblem(c, ErrTokenReused)
+            return
+        } else if fetchErr != nil {
+            refreshErr = withReason("error", errRefreshFailed)
+            ginProblem(c, fetchErr)
             return
         }
-
-        user, err := g.s.LoadUser(c, userId)
+        user, err := g.s.LoadUser(c.Request.Context(), userId)
         if err != nil {
-            c.JSON(http.StatusForbidden, err.Error())
+            refreshErr = withReason("unknown_user", errRefreshFailed)
+            ginProblem(c, err)
+            return
+        }
+        if err := statusError(user.Status); err != nil {
+            refreshErr = err
+            ginProblem(c, err)
             return
         }
 
         //Create new pairs of refresh and access tokens
-        ts, createErr := g.s.RefreshToken(user, claims)
+        ts, createErr := g.s.RefreshToken(c.Request.Context(), user, claims)
         if createErr != nil {
-            c.JSON(http.StatusForbidden, createErr.Error())
+            refreshErr = withReason("error", errRefreshFailed)
+            ginProblem(c, createErr)
+            return
+        }
+        //swap the previous refresh token for the new pair in one transaction
+        saveErr := g.s.RotateRefresh(c.Request.Context(), refreshUuid, userId, ts)
+        if errors.Is(saveErr, ErrTokenReused) {
+            g.s.Reporter().Publish(&Event{Type: EventTokenReuse, Request: c.Request, UserId: userId})
+            _ = g.s.RevokeSessions(c.Request.Context(), userId)
+            g.s.Metrics().revocation(adapterGin, "reuse")
+            refreshErr = withReason("reuse", errRefreshFailed)
+            ginProblem(c, ErrTokenReused)
             return
         }
-        //save the token's metadata to redis
-        saveErr := g.s.SaveAuth(c, userId, ts)
         if saveErr != nil {
-            c.JSON(http.StatusForbidden, saveErr.Error())
+            refreshErr = withReason("error", errRefreshFailed)
+            ginProblem(c, saveErr)
             return
         }
 
-        c.JSON(http.StatusCreated, ts)
+        g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditRefresh, ActorId: userId, TargetId: userId})
+        g.s.Reporter().Publish(&Event{Type: EventRefresh, Request: c.Request, UserId: userId})
+        g.s.Reporter().Publish(&Event{Type: EventTokenGranted, Request: c.Request, UserId: userId, Token: ts})
+        body, err := g.s.Cookies().issue(c.Writer, ts)
+        if err != nil {
+            ginProblem(c, err)
+            return
+        }
+        c.JSON(http.StatusCreated, body)
     } else {
-        c.JSON(http.StatusUnauthorized, "refresh expired")
+        refreshErr = withReason("invalid", errRefreshFailed)
+        ginProblem(c, ErrTokenInvalid)
     }
 }
 
@@ -204,13 +310,10 @@ func (g *ginAdapter) Whoami(c *gin.Context) {
         }
 
         c.JSON(http.StatusOK, data)
+        return
     }
 
-    data := gin.H{
-        "code":    http.StatusNotFound,
-        "message": fmt.Sprintf("not logged in"),
-    }
-    c.JSON(http.StatusUnauthorized, data)
+    ginProblem(c, ErrUnauthorized)
 }
 
 func (g *ginAdapter) Sessions(c *gin.Context) {
@@ -224,23 +327,429 @@ func (g *ginAdapter) Sessions(c *gin.Context) {
         }
 
         c.JSON(http.StatusOK, data)
+        return
+    }
+
+    ginProblem(c, ErrUnauthorized)
+}
+
+func (g *ginAdapter) Profile(c *gin.Context) {
+    metadata, err := g.s.Authorize(c.Request)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+
+    profile, err := g.s.GetProfile(c.Request.Context(), metadata.UserId)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+
+    c.JSON(http.StatusOK, profile)
+}
+
+func (g *ginAdapter) UpdateProfile(c *gin.Context) {
+    metadata, err := g.s.Authorize(c.Request)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ginProblem(c, ErrImpersonated)
+        return
+    }
+
+    var profileArgs ProfileParams
+    if err := c.ShouldBindJSON(&profileArgs); err != nil {
+        ginProblem(c, invalidf("invalid json provided"))
+        return
+    }
+
+    profile, err := g.s.UpdateProfile(c.Request.Context(), metadata.UserId, &profileArgs)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+
+    g.s.Reporter().Publish(&Event{Type: EventProfileUpdate, Request: c.Request, UserId: metadata.UserId})
+    c.JSON(http.StatusOK, profile)
+}
+
+func (g *ginAdapter) RequestEmailChange(c *gin.Context) {
+    metadata, err := g.s.Authorize(c.Request)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ginProblem(c, ErrImpersonated)
+        return
+    }
+
+    var changeArgs EmailChangeParams
+    if err := c.ShouldBindJSON(&changeArgs); err != nil {
+        ginProblem(c, invalidf("invalid json provided"))
+        return
+    }
+
+    if err := g.s.RequestEmailChange(c.Request.Context(), metadata.UserId, &changeArgs); err != nil {
+        ginProblem(c, err)
+        return
+    }
+
+    c.JSON(http.StatusAccepted, "Confirmation sent to the new email address")
+}
+
+func (g *ginAdapter) ConfirmEmailChange(c *gin.Context) {
+    if err := g.s.ConfirmEmailChange(c.Request.Context(), c.Query("token")); err != nil {
+        ginProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, "Email address changed")
+}
+
+func (g *ginAdapter) RevertEmailChange(c *gin.Context) {
+    if err := g.s.RevertEmailChange(c.Request.Context(), c.Query("token")); err != nil {
+        ginProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, "Email change reverted")
+}
+
+func (g *ginAdapter) ResetPassword(c *gin.Context) {
+    var resetArgs PasswordResetParams
+    if err := c.ShouldBindJSON(&resetArgs); err != nil {
+        ginProblem(c, invalidf("invalid json provided"))
+        return
+    }
+
+    userId, err := g.s.ResetPassword(c.Request.Context(), &resetArgs)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditPasswordChange, ActorId: userId, TargetId: userId, Detail: "reset token"})
+    g.s.Reporter().Publish(&Event{Type: EventPasswordChange, Request: c.Request, UserId: userId, Reason: "reset token"})
+    c.JSON(http.StatusOK, "Password changed")
+}
+
+func (g *ginAdapter) ChangePassword(c *gin.Context) {
+    metadata, err := g.s.Authorize(c.Request)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ginProblem(c, ErrImpersonated)
+        return
     }
 
-    data := gin.H{
-        "code":    http.StatusNotFound,
-        "message": fmt.Sprintf("not logged in"),
+    var passwordArgs ChangePasswordParams
+    if err := c.ShouldBindJSON(&passwordArgs); err != nil {
+        ginProblem(c, invalidf("invalid json provided"))
+        return
     }
-    c.JSON(http.StatusUnauthorized, data)
+
+    if err := g.s.ChangePassword(c.Request.Context(), metadata.UserId, &passwordArgs); err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditPasswordChange, ActorId: metadata.UserId, TargetId: metadata.UserId})
+    g.s.Reporter().Publish(&Event{Type: EventPasswordChange, Request: c.Request, UserId: metadata.UserId})
+    c.JSON(http.StatusOK, "Password changed")
 }
 
-func (g *ginAdapter) TokenAuthMiddleware() gin.HandlerFunc {
+// CreateAPIKey the key is only shown in this response. Keys can not mint further keys.
+func (g *ginAdapter) CreateAPIKey(c *gin.Context) {
+    metadata, err := g.s.Authorize(c.Request)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ginProblem(c, ErrImpersonated)
+        return
+    }
+    if metadata.KeyId != "" {
+        ginProblem(c, ErrForbidden)
+        return
+    }
+
+    var keyArgs APIKeyParams
+    if err := c.ShouldBindJSON(&keyArgs); err != nil {
+        ginProblem(c, invalidf("invalid json provided"))
+        return
+    }
+
+    key, err := g.s.CreateAPIKey(c.Request.Context(), metadata.UserId, &keyArgs)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditAPIKeyCreate, ActorId: metadata.UserId, TargetId: metadata.UserId, Detail: key.Prefix})
+    c.JSON(http.StatusCreated, key)
+}
+
+func (g *ginAdapter) ListAPIKeys(c *gin.Context) {
+    metadata, err := g.s.Authorize(c.Request)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+
+    keys, err := g.s.ListAPIKeys(c.Request.Context(), metadata.UserId)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, keys)
+}
+
+// RevokeAPIKey the key is selected with the `:id` route parameter or the `id` query parameter
+func (g *ginAdapter) RevokeAPIKey(c *gin.Context) {
+    metadata, err := g.s.Authorize(c.Request)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ginProblem(c, ErrImpersonated)
+        return
+    }
+
+    keyId := c.Param("id")
+    if keyId == "" {
+        keyId = c.Query("id")
+    }
+    if err := g.s.RevokeAPIKey(c.Request.Context(), metadata.UserId, keyId); err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditAPIKeyRevoke, ActorId: metadata.UserId, TargetId: metadata.UserId, Detail: keyId})
+    c.JSON(http.StatusOK, "API key revoked")
+}
+
+// FederatedRedirect send the browser to the identity provider selected with the `:provider` route parameter or the `provider` query parameter.
+// With `link=true` the signed in user links the provider account instead of signing in.
+func (g *ginAdapter) FederatedRedirect(c *gin.Context) {
+    provider := c.Param("provider")
+    if provider == "" {
+        provider = c.Query("provider")
+    }
+    linkUserId := ""
+    if c.Request.URL.Query().Get("link") == "true" {
+        metadata, err := g.s.Authorize(c.Request)
+        if err != nil {
+            ginProblem(c, err)
+            return
+        }
+        if metadata.Impersonated() {
+            ginProblem(c, ErrImpersonated)
+            return
+        }
+        linkUserId = metadata.UserId
+    }
+
+    redirect, err := g.s.BeginFederatedLogin(c.Request.Context(), provider, linkUserId)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.Cookies().setState(c.Writer, federationCookie, redirect.State, int(federatedLoginTTL.Seconds()), http.SameSiteLaxMode)
+    c.Redirect(http.StatusFound, redirect.URL)
+}
+
+// FederatedCallback redirect_uri registered at the provider, signs in like Login or answers the linked identity
+func (g *ginAdapter) FederatedCallback(c *gin.Context) {
+    provider := c.Param("provider")
+    if provider == "" {
+        provider = c.Query("provider")
+    }
+    query := c.Request.URL.Query()
+    args := &FederatedCallbackParams{
+        State:        query.Get("state"),
+        Code:         query.Get("code"),
+        Error:        query.Get("error"),
+        BrowserState: g.s.Cookies().value(c.Request, federationCookie),
+    }
+    g.s.Cookies().setState(c.Writer, federationCookie, "", -1, http.SameSiteLaxMode)
+
+    result, err := g.s.CompleteFederatedLogin(c.Request.Context(), provider, args)
+    g.federatedLogin(c, provider, result, err)
+}
+
+// federatedLogin finish a federated or SAML login like Login, a link request answers the linked identity
+func (g *ginAdapter) federatedLogin(c *gin.Context, provider string, result *FederatedLoginResult, err error) {
+    if err != nil {
+        g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditLoginFailure, Detail: "federated " + provider})
+        g.s.Metrics().login(adapterGin, err)
+        ginProblem(c, err)
+        return
+    }
+    user := result.User
+    if result.NewIdentity {
+        g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditIdentityLink, ActorId: user.ID, TargetId: user.ID, Detail: provider})
+    }
+    if result.Linked {
+        c.JSON(http.StatusOK, result.Identity)
+        return
+    }
+    if result.Created {
+        g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditRegister, ActorId: user.ID, TargetId: user.ID, Detail: "federated " + provider})
+    }
+
+    if metadata, _ := g.s.ExtractTokenMetadata(c.Request); metadata != nil {
+        if err = g.s.DeleteTokens(c.Request.Context(), metadata); err != nil {
+            ginProblem(c, err)
+            return
+        }
+    }
+    ts, err := g.s.CreateToken(c.Request.Context(), user)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    if err = g.s.SaveAuth(c.Request.Context(), user.ID, ts); err != nil {
+        ginProblem(c, err)
+        return
+    }
+
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditLoginSuccess, ActorId: user.ID, TargetId: user.ID, Detail: "federated " + provider})
+    g.s.Metrics().login(adapterGin, nil)
+    g.s.Reporter().Publish(&Event{Type: EventLoginSuccess, Request: c.Request, UserId: user.ID, Username: user.Username})
+    g.s.Reporter().Publish(&Event{Type: EventTokenGranted, Request: c.Request, UserId: user.ID, Token: ts})
+    body, err := g.s.Cookies().issue(c.Writer, ts)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, body)
+}
+
+func (g *ginAdapter) ListIdentities(c *gin.Context) {
+    metadata, err := g.s.Authorize(c.Request)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+
+    identities, err := g.s.ListIdentities(c.Request.Context(), metadata.UserId)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, identities)
+}
+
+// UnlinkIdentity the provider is selected with the `:provider` route parameter or the `provider` query parameter
+func (g *ginAdapter) UnlinkIdentity(c *gin.Context) {
+    metadata, err := g.s.Authorize(c.Request)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ginProblem(c, ErrImpersonated)
+        return
+    }
+
+    provider := c.Param("provider")
+    if provider == "" {
+        provider = c.Query("provider")
+    }
+    if err := g.s.UnlinkIdentity(c.Request.Context(), metadata.UserId, provider); err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditIdentityUnlink, ActorId: metadata.UserId, TargetId: metadata.UserId, Detail: provider})
+    c.JSON(http.StatusOK, "Identity unlinked")
+}
+
+// SAMLMetadata EntityDescriptor to register this service provider at the identity provider
+func (g *ginAdapter) SAMLMetadata(c *gin.Context) {
+    metadata, err := g.s.SAMLMetadata()
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    c.Data(http.StatusOK, "application/samlmetadata+xml", metadata)
+}
+
+// SAMLLogin send the browser to the identity provider with an AuthnRequest
+func (g *ginAdapter) SAMLLogin(c *gin.Context) {
+    redirect, err := g.s.BeginSAMLLogin(c.Request.Context())
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    g.s.Cookies().setState(c.Writer, samlCookie, redirect.State, int(federatedLoginTTL.Seconds()), http.SameSiteNoneMode)
+    if redirect.Form != nil {
+        c.Data(http.StatusOK, "text/html; charset=utf-8", redirect.Form)
+        return
+    }
+    c.Redirect(http.StatusFound, redirect.URL)
+}
+
+// SAMLACS assertion consumer service the identity provider posts the response to, signs in like Login
+func (g *ginAdapter) SAMLACS(c *gin.Context) {
+    args := &SAMLResponseParams{
+        SAMLResponse: c.PostForm("SAMLResponse"),
+        RelayState:   c.PostForm("RelayState"),
+        BrowserState: g.s.Cookies().value(c.Request, samlCookie),
+    }
+    g.s.Cookies().setState(c.Writer, samlCookie, "", -1, http.SameSiteNoneMode)
+
+    result, err := g.s.CompleteSAMLLogin(c.Request.Context(), args)
+    provider := BackendSAML
+    if result != nil {
+        provider = result.Identity.Provider
+    }
+    g.federatedLogin(c, provider, result, err)
+}
+
+// TokenAuthMiddleware first party credentials only, see Authorize. extractors override the token extractor
+// chain of the service for this instance
+func (g *ginAdapter) TokenAuthMiddleware(extractors ...TokenExtractor) gin.HandlerFunc {
+    return g.authMiddleware(g.s.Authorize, extractors)
+}
+
+// ScopedAuthMiddleware also accepts OAuth tokens, service accounts and scoped API keys granted every one of scopes
+func (g *ginAdapter) ScopedAuthMiddleware(scopes []string, extractors ...TokenExtractor) gin.HandlerFunc {
+    return g.authMiddleware(func(r *http.Request) (*AccessDetails, error) {
+        return g.s.AuthorizeScopes(r, scopes...)
+    }, extractors)
+}
+
+func (g *ginAdapter) authMiddleware(authorize func(*http.Request) (*AccessDetails, error), extractors []TokenExtractor) gin.HandlerFunc {
     return func(c *gin.Context) {
-        err := g.s.TokenValid(c.Request)
+        c.Request = withExtractors(c.Request, extractors)
+        ctx, span := g.s.Tracer().Start(c.Request.Context(), "authr.TokenAuthMiddleware", trace.WithAttributes(attrAdapter.String(adapterGin)))
+        //the handler and its store calls nest under the middleware span
+        c.Request = c.Request.WithContext(ctx)
+        metadata, err := authorize(c.Request)
+        g.s.Metrics().validation(adapterGin, err)
         if err != nil {
-            c.JSON(http.StatusUnauthorized, "unauthorized")
-            c.Abort()
+            endSpan(span, err)
+            abortProblem(c, err)
             return
         }
+        span.SetAttributes(attrUserId.String(metadata.UserId))
+        endSpan(span, nil)
         c.Next()
     }
 }
+
+// ginProblem write err as an RFC 7807 application/problem+json response
+func ginProblem(c *gin.Context, err error) {
+    p := *NewProblem(err)
+    p.Instance = c.Request.URL.Path
+    c.Header("Content-Type", ProblemContentType)
+    c.JSON(p.Status, p)
+}
+
+// abortProblem like ginProblem and stop the handler chain
+func abortProblem(c *gin.Context, err error) {
+    ginProblem(c, err)
+    c.Abort()
+}
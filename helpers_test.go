@@ -0,0 +1,169 @@
+package authr
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "github.com/twinj/uuid"
+    "golang.org/x/crypto/bcrypt"
+    "gorm.io/driver/sqlite"
+    "gorm.io/gorm"
+    "gorm.io/gorm/logger"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// newTestService service on a fresh sqlite file, a file rather than memory so concurrent tests really race
+func newTestService(t *testing.T, opts ...Option) *service {
+    t.Helper()
+    dsn := filepath.Join(t.TempDir(), "authr.db") + "?_busy_timeout=5000"
+    db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        if sqlDB, err := db.DB(); err == nil {
+            sqlDB.Close()
+        }
+    })
+
+    as, err := NewAuthService(NewTokenService("access-secret", "refresh-secret"), db, NewAuthReporter(), opts...)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return as.(*service)
+}
+
+// newTestUser an active local user, hashed with the minimum cost to keep the tests fast
+func newTestUser(t *testing.T, s *service, username, password string, roles ...string) *User {
+    t.Helper()
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+    if err != nil {
+        t.Fatal(err)
+    }
+    user := &User{
+        ID:       uuid.NewV4().String(),
+        Username: username,
+        Email:    username + "@example.com",
+        Password: string(hash),
+        Roles:    strings.Join(roles, ","),
+        Status:   StatusActive,
+    }
+    if err = s.db.Create(user).Error; err != nil {
+        t.Fatal(err)
+    }
+    return user
+}
+
+// newTestLogin the stored token pair of a login of user
+func newTestLogin(t *testing.T, s *service, user *User) *TokenDetails {
+    t.Helper()
+    td, err := s.CreateToken(context.Background(), user)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err = s.SaveAuth(context.Background(), user.ID, td); err != nil {
+        t.Fatal(err)
+    }
+    return td
+}
+
+// bearerRequest GET request carrying token in the Authorization header
+func bearerRequest(token string) *http.Request {
+    r := httptest.NewRequest(http.MethodGet, "/", nil)
+    r.Header.Set("Authorization", "Bearer "+token)
+    return r
+}
+
+// testRedirectURI redirect uri of the clients of newTestClient
+const testRedirectURI = "https://client.example.com/callback"
+
+// testVerifier PKCE code verifier of the authorization requests of authorizeCode
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+// newTestClient a public first party client, no secret to hash and no consent prompt in the way
+func newTestClient(t *testing.T, s *service, scopes ...string) *ClientRegistration {
+    t.Helper()
+    reg, err := s.RegisterClient(context.Background(), &ClientParams{
+        Name:         "test client",
+        RedirectURIs: []string{testRedirectURI},
+        Scopes:       scopes,
+        Public:       true,
+        FirstParty:   true,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return reg
+}
+
+// pkceChallenge S256 code challenge of verifier
+func pkceChallenge(verifier string) string {
+    sum := sha256.Sum256([]byte(verifier))
+    return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authorizeCode an authorization code of user for client, bound to testVerifier
+func authorizeCode(t *testing.T, s *service, user *User, client *ClientRegistration, scope string) string {
+    t.Helper()
+    res, err := s.AuthorizeCode(context.Background(), &AccessDetails{UserId: user.ID}, &AuthorizeParams{
+        ResponseType:        "code",
+        ClientId:            client.ClientId,
+        RedirectURI:         testRedirectURI,
+        Scope:               scope,
+        State:               "xyz",
+        CodeChallenge:       pkceChallenge(testVerifier),
+        CodeChallengeMethod: "S256",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    u, err := url.Parse(res.Redirect)
+    if err != nil {
+        t.Fatal(err)
+    }
+    code := u.Query().Get("code")
+    if code == "" {
+        t.Fatalf("authorization failed, redirect %s", res.Redirect)
+    }
+    return code
+}
+
+// codeParams token request redeeming code with testVerifier
+func codeParams(client *ClientRegistration, code string) *TokenParams {
+    return &TokenParams{
+        GrantType:    "authorization_code",
+        Code:         code,
+        RedirectURI:  testRedirectURI,
+        ClientId:     client.ClientId,
+        ClientSecret: client.ClientSecret,
+        CodeVerifier: testVerifier,
+    }
+}
+
+var (
+    testKeysOnce sync.Once
+    testKeys     [2]*rsa.PrivateKey
+)
+
+// testRSAKey one of two RSA keys shared by the tests, generating keys is slow
+func testRSAKey(t *testing.T, i int) *rsa.PrivateKey {
+    t.Helper()
+    testKeysOnce.Do(func() {
+        for k := range testKeys {
+            key, err := rsa.GenerateKey(rand.Reader, 2048)
+            if err != nil {
+                panic(err)
+            }
+            testKeys[k] = key
+        }
+    })
+    return testKeys[i]
+}
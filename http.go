@@ -2,8 +2,10 @@ package authr
 
 import (
     "encoding/json"
+    "errors"
     "fmt"
     "github.com/dgrijalva/jwt-go"
+    "go.opentelemetry.io/otel/trace"
     "net/http"
 )
 
@@ -15,7 +17,25 @@ type HttpAdapter interface {
     Refresh(w http.ResponseWriter, r *http.Request)
     Whoami(w http.ResponseWriter, r *http.Request)
     Sessions(w http.ResponseWriter, r *http.Request)
-    TokenAuthMiddleware(next http.Handler) http.Handler
+    Profile(w http.ResponseWriter, r *http.Request)
+    UpdateProfile(w http.ResponseWriter, r *http.Request)
+    RequestEmailChange(w http.ResponseWriter, r *http.Request)
+    ConfirmEmailChange(w http.ResponseWriter, r *http.Request)
+    RevertEmailChange(w http.ResponseWriter, r *http.Request)
+    ResetPassword(w http.ResponseWriter, r *http.Request)
+    ChangePassword(w http.ResponseWriter, r *http.Request)
+    CreateAPIKey(w http.ResponseWriter, r *http.Request)
+    ListAPIKeys(w http.ResponseWriter, r *http.Request)
+    RevokeAPIKey(w http.ResponseWriter, r *http.Request)
+    FederatedRedirect(w http.ResponseWriter, r *http.Request)
+    FederatedCallback(w http.ResponseWriter, r *http.Request)
+    ListIdentities(w http.ResponseWriter, r *http.Request)
+    UnlinkIdentity(w http.ResponseWriter, r *http.Request)
+    SAMLMetadata(w http.ResponseWriter, r *http.Request)
+    SAMLLogin(w http.ResponseWriter, r *http.Request)
+    SAMLACS(w http.ResponseWriter, r *http.Request)
+    TokenAuthMiddleware(next http.Handler, extractors ...TokenExtractor) http.Handler
+    ScopedAuthMiddleware(next http.Handler, scopes []string, extractors ...TokenExtractor) http.Handler
 }
 
 func NewHttpAdapter(s AuthService) HttpAdapter {
@@ -27,14 +47,35 @@ type httpAdapter struct {
     s AuthService
 }
 
-func (g *httpAdapter) TokenAuthMiddleware(next http.Handler) http.Handler {
+// TokenAuthMiddleware first party credentials only, see Authorize. extractors override the token extractor
+// chain of the service for this instance
+func (g *httpAdapter) TokenAuthMiddleware(next http.Handler, extractors ...TokenExtractor) http.Handler {
+    return g.authMiddleware(next, g.s.Authorize, extractors)
+}
+
+// ScopedAuthMiddleware also accepts OAuth tokens, service accounts and scoped API keys granted every one of scopes
+func (g *httpAdapter) ScopedAuthMiddleware(next http.Handler, scopes []string, extractors ...TokenExtractor) http.Handler {
+    return g.authMiddleware(next, func(r *http.Request) (*AccessDetails, error) {
+        return g.s.AuthorizeScopes(r, scopes...)
+    }, extractors)
+}
+
+func (g *httpAdapter) authMiddleware(next http.Handler, authorize func(*http.Request) (*AccessDetails, error), extractors []TokenExtractor) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        r = withExtractors(r, extractors)
 
-        err := g.s.TokenValid(r)
+        ctx, span := g.s.Tracer().Start(r.Context(), "authr.TokenAuthMiddleware", trace.WithAttributes(attrAdapter.String(adapterHttp)))
+        //the handler and its store calls nest under the middleware span
+        r = r.WithContext(ctx)
+        metadata, err := authorize(r)
+        g.s.Metrics().validation(adapterHttp, err)
         if err != nil {
-            JSON(w, http.StatusUnauthorized, "unauthorized")
+            endSpan(span, err)
+            ProblemJSON(w, r, err)
             return
         }
+        span.SetAttributes(attrUserId.String(metadata.UserId))
+        endSpan(span, nil)
 
         next.ServeHTTP(w, r)
     })
@@ -46,79 +87,105 @@ func (g *httpAdapter) Login(w http.ResponseWriter, r *http.Request) {
     if metadata != nil {
         deleteErr := g.s.DeleteTokens(r.Context(), metadata)
         if deleteErr != nil {
-            JSON(w, http.StatusBadRequest, deleteErr.Error())
+            ProblemJSON(w, r, deleteErr)
             return
         }
     }
 
     var loginArgs LoginParams
     if err := ShouldBindJSON(r, &loginArgs); err != nil {
-        JSON(w, http.StatusUnprocessableEntity, "Invalid json provided")
+        g.s.Metrics().login(adapterHttp, withReason("invalid_request", err))
+        ProblemJSON(w, r, invalidf("invalid json provided"))
         return
     }
 
     user, err := g.s.LoginUser(r.Context(), &loginArgs)
     if err != nil {
-        JSON(w, http.StatusUnprocessableEntity, err.Error())
+        g.s.RecordAudit(r, &AuditEvent{Type: AuditLoginFailure, Detail: loginArgs.Username})
+        g.s.Metrics().login(adapterHttp, err)
+        g.s.Reporter().Publish(&Event{Type: EventLoginFailure, Request: r, Username: loginArgs.Username, Reason: err.Error()})
+        if errors.Is(err, ErrAccountLocked) {
+            g.s.Reporter().Publish(&Event{Type: EventLockedLogin, Request: r, Username: loginArgs.Username})
+        }
+        ProblemJSON(w, r, err)
         return
     }
 
     //compare the user from the request, with the one we defined:
     if user == nil {
-        JSON(w, http.StatusUnauthorized, "Please provide valid login details")
+        ProblemJSON(w, r, ErrInvalidCredentials)
         return
     }
-    ts, err := g.s.CreateToken(user)
+    ts, err := g.s.CreateToken(r.Context(), user)
     if err != nil {
-        JSON(w, http.StatusUnprocessableEntity, err.Error())
+        ProblemJSON(w, r, err)
         return
     }
     saveErr := g.s.SaveAuth(r.Context(), user.ID, ts)
     if saveErr != nil {
-        JSON(w, http.StatusUnprocessableEntity, saveErr.Error())
+        ProblemJSON(w, r, saveErr)
         return
     }
 
-    JSON(w, http.StatusOK, ts)
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditLoginSuccess, ActorId: user.ID, TargetId: user.ID})
+    g.s.Metrics().login(adapterHttp, nil)
+    g.s.Reporter().Publish(&Event{Type: EventLoginSuccess, Request: r, UserId: user.ID, Username: user.Username})
+    g.s.Reporter().Publish(&Event{Type: EventTokenGranted, Request: r, UserId: user.ID, Token: ts})
+    body, err := g.s.Cookies().issue(w, ts)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    JSON(w, http.StatusOK, body)
 }
 
 func (g *httpAdapter) Register(w http.ResponseWriter, r *http.Request) {
 
     metadata, _ := g.s.ExtractTokenMetadata(r)
     if metadata != nil {
-        JSON(w, http.StatusUnauthorized, "unable to register - user is logged in")
+        ProblemJSON(w, r, invalidf("unable to register - user is logged in"))
         return
     }
 
     var regArgs RegistrationParams
     if err := ShouldBindJSON(r, &regArgs); err != nil {
-        JSON(w, http.StatusUnprocessableEntity, "Invalid json provided")
+        ProblemJSON(w, r, invalidf("invalid json provided"))
         return
     }
 
     user, err := g.s.RegisterUser(r.Context(), &regArgs)
     if err != nil {
-        JSON(w, http.StatusUnprocessableEntity, "error occurred")
+        g.s.Metrics().registration(adapterHttp, err)
+        ProblemJSON(w, r, err)
         return
     }
 
     if user == nil {
-        JSON(w, http.StatusUnauthorized, "Please provide valid registration details")
+        ProblemJSON(w, r, invalidf("registration params are invalid"))
         return
     }
 
-    ts, err := g.s.CreateToken(user)
+    ts, err := g.s.CreateToken(r.Context(), user)
     if err != nil {
-        JSON(w, http.StatusUnprocessableEntity, err.Error())
+        ProblemJSON(w, r, err)
         return
     }
     saveErr := g.s.SaveAuth(r.Context(), user.ID, ts)
     if saveErr != nil {
-        JSON(w, http.StatusUnprocessableEntity, saveErr.Error())
+        ProblemJSON(w, r, saveErr)
         return
     }
 
-    JSON(w, http.StatusOK, ts)
+    g.s.Metrics().registration(adapterHttp, nil)
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditRegister, ActorId: user.ID, TargetId: user.ID})
+    g.s.Reporter().Publish(&Event{Type: EventRegister, Request: r, UserId: user.ID, Username: user.Username})
+    g.s.Reporter().Publish(&Event{Type: EventTokenGranted, Request: r, UserId: user.ID, Token: ts})
+    body, err := g.s.Cookies().issue(w, ts)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    JSON(w, http.StatusOK, body)
 }
 
 func (g *httpAdapter) Logout(w http.ResponseWriter, r *http.Request) {
@@ -127,20 +194,39 @@ func (g *httpAdapter) Logout(w http.ResponseWriter, r *http.Request) {
     if metadata != nil {
         deleteErr := g.s.DeleteTokens(r.Context(), metadata)
         if deleteErr != nil {
-            JSON(w, http.StatusBadRequest, deleteErr.Error())
+            ProblemJSON(w, r, deleteErr)
             return
         }
+        g.s.Metrics().revocation(adapterHttp, "logout")
+        g.s.RecordAudit(r, &AuditEvent{Type: AuditLogout, ActorId: actorOf(metadata), TargetId: metadata.UserId})
+        g.s.Reporter().Publish(&Event{Type: EventLogout, Request: r, UserId: metadata.UserId, ActorId: metadata.ActorId})
+        g.s.Reporter().Publish(&Event{Type: EventTokenRevoked, Request: r, UserId: metadata.UserId, Token: &TokenDetails{ID: metadata.UserId, TokenUuid: metadata.TokenUuid}})
     }
+    g.s.Cookies().clear(w)
     JSON(w, http.StatusOK, "Successfully logged out")
 }
 
 func (g *httpAdapter) Refresh(w http.ResponseWriter, r *http.Request) {
-    mapToken := map[string]string{}
-    if err := ShouldBindJSON(r, &mapToken); err != nil {
-        JSON(w, http.StatusUnprocessableEntity, err.Error())
-        return
+    var refreshErr error
+    defer func() { g.s.Metrics().refresh(adapterHttp, refreshErr) }()
+
+    //in cookie mode the refresh token comes from its cookie, guarded by the CSRF token
+    refreshToken := g.s.Cookies().refreshToken(r)
+    if refreshToken != "" {
+        if err := g.s.Cookies().checkCSRF(r); err != nil {
+            refreshErr = withReason("csrf", errRefreshFailed)
+            ProblemJSON(w, r, err)
+            return
+        }
+    } else {
+        mapToken := map[string]string{}
+        if err := ShouldBindJSON(r, &mapToken); err != nil {
+            refreshErr = withReason("invalid_request", errRefreshFailed)
+            ProblemJSON(w, r, invalidf("invalid json provided"))
+            return
+        }
+        refreshToken = mapToken["refresh_token"]
     }
-    refreshToken := mapToken["refresh_token"]
 
     //verify the token
     token, err := jwt.Parse(refreshToken, func(token *jwt.Token) (interface{}, error) {
@@ -151,12 +237,14 @@ func (g *httpAdapter) Refresh(w http.ResponseWriter, r *http.Request) {
     })
     //if there is an error, the token must have expired
     if err != nil {
-        JSON(w, http.StatusUnauthorized, "Refresh token expired")
+        refreshErr = withReason("expired", errRefreshFailed)
+        ProblemJSON(w, r, tokenErr(err))
         return
     }
     //is token valid?
     if _, ok := token.Claims.(jwt.Claims); !ok && !token.Valid {
-        JSON(w, http.StatusUnauthorized, err)
+        refreshErr = withReason("invalid", errRefreshFailed)
+        ProblemJSON(w, r, ErrTokenInvalid)
         return
     }
     //Since token is valid, get the uuid:
@@ -164,43 +252,82 @@ func (g *httpAdapter) Refresh(w http.ResponseWriter, r *http.Request) {
     if ok && token.Valid {
         refreshUuid, ok := claims[JwtRefreshUuid].(string) //convert the interface to string
         if !ok {
-            JSON(w, http.StatusUnprocessableEntity, err)
+            refreshErr = withReason("invalid", errRefreshFailed)
+            ProblemJSON(w, r, ErrTokenInvalid)
             return
         }
-        userId, roleOk := claims[JwtAccessUuid].(string)
+        //OAuth refresh tokens are redeemed at the token endpoint, which authenticates their client
+        if _, oauth := claims[JwtClientId]; oauth {
+            refreshErr = withReason("invalid", errRefreshFailed)
+            ProblemJSON(w, r, ErrTokenInvalid)
+            return
+        }
+        userId, roleOk := claims[JwtUserId].(string)
         if roleOk == false {
-            JSON(w, http.StatusUnprocessableEntity, "unauthorized")
+            refreshErr = withReason("invalid", errRefreshFailed)
+            ProblemJSON(w, r, ErrTokenInvalid)
             return
         }
-        //Delete the previous Refresh Token
-        delErr := g.s.DeleteRefresh(r.Context(), refreshUuid)
-        if delErr != nil { //if any goes wrong
-            JSON(w, http.StatusUnauthorized, "unauthorized")
+        //A refresh token that is no longer stored was already rotated, treat it as stolen
+        if _, fetchErr := g.s.FetchAuth(r.Context(), refreshUuid); errors.Is(fetchErr, ErrNotFound) {
+            g.s.Reporter().Publish(&Event{Type: EventTokenReuse, Request: r, UserId: userId})
+            _ = g.s.RevokeSessions(r.Context(), userId)
+            g.s.Metrics().revocation(adapterHttp, "reuse")
+            refreshErr = withReason("reuse", errRefreshFailed)
+            ProblemJSON(w, r, ErrTokenReused)
+            return
+        } else if fetchErr != nil {
+            refreshErr = withReason("error", errRefreshFailed)
+            ProblemJSON(w, r, fetchErr)
             return
         }
-
         user, err := g.s.LoadUser(r.Context(), userId)
         if err != nil {
-            JSON(w, http.StatusForbidden, err.Error())
+            refreshErr = withReason("unknown_user", errRefreshFailed)
+            ProblemJSON(w, r, err)
+            return
+        }
+        if err := statusError(user.Status); err != nil {
+            refreshErr = err
+            ProblemJSON(w, r, err)
             return
         }
 
         //Create new pairs of refresh and access tokens
-        ts, createErr := g.s.RefreshToken(user, claims)
+        ts, createErr := g.s.RefreshToken(r.Context(), user, claims)
         if createErr != nil {
-            JSON(w, http.StatusForbidden, createErr.Error())
+            refreshErr = withReason("error", errRefreshFailed)
+            ProblemJSON(w, r, createErr)
+            return
+        }
+        //swap the previous refresh token for the new pair in one transaction
+        saveErr := g.s.RotateRefresh(r.Context(), refreshUuid, userId, ts)
+        if errors.Is(saveErr, ErrTokenReused) {
+            g.s.Reporter().Publish(&Event{Type: EventTokenReuse, Request: r, UserId: userId})
+            _ = g.s.RevokeSessions(r.Context(), userId)
+            g.s.Metrics().revocation(adapterHttp, "reuse")
+            refreshErr = withReason("reuse", errRefreshFailed)
+            ProblemJSON(w, r, ErrTokenReused)
             return
         }
-        //save the token's metadata to redis
-        saveErr := g.s.SaveAuth(r.Context(), userId, ts)
         if saveErr != nil {
-            JSON(w, http.StatusForbidden, saveErr.Error())
+            refreshErr = withReason("error", errRefreshFailed)
+            ProblemJSON(w, r, saveErr)
             return
         }
 
-        JSON(w, http.StatusCreated, ts)
+        g.s.RecordAudit(r, &AuditEvent{Type: AuditRefresh, ActorId: userId, TargetId: userId})
+        g.s.Reporter().Publish(&Event{Type: EventRefresh, Request: r, UserId: userId})
+        g.s.Reporter().Publish(&Event{Type: EventTokenGranted, Request: r, UserId: userId, Token: ts})
+        body, err := g.s.Cookies().issue(w, ts)
+        if err != nil {
+            ProblemJSON(w, r, err)
+            return
+        }
+        JSON(w, http.StatusCreated, body)
     } else {
-        JSON(w, http.StatusUnauthorized, "refresh expired")
+        refreshErr = withReason("invalid", errRefreshFailed)
+        ProblemJSON(w, r, ErrTokenInvalid)
     }
 }
 
@@ -215,13 +342,10 @@ func (g *httpAdapter) Whoami(w http.ResponseWriter, r *http.Request) {
         }
 
         JSON(w, http.StatusOK, data)
+        return
     }
 
-    data := map[string]interface{}{
-        "code":    http.StatusNotFound,
-        "message": fmt.Sprintf("not logged in"),
-    }
-    JSON(w, http.StatusUnauthorized, data)
+    ProblemJSON(w, r, ErrUnauthorized)
 }
 
 func (g *httpAdapter) Sessions(w http.ResponseWriter, r *http.Request) {
@@ -235,13 +359,381 @@ func (g *httpAdapter) Sessions(w http.ResponseWriter, r *http.Request) {
         }
 
         JSON(w, http.StatusOK, data)
+        return
+    }
+
+    ProblemJSON(w, r, ErrUnauthorized)
+}
+
+func (g *httpAdapter) Profile(w http.ResponseWriter, r *http.Request) {
+    metadata, err := g.s.Authorize(r)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+
+    profile, err := g.s.GetProfile(r.Context(), metadata.UserId)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+
+    JSON(w, http.StatusOK, profile)
+}
+
+func (g *httpAdapter) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+    metadata, err := g.s.Authorize(r)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ProblemJSON(w, r, ErrImpersonated)
+        return
+    }
+
+    var profileArgs ProfileParams
+    if err := ShouldBindJSON(r, &profileArgs); err != nil {
+        ProblemJSON(w, r, invalidf("invalid json provided"))
+        return
+    }
+
+    profile, err := g.s.UpdateProfile(r.Context(), metadata.UserId, &profileArgs)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+
+    g.s.Reporter().Publish(&Event{Type: EventProfileUpdate, Request: r, UserId: metadata.UserId})
+    JSON(w, http.StatusOK, profile)
+}
+
+func (g *httpAdapter) RequestEmailChange(w http.ResponseWriter, r *http.Request) {
+    metadata, err := g.s.Authorize(r)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ProblemJSON(w, r, ErrImpersonated)
+        return
+    }
+
+    var changeArgs EmailChangeParams
+    if err := ShouldBindJSON(r, &changeArgs); err != nil {
+        ProblemJSON(w, r, invalidf("invalid json provided"))
+        return
+    }
+
+    if err := g.s.RequestEmailChange(r.Context(), metadata.UserId, &changeArgs); err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+
+    JSON(w, http.StatusAccepted, "Confirmation sent to the new email address")
+}
+
+func (g *httpAdapter) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+    if err := g.s.ConfirmEmailChange(r.Context(), r.URL.Query().Get("token")); err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    JSON(w, http.StatusOK, "Email address changed")
+}
+
+func (g *httpAdapter) RevertEmailChange(w http.ResponseWriter, r *http.Request) {
+    if err := g.s.RevertEmailChange(r.Context(), r.URL.Query().Get("token")); err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    JSON(w, http.StatusOK, "Email change reverted")
+}
+
+func (g *httpAdapter) ResetPassword(w http.ResponseWriter, r *http.Request) {
+    var resetArgs PasswordResetParams
+    if err := ShouldBindJSON(r, &resetArgs); err != nil {
+        ProblemJSON(w, r, invalidf("invalid json provided"))
+        return
+    }
+
+    userId, err := g.s.ResetPassword(r.Context(), &resetArgs)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditPasswordChange, ActorId: userId, TargetId: userId, Detail: "reset token"})
+    g.s.Reporter().Publish(&Event{Type: EventPasswordChange, Request: r, UserId: userId, Reason: "reset token"})
+    JSON(w, http.StatusOK, "Password changed")
+}
+
+func (g *httpAdapter) ChangePassword(w http.ResponseWriter, r *http.Request) {
+    metadata, err := g.s.Authorize(r)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ProblemJSON(w, r, ErrImpersonated)
+        return
+    }
+
+    var passwordArgs ChangePasswordParams
+    if err := ShouldBindJSON(r, &passwordArgs); err != nil {
+        ProblemJSON(w, r, invalidf("invalid json provided"))
+        return
+    }
+
+    if err := g.s.ChangePassword(r.Context(), metadata.UserId, &passwordArgs); err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditPasswordChange, ActorId: metadata.UserId, TargetId: metadata.UserId})
+    g.s.Reporter().Publish(&Event{Type: EventPasswordChange, Request: r, UserId: metadata.UserId})
+    JSON(w, http.StatusOK, "Password changed")
+}
+
+// CreateAPIKey the key is only shown in this response. Keys can not mint further keys.
+func (g *httpAdapter) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+    metadata, err := g.s.Authorize(r)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ProblemJSON(w, r, ErrImpersonated)
+        return
+    }
+    if metadata.KeyId != "" {
+        ProblemJSON(w, r, ErrForbidden)
+        return
     }
 
-    data := map[string]interface{}{
-        "code":    http.StatusNotFound,
-        "message": fmt.Sprintf("not logged in"),
+    var keyArgs APIKeyParams
+    if err := ShouldBindJSON(r, &keyArgs); err != nil {
+        ProblemJSON(w, r, invalidf("invalid json provided"))
+        return
+    }
+
+    key, err := g.s.CreateAPIKey(r.Context(), metadata.UserId, &keyArgs)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditAPIKeyCreate, ActorId: metadata.UserId, TargetId: metadata.UserId, Detail: key.Prefix})
+    JSON(w, http.StatusCreated, key)
+}
+
+func (g *httpAdapter) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+    metadata, err := g.s.Authorize(r)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+
+    keys, err := g.s.ListAPIKeys(r.Context(), metadata.UserId)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
     }
-    JSON(w, http.StatusUnauthorized, data)
+    JSON(w, http.StatusOK, keys)
+}
+
+// RevokeAPIKey the key is selected with the `id` query parameter
+func (g *httpAdapter) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+    metadata, err := g.s.Authorize(r)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ProblemJSON(w, r, ErrImpersonated)
+        return
+    }
+
+    keyId := r.URL.Query().Get("id")
+    if err := g.s.RevokeAPIKey(r.Context(), metadata.UserId, keyId); err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditAPIKeyRevoke, ActorId: metadata.UserId, TargetId: metadata.UserId, Detail: keyId})
+    JSON(w, http.StatusOK, "API key revoked")
+}
+
+// FederatedRedirect send the browser to the identity provider selected with the `provider` query parameter.
+// With `link=true` the signed in user links the provider account instead of signing in.
+func (g *httpAdapter) FederatedRedirect(w http.ResponseWriter, r *http.Request) {
+    provider := r.URL.Query().Get("provider")
+    linkUserId := ""
+    if r.URL.Query().Get("link") == "true" {
+        metadata, err := g.s.Authorize(r)
+        if err != nil {
+            ProblemJSON(w, r, err)
+            return
+        }
+        if metadata.Impersonated() {
+            ProblemJSON(w, r, ErrImpersonated)
+            return
+        }
+        linkUserId = metadata.UserId
+    }
+
+    redirect, err := g.s.BeginFederatedLogin(r.Context(), provider, linkUserId)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.Cookies().setState(w, federationCookie, redirect.State, int(federatedLoginTTL.Seconds()), http.SameSiteLaxMode)
+    http.Redirect(w, r, redirect.URL, http.StatusFound)
+}
+
+// FederatedCallback redirect_uri registered at the provider, signs in like Login or answers the linked identity
+func (g *httpAdapter) FederatedCallback(w http.ResponseWriter, r *http.Request) {
+    provider := r.URL.Query().Get("provider")
+    query := r.URL.Query()
+    args := &FederatedCallbackParams{
+        State:        query.Get("state"),
+        Code:         query.Get("code"),
+        Error:        query.Get("error"),
+        BrowserState: g.s.Cookies().value(r, federationCookie),
+    }
+    g.s.Cookies().setState(w, federationCookie, "", -1, http.SameSiteLaxMode)
+
+    result, err := g.s.CompleteFederatedLogin(r.Context(), provider, args)
+    g.federatedLogin(w, r, provider, result, err)
+}
+
+// federatedLogin finish a federated or SAML login like Login, a link request answers the linked identity
+func (g *httpAdapter) federatedLogin(w http.ResponseWriter, r *http.Request, provider string, result *FederatedLoginResult, err error) {
+    if err != nil {
+        g.s.RecordAudit(r, &AuditEvent{Type: AuditLoginFailure, Detail: "federated " + provider})
+        g.s.Metrics().login(adapterHttp, err)
+        ProblemJSON(w, r, err)
+        return
+    }
+    user := result.User
+    if result.NewIdentity {
+        g.s.RecordAudit(r, &AuditEvent{Type: AuditIdentityLink, ActorId: user.ID, TargetId: user.ID, Detail: provider})
+    }
+    if result.Linked {
+        JSON(w, http.StatusOK, result.Identity)
+        return
+    }
+    if result.Created {
+        g.s.RecordAudit(r, &AuditEvent{Type: AuditRegister, ActorId: user.ID, TargetId: user.ID, Detail: "federated " + provider})
+    }
+
+    if metadata, _ := g.s.ExtractTokenMetadata(r); metadata != nil {
+        if err = g.s.DeleteTokens(r.Context(), metadata); err != nil {
+            ProblemJSON(w, r, err)
+            return
+        }
+    }
+    ts, err := g.s.CreateToken(r.Context(), user)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    if err = g.s.SaveAuth(r.Context(), user.ID, ts); err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditLoginSuccess, ActorId: user.ID, TargetId: user.ID, Detail: "federated " + provider})
+    g.s.Metrics().login(adapterHttp, nil)
+    g.s.Reporter().Publish(&Event{Type: EventLoginSuccess, Request: r, UserId: user.ID, Username: user.Username})
+    g.s.Reporter().Publish(&Event{Type: EventTokenGranted, Request: r, UserId: user.ID, Token: ts})
+    body, err := g.s.Cookies().issue(w, ts)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    JSON(w, http.StatusOK, body)
+}
+
+func (g *httpAdapter) ListIdentities(w http.ResponseWriter, r *http.Request) {
+    metadata, err := g.s.Authorize(r)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+
+    identities, err := g.s.ListIdentities(r.Context(), metadata.UserId)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    JSON(w, http.StatusOK, identities)
+}
+
+// UnlinkIdentity the provider is selected with the `provider` query parameter
+func (g *httpAdapter) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+    metadata, err := g.s.Authorize(r)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ProblemJSON(w, r, ErrImpersonated)
+        return
+    }
+
+    provider := r.URL.Query().Get("provider")
+    if err := g.s.UnlinkIdentity(r.Context(), metadata.UserId, provider); err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditIdentityUnlink, ActorId: metadata.UserId, TargetId: metadata.UserId, Detail: provider})
+    JSON(w, http.StatusOK, "Identity unlinked")
+}
+
+// SAMLMetadata EntityDescriptor to register this service provider at the identity provider
+func (g *httpAdapter) SAMLMetadata(w http.ResponseWriter, r *http.Request) {
+    metadata, err := g.s.SAMLMetadata()
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    w.Header().Set("Content-Type", "application/samlmetadata+xml")
+    w.WriteHeader(http.StatusOK)
+    w.Write(metadata)
+}
+
+// SAMLLogin send the browser to the identity provider with an AuthnRequest
+func (g *httpAdapter) SAMLLogin(w http.ResponseWriter, r *http.Request) {
+    redirect, err := g.s.BeginSAMLLogin(r.Context())
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    g.s.Cookies().setState(w, samlCookie, redirect.State, int(federatedLoginTTL.Seconds()), http.SameSiteNoneMode)
+    if redirect.Form != nil {
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        w.WriteHeader(http.StatusOK)
+        w.Write(redirect.Form)
+        return
+    }
+    http.Redirect(w, r, redirect.URL, http.StatusFound)
+}
+
+// SAMLACS assertion consumer service the identity provider posts the response to, signs in like Login
+func (g *httpAdapter) SAMLACS(w http.ResponseWriter, r *http.Request) {
+    if err := r.ParseForm(); err != nil {
+        ProblemJSON(w, r, invalidf("invalid form provided"))
+        return
+    }
+    args := &SAMLResponseParams{
+        SAMLResponse: r.PostForm.Get("SAMLResponse"),
+        RelayState:   r.PostForm.Get("RelayState"),
+        BrowserState: g.s.Cookies().value(r, samlCookie),
+    }
+    g.s.Cookies().setState(w, samlCookie, "", -1, http.SameSiteNoneMode)
+
+    result, err := g.s.CompleteSAMLLogin(r.Context(), args)
+    provider := BackendSAML
+    if result != nil {
+        provider = result.Identity.Provider
+    }
+    g.federatedLogin(w, r, provider, result, err)
 }
 
 func JSON(w http.ResponseWriter, code int, val interface{}) error {
@@ -258,6 +750,22 @@ func JSON(w http.ResponseWriter, code int, val interface{}) error {
     return err
 }
 
+// ProblemJSON write err as an RFC 7807 application/problem+json response
+func ProblemJSON(w http.ResponseWriter, r *http.Request, err error) error {
+    p := *NewProblem(err)
+    p.Instance = r.URL.Path
+
+    b, err := json.Marshal(p)
+    if err != nil {
+        return err
+    }
+
+    w.Header().Set("Content-Type", ProblemContentType)
+    w.WriteHeader(p.Status)
+    _, err = w.Write(b)
+    return err
+}
+
 func ShouldBindJSON(r *http.Request, val any) error {
     err := json.NewDecoder(r.Body).Decode(val)
     if err != nil {
@@ -0,0 +1,54 @@
+package authr
+
+import (
+    "context"
+)
+
+// Impersonate issue a token for the target user carrying an act claim with the admin's ID. There is no
+// refresh token, the impersonation ends when the access token expires.
+func (s *service) Impersonate(c context.Context, actor *AccessDetails, targetId string) (*TokenDetails, error) {
+    if actor == nil || !actor.HasRole(RoleAdmin) {
+        return nil, ErrForbidden
+    }
+    if actor.Impersonated() {
+        return nil, ErrImpersonated
+    }
+    if actor.UserId == targetId {
+        return nil, invalidf("can not impersonate yourself")
+    }
+
+    user, err := s.LoadUser(c, targetId)
+    if err != nil {
+        return nil, err
+    }
+    if err = statusError(user.Status); err != nil {
+        return nil, err
+    }
+
+    user.details = s.projectAttributes(user)
+    if user.details == nil {
+        user.details = map[string]interface{}{}
+    }
+    user.details[JwtActor] = map[string]interface{}{"sub": actor.UserId}
+
+    td, err := s.createToken(user)
+    if err != nil {
+        return nil, err
+    }
+    td.actorId = actor.UserId
+    if td.RefreshToken != "" {
+        td.RefreshToken, td.RefreshUuid, td.RtExpires = "", "", td.AtExpires
+    }
+    if err = s.SaveAuth(c, user.ID, td); err != nil {
+        return nil, err
+    }
+    return td, nil
+}
+
+// StopImpersonation revoke the impersonated session
+func (s *service) StopImpersonation(c context.Context, session *AccessDetails) error {
+    if session == nil || !session.Impersonated() {
+        return invalidf("session is not impersonated")
+    }
+    return s.DeleteTokens(c, session)
+}
@@ -0,0 +1,156 @@
+package authr
+
+import (
+    "context"
+    "errors"
+    "github.com/dgrijalva/jwt-go"
+    "net/http"
+    "strings"
+)
+
+// IntrospectToken RFC 7662, callers authenticate as a confidential client or a service account.
+// Unknown, expired and revoked tokens are reported as inactive, not as an error.
+func (s *service) IntrospectToken(c context.Context, args *TokenLookupParams) (*TokenIntrospection, error) {
+    if err := s.authenticateCaller(c, args.ClientId, args.ClientSecret); err != nil {
+        return nil, err
+    }
+    if args.Token == "" {
+        return nil, oauthErr(OAuthInvalidRequest, "token is required")
+    }
+
+    metadata, claims := s.lookupToken(c, args.Token, args.TokenTypeHint)
+    switch {
+    case metadata != nil:
+        res := &TokenIntrospection{
+            Active:    true,
+            TokenType: "Bearer",
+            Sub:       metadata.UserId,
+            Exp:       claimInt(metadata.Claims, JwtExpires),
+            Principal: metadata.Principal,
+        }
+        res.Scope, _ = metadata.Claims[JwtScope].(string)
+        res.ClientId, _ = metadata.Claims[JwtClientId].(string)
+        if metadata.Impersonated() {
+            res.Act = map[string]interface{}{"sub": metadata.ActorId}
+        }
+        return res, nil
+    case claims != nil:
+        res := &TokenIntrospection{
+            Active:    true,
+            TokenType: "refresh_token",
+            Exp:       claimInt(claims, JwtExpires),
+            Principal: PrincipalUser,
+        }
+        res.Sub, _ = claims[JwtUserId].(string)
+        res.Scope, _ = claims[JwtScope].(string)
+        res.ClientId, _ = claims[JwtClientId].(string)
+        return res, nil
+    default:
+        return &TokenIntrospection{}, nil
+    }
+}
+
+// RevokeToken RFC 7009, revoking either half of a token pair revokes both. Tokens issued to another
+// OAuth client are refused, tokens that are already invalid are not an error.
+func (s *service) RevokeToken(c context.Context, args *TokenLookupParams) error {
+    if err := s.authenticateCaller(c, args.ClientId, args.ClientSecret); err != nil {
+        return err
+    }
+    if args.Token == "" {
+        return oauthErr(OAuthInvalidRequest, "token is required")
+    }
+
+    metadata, claims := s.lookupToken(c, args.Token, args.TokenTypeHint)
+    if metadata == nil && claims == nil {
+        return nil
+    }
+    if metadata == nil {
+        userId, _ := claims[JwtUserId].(string)
+        refreshUuid, _ := claims[JwtRefreshUuid].(string)
+        metadata = &AccessDetails{
+            TokenUuid: strings.TrimSuffix(refreshUuid, "++"+userId),
+            UserId:    userId,
+            Claims:    claims,
+        }
+    }
+    if clientId, _ := metadata.Claims[JwtClientId].(string); clientId != "" && clientId != args.ClientId {
+        return oauthErr(OAuthUnauthorizedClient, "token was issued to another client")
+    }
+
+    if metadata.KeyId != "" {
+        return s.RevokeAPIKey(c, metadata.UserId, metadata.KeyId)
+    }
+    return s.DeleteTokens(c, metadata)
+}
+
+// authenticateCaller a service account or a confidential OAuth client
+func (s *service) authenticateCaller(c context.Context, clientId, secret string) error {
+    account, err := s.loadServiceAccount(c, clientId)
+    if err == nil {
+        if secret == "" || !s.checkPassword(c, secret, account.SecretHash) {
+            return oauthErr(OAuthInvalidClient, "client authentication failed")
+        }
+        return nil
+    }
+    if !errors.Is(err, ErrNotFound) {
+        return err
+    }
+
+    client, err := s.authenticateClient(c, clientId, secret)
+    if err != nil {
+        return err
+    }
+    if client.Public() {
+        return oauthErr(OAuthInvalidClient, "public clients can not call this endpoint")
+    }
+    return nil
+}
+
+// lookupToken the live access token, session or API key, else the claims of the live refresh token.
+// Both are nil when the token is not active.
+func (s *service) lookupToken(c context.Context, token, hint string) (*AccessDetails, jwt.MapClaims) {
+    if hint == "refresh_token" {
+        if claims := s.liveRefresh(c, token); claims != nil {
+            return nil, claims
+        }
+        return s.liveAccess(c, token), nil
+    }
+    if metadata := s.liveAccess(c, token); metadata != nil {
+        return metadata, nil
+    }
+    return nil, s.liveRefresh(c, token)
+}
+
+// liveAccess run the token through Authorize as if it was presented as a bearer token
+func (s *service) liveAccess(c context.Context, token string) *AccessDetails {
+    r, err := http.NewRequestWithContext(c, http.MethodGet, "/", nil)
+    if err != nil {
+        return nil
+    }
+    r.Header.Set("Authorization", "Bearer "+token)
+    metadata, err := s.AuthorizeScopes(withExtractors(r, []TokenExtractor{BearerExtractor()}))
+    if err != nil {
+        return nil
+    }
+    return metadata
+}
+
+func (s *service) liveRefresh(c context.Context, token string) jwt.MapClaims {
+    claims, err := s.parseRefresh(token)
+    if err != nil {
+        return nil
+    }
+    refreshUuid, _ := claims[JwtRefreshUuid].(string)
+    userId, _ := claims[JwtUserId].(string)
+    if refreshUuid == "" || userId == "" {
+        return nil
+    }
+    if _, err = s.FetchAuth(c, refreshUuid); err != nil {
+        return nil
+    }
+    user, err := s.LoadUser(c, userId)
+    if err != nil || statusError(user.Status) != nil {
+        return nil
+    }
+    return claims
+}
@@ -0,0 +1,283 @@
+package authr
+
+import (
+    "context"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "github.com/go-ldap/ldap/v3"
+    "net"
+    "strings"
+    "time"
+)
+
+// BackendLDAP Backend of the users owned by the directory of WithLDAP
+const BackendLDAP = "ldap"
+
+const ldapTimeout = time.Second * 10
+
+// LDAPConfig LDAP or Active Directory the logins of unknown and directory owned users are bound against
+type LDAPConfig struct {
+    // URL ldap:// or ldaps:// address of the directory
+    URL string
+    // StartTLS upgrade an ldap:// connection before binding, TLSConfig applies to ldaps:// and StartTLS
+    StartTLS  bool
+    TLSConfig *tls.Config
+    // UserDNTemplate bind directly as the user, e.g. "uid=%s,ou=people,dc=example,dc=com" or "%s@corp.example.com".
+    // Without it the user is searched below BaseDN as BindDN and the found entry is bound with the password.
+    UserDNTemplate string
+    BindDN         string
+    BindPassword   string
+    BaseDN         string
+    // UserFilter defaults to (uid=%s), Active Directory uses (sAMAccountName=%s)
+    UserFilter string
+    // EmailAttribute defaults to mail
+    EmailAttribute string
+    // GroupAttribute group DNs on the user entry, defaults to memberOf
+    GroupAttribute string
+    // GroupBaseDN search the groups below it with GroupFilter instead of reading GroupAttribute
+    GroupBaseDN string
+    // GroupFilter defaults to (member=%s), the user DN is substituted
+    GroupFilter string
+    // GroupRoles authr role of a group keyed by the group DN or its cn, compared case insensitive.
+    // The roles of directory users follow their groups on every login.
+    GroupRoles map[string]string
+    // DefaultRoles roles of every directory user on top of the mapped groups
+    DefaultRoles []string
+    // Dial defaults to dialing URL, a stand-in directory can be returned instead
+    Dial func(c context.Context) (LDAPConn, error)
+}
+
+// LDAPConn the part of *ldap.Conn the login needs
+type LDAPConn interface {
+    Bind(username, password string) error
+    Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+    Close()
+}
+
+// WithLDAP append the directory to the default login chain after the local database, see WithAuthenticators.
+// Directory users are provisioned on their first login and updated on every login, they have no local password.
+func WithLDAP(cfg LDAPConfig) Option {
+    return func(s *service) {
+        s.ldap = ldapDefaults(cfg)
+    }
+}
+
+// LDAPAuthenticator the directory as an entry of WithAuthenticators
+func LDAPAuthenticator(cfg LDAPConfig) Authenticator {
+    return ldapDefaults(cfg)
+}
+
+func ldapDefaults(cfg LDAPConfig) *LDAPConfig {
+    if cfg.UserFilter == "" {
+        cfg.UserFilter = "(uid=%s)"
+    }
+    if cfg.EmailAttribute == "" {
+        cfg.EmailAttribute = "mail"
+    }
+    if cfg.GroupAttribute == "" {
+        cfg.GroupAttribute = "memberOf"
+    }
+    if cfg.GroupFilter == "" {
+        cfg.GroupFilter = "(member=%s)"
+    }
+    return &cfg
+}
+
+func (cfg *LDAPConfig) validate() error {
+    if cfg.URL == "" && cfg.Dial == nil {
+        return fmt.Errorf("%w: WithLDAP needs a URL", ErrNotConfigured)
+    }
+    if cfg.UserDNTemplate == "" && cfg.BaseDN == "" {
+        return fmt.Errorf("%w: WithLDAP needs a UserDNTemplate or a BaseDN", ErrNotConfigured)
+    }
+    return nil
+}
+
+func (cfg *LDAPConfig) dial(c context.Context) (LDAPConn, error) {
+    conn, err := ldap.DialURL(cfg.URL, ldap.DialWithTLSConfig(cfg.TLSConfig), ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+    if err != nil {
+        return nil, err
+    }
+    conn.SetTimeout(ldapTimeout)
+    if cfg.StartTLS {
+        if err = conn.StartTLS(cfg.TLSConfig); err != nil {
+            conn.Close()
+            return nil, err
+        }
+    }
+    return conn, nil
+}
+
+func (cfg *LDAPConfig) Name() string {
+    return BackendLDAP
+}
+
+// Authenticate bind as the user, the roles are DefaultRoles plus the roles of the mapped groups
+func (cfg *LDAPConfig) Authenticate(c context.Context, args *LoginParams, local *User) (*AuthIdentity, error) {
+    entry, err := cfg.bind(c, args.Username, args.Password)
+    if err != nil {
+        return nil, err
+    }
+    return &AuthIdentity{
+        Email:  entry.email,
+        Groups: entry.groups,
+        Roles:  mapRoles(entry.groups, cfg.GroupRoles, cfg.DefaultRoles),
+    }, nil
+}
+
+type ldapEntry struct {
+    dn     string
+    email  string
+    groups []string
+}
+
+// bind as the user, ErrInvalidCredentials when the directory rejects the password
+func (cfg *LDAPConfig) bind(c context.Context, username, password string) (*ldapEntry, error) {
+    // an empty password is an unauthenticated bind which most directories accept
+    if password == "" {
+        return nil, ErrInvalidCredentials
+    }
+    conn, err := cfg.connect(c)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    attrs := []string{cfg.EmailAttribute, cfg.GroupAttribute}
+    var entry *ldap.Entry
+    if cfg.UserDNTemplate != "" {
+        dn := fmt.Sprintf(cfg.UserDNTemplate, escapeDN(username))
+        if err = bindErr(conn.Bind(dn, password)); err != nil {
+            return nil, err
+        }
+        if entry, err = searchOne(conn, dn, ldap.ScopeBaseObject, "(objectClass=*)", attrs); err != nil {
+            return nil, err
+        }
+    } else {
+        if cfg.BindDN != "" {
+            if err = conn.Bind(cfg.BindDN, cfg.BindPassword); err != nil {
+                return nil, fmt.Errorf("%w: ldap service bind: %v", ErrProvider, err)
+            }
+        }
+        filter := fmt.Sprintf(cfg.UserFilter, ldap.EscapeFilter(username))
+        if entry, err = searchOne(conn, cfg.BaseDN, ldap.ScopeWholeSubtree, filter, attrs); err != nil {
+            return nil, err
+        }
+        if err = bindErr(conn.Bind(entry.DN, password)); err != nil {
+            return nil, err
+        }
+    }
+
+    result := &ldapEntry{dn: entry.DN, email: entry.GetEqualFoldAttributeValue(cfg.EmailAttribute)}
+    if cfg.GroupBaseDN == "" {
+        result.groups = entry.GetEqualFoldAttributeValues(cfg.GroupAttribute)
+        return result, nil
+    }
+    res, err := conn.Search(ldap.NewSearchRequest(cfg.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+        fmt.Sprintf(cfg.GroupFilter, ldap.EscapeFilter(entry.DN)), []string{"cn"}, nil))
+    if err != nil {
+        return nil, fmt.Errorf("%w: ldap group search: %v", ErrProvider, err)
+    }
+    for _, group := range res.Entries {
+        result.groups = append(result.groups, group.DN)
+    }
+    return result, nil
+}
+
+// LookupUser the username resolves to one entry of the directory, searched as BindDN or, with a
+// UserDNTemplate and no BindDN, read anonymously. Registration fails while the directory is unreachable.
+func (cfg *LDAPConfig) LookupUser(c context.Context, username string) (bool, error) {
+    conn, err := cfg.connect(c)
+    if err != nil {
+        return false, err
+    }
+    defer conn.Close()
+
+    if cfg.BindDN != "" {
+        if err = conn.Bind(cfg.BindDN, cfg.BindPassword); err != nil {
+            return false, fmt.Errorf("%w: ldap service bind: %v", ErrProvider, err)
+        }
+    }
+    if cfg.UserDNTemplate != "" {
+        dn := fmt.Sprintf(cfg.UserDNTemplate, escapeDN(username))
+        _, err = searchOne(conn, dn, ldap.ScopeBaseObject, "(objectClass=*)", []string{"1.1"})
+    } else {
+        filter := fmt.Sprintf(cfg.UserFilter, ldap.EscapeFilter(username))
+        _, err = searchOne(conn, cfg.BaseDN, ldap.ScopeWholeSubtree, filter, []string{"1.1"})
+    }
+    if errors.Is(err, ErrInvalidCredentials) {
+        return false, nil
+    }
+    return err == nil, err
+}
+
+func (cfg *LDAPConfig) connect(c context.Context) (LDAPConn, error) {
+    dial := cfg.Dial
+    if dial == nil {
+        dial = cfg.dial
+    }
+    conn, err := dial(c)
+    if err != nil {
+        return nil, fmt.Errorf("%w: ldap: %v", ErrProvider, err)
+    }
+    return conn, nil
+}
+
+// searchOne the search must match exactly one entry, otherwise the user is treated as unknown
+func searchOne(conn LDAPConn, base string, scope int, filter string, attrs []string) (*ldap.Entry, error) {
+    res, err := conn.Search(ldap.NewSearchRequest(base, scope, ldap.NeverDerefAliases, 2, 0, false, filter, attrs, nil))
+    if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+        return nil, ErrInvalidCredentials
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%w: ldap search: %v", ErrProvider, err)
+    }
+    if len(res.Entries) != 1 {
+        return nil, ErrInvalidCredentials
+    }
+    return res.Entries[0], nil
+}
+
+func bindErr(err error) error {
+    if err == nil {
+        return nil
+    }
+    if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+        return ErrInvalidCredentials
+    }
+    return fmt.Errorf("%w: ldap bind: %v", ErrProvider, err)
+}
+
+// groupCN cn of the first RDN of a group DN, "" when it is not a cn
+func groupCN(dn string) string {
+    parsed, err := ldap.ParseDN(dn)
+    if err != nil || len(parsed.RDNs) == 0 {
+        return ""
+    }
+    for _, attr := range parsed.RDNs[0].Attributes {
+        if strings.EqualFold(attr.Type, "cn") {
+            return attr.Value
+        }
+    }
+    return ""
+}
+
+// escapeDN escape an attribute value for a DN, RFC 4514 section 2.4
+func escapeDN(value string) string {
+    var b strings.Builder
+    for i, r := range value {
+        switch {
+        case strings.ContainsRune(`,+"\<>;=`, r),
+            (r == ' ' || r == '#') && i == 0,
+            r == ' ' && i == len(value)-1:
+            b.WriteByte('\\')
+            b.WriteRune(r)
+        case r == 0:
+            b.WriteString(`\00`)
+        default:
+            b.WriteRune(r)
+        }
+    }
+    return b.String()
+}
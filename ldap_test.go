@@ -0,0 +1,299 @@
+package authr
+
+import (
+    "context"
+    "errors"
+    "github.com/go-ldap/ldap/v3"
+    "reflect"
+    "sort"
+    "strings"
+    "testing"
+)
+
+// testDirectory LDAPConn recording the binds and searches, searches answer entries or searchErr
+type testDirectory struct {
+    passwords map[string]string
+    entries   []*ldap.Entry
+    // filter the only search filter entries answer, any filter when empty
+    filter    string
+    groups    []*ldap.Entry
+    searchErr error
+    binds     []string
+    searches  []*ldap.SearchRequest
+    dials     int
+}
+
+func (d *testDirectory) dial(c context.Context) (LDAPConn, error) {
+    d.dials++
+    return d, nil
+}
+
+func (d *testDirectory) Bind(username, password string) error {
+    d.binds = append(d.binds, username)
+    if want, ok := d.passwords[username]; !ok || want != password {
+        return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+    }
+    return nil
+}
+
+func (d *testDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+    d.searches = append(d.searches, req)
+    if d.searchErr != nil {
+        return nil, d.searchErr
+    }
+    if len(d.searches) > 1 && d.groups != nil {
+        return &ldap.SearchResult{Entries: d.groups}, nil
+    }
+    if d.filter != "" && req.Filter != d.filter {
+        return &ldap.SearchResult{}, nil
+    }
+    return &ldap.SearchResult{Entries: d.entries}, nil
+}
+
+func (d *testDirectory) Close() {}
+
+const testUserDN = "uid=ann,ou=people,dc=example,dc=com"
+
+func testEntry(dn string, groups ...string) *ldap.Entry {
+    return ldap.NewEntry(dn, map[string][]string{"mail": {"ann@corp.example.com"}, "memberOf": groups})
+}
+
+// searchConfig find the user below BaseDN as a service account
+func (d *testDirectory) searchConfig() LDAPConfig {
+    return LDAPConfig{
+        BaseDN:       "ou=people,dc=example,dc=com",
+        BindDN:       "cn=svc,dc=example,dc=com",
+        BindPassword: "svc",
+        Dial:         d.dial,
+    }
+}
+
+func TestLDAPEmptyPassword(t *testing.T) {
+    dir := &testDirectory{passwords: map[string]string{testUserDN: ""}, entries: []*ldap.Entry{testEntry(testUserDN)}}
+    cfg := ldapDefaults(dir.searchConfig())
+
+    _, err := cfg.Authenticate(context.Background(), &LoginParams{Username: "ann"}, nil)
+    if !errors.Is(err, ErrInvalidCredentials) {
+        t.Errorf("Authenticate = %v, want ErrInvalidCredentials", err)
+    }
+    if dir.dials != 0 {
+        t.Errorf("dialed the directory %d times, want 0", dir.dials)
+    }
+}
+
+func TestLDAPEscaping(t *testing.T) {
+    tests := []struct {
+        name       string
+        template   string
+        username   string
+        wantBind   string
+        wantFilter string
+    }{
+        {"filter injection", "", "*)(uid=*))(|(uid=*", "", `(uid=\2a\29\28uid=\2a\29\29\28|\28uid=\2a)`},
+        {"filter with nul", "", "ann\x00", "", `(uid=ann\00)`},
+        {"dn injection", "uid=%s,ou=people,dc=example,dc=com", "ann,ou=admins", `uid=ann\,ou\=admins,ou=people,dc=example,dc=com`, ""},
+        {"dn leading space and hash", "uid=%s,ou=people,dc=example,dc=com", "#ann ", `uid=\#ann\ ,ou=people,dc=example,dc=com`, ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            dir := &testDirectory{passwords: map[string]string{"cn=svc,dc=example,dc=com": "svc"}}
+            cfg := dir.searchConfig()
+            cfg.UserDNTemplate = tt.template
+
+            _, err := ldapDefaults(cfg).Authenticate(context.Background(), &LoginParams{Username: tt.username, Password: "pw"}, nil)
+            if !errors.Is(err, ErrInvalidCredentials) {
+                t.Fatalf("Authenticate = %v, want ErrInvalidCredentials", err)
+            }
+            if tt.wantBind != "" && (len(dir.binds) != 1 || dir.binds[0] != tt.wantBind) {
+                t.Errorf("binds = %q, want %q", dir.binds, tt.wantBind)
+            }
+            if tt.wantFilter != "" && (len(dir.searches) != 1 || dir.searches[0].Filter != tt.wantFilter) {
+                t.Errorf("searches = %v, want filter %q", dir.searches, tt.wantFilter)
+            }
+        })
+    }
+}
+
+func TestLDAPSearchHits(t *testing.T) {
+    tests := []struct {
+        name      string
+        entries   []*ldap.Entry
+        searchErr error
+        wantErr   error
+    }{
+        {"one hit", []*ldap.Entry{testEntry(testUserDN)}, nil, nil},
+        {"no hit", nil, nil, ErrInvalidCredentials},
+        {"two hits", []*ldap.Entry{testEntry(testUserDN), testEntry("uid=ann,ou=guests,dc=example,dc=com")}, nil, ErrInvalidCredentials},
+        {"size limit", nil, ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit")), ErrInvalidCredentials},
+        {"no such base", nil, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("no such object")), ErrInvalidCredentials},
+        {"directory down", nil, ldap.NewError(ldap.LDAPResultUnavailable, errors.New("unavailable")), ErrProvider},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            dir := &testDirectory{
+                passwords: map[string]string{"cn=svc,dc=example,dc=com": "svc", testUserDN: "pw"},
+                entries:   tt.entries,
+                searchErr: tt.searchErr,
+            }
+
+            _, err := ldapDefaults(dir.searchConfig()).Authenticate(context.Background(), &LoginParams{Username: "ann", Password: "pw"}, nil)
+            if !errors.Is(err, tt.wantErr) {
+                t.Fatalf("Authenticate = %v, want %v", err, tt.wantErr)
+            }
+            userBound := len(dir.binds) == 2 && dir.binds[1] == testUserDN
+            if userBound != (tt.wantErr == nil) {
+                t.Errorf("binds = %q", dir.binds)
+            }
+        })
+    }
+}
+
+func TestLDAPGroupRoles(t *testing.T) {
+    groupRoles := map[string]string{
+        "cn=Admins,ou=groups,dc=example,dc=com": "ROLE_ADMIN",
+        "moderators":                            "ROLE_MODERATOR",
+    }
+    tests := []struct {
+        name      string
+        memberOf  []string
+        groupBase bool
+        groups    []*ldap.Entry
+        want      []string
+    }{
+        {"no groups", nil, false, nil, []string{"ROLE_USER"}},
+        {"group by dn", []string{"CN=admins,OU=groups,DC=example,DC=com"}, false, nil, []string{"ROLE_ADMIN", "ROLE_USER"}},
+        {"group by cn", []string{"cn=Moderators,ou=teams,dc=example,dc=com"}, false, nil, []string{"ROLE_MODERATOR", "ROLE_USER"}},
+        {"unmapped group", []string{"cn=staff,ou=groups,dc=example,dc=com"}, false, nil, []string{"ROLE_USER"}},
+        {"group search", nil, true, []*ldap.Entry{ldap.NewEntry("cn=admins,ou=groups,dc=example,dc=com", nil)}, []string{"ROLE_ADMIN", "ROLE_USER"}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            dir := &testDirectory{
+                passwords: map[string]string{"cn=svc,dc=example,dc=com": "svc", testUserDN: "pw"},
+                entries:   []*ldap.Entry{testEntry(testUserDN, tt.memberOf...)},
+                groups:    tt.groups,
+            }
+            cfg := dir.searchConfig()
+            cfg.GroupRoles = groupRoles
+            cfg.DefaultRoles = []string{"ROLE_USER"}
+            if tt.groupBase {
+                cfg.GroupBaseDN = "ou=groups,dc=example,dc=com"
+            }
+            // the directory alone, the local backend would spend a bcrypt compare on the unknown username
+            s := newTestService(t, WithAuthenticators(LDAPAuthenticator(cfg)))
+
+            user, err := s.LoginUser(context.Background(), &LoginParams{Username: "ann", Password: "pw"})
+            if err != nil {
+                t.Fatal(err)
+            }
+            stored, err := s.LoadUser(context.Background(), user.ID)
+            if err != nil {
+                t.Fatal(err)
+            }
+            got := strings.Split(stored.Roles, ",")
+            sort.Strings(got)
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("roles = %v, want %v", got, tt.want)
+            }
+            if stored.Backend != BackendLDAP || stored.Email != "ann@corp.example.com" {
+                t.Errorf("user = %+v, want an ldap user with the directory email", stored)
+            }
+            if tt.groupBase && dir.searches[1].Filter != `(member=uid=ann,ou=people,dc=example,dc=com)` {
+                t.Errorf("group filter = %q", dir.searches[1].Filter)
+            }
+        })
+    }
+}
+
+func TestRegisterDirectoryUsername(t *testing.T) {
+    tests := []struct {
+        name      string
+        entries   []*ldap.Entry
+        searchErr error
+        wantErr   error
+    }{
+        {"directory user", []*ldap.Entry{testEntry(testUserDN)}, nil, ErrUserExists},
+        {"unknown to the directory", nil, nil, nil},
+        {"directory down", nil, ldap.NewError(ldap.LDAPResultUnavailable, errors.New("unavailable")), ErrProvider},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            dir := &testDirectory{
+                passwords: map[string]string{"cn=svc,dc=example,dc=com": "svc"},
+                entries:   tt.entries,
+                searchErr: tt.searchErr,
+            }
+            s := newTestService(t, WithLDAP(dir.searchConfig()))
+
+            _, err := s.RegisterUser(context.Background(), &RegistrationParams{Username: "ann", Password: "pw", Email: "ann@example.com"})
+            if !errors.Is(err, tt.wantErr) {
+                t.Fatalf("RegisterUser = %v, want %v", err, tt.wantErr)
+            }
+            if len(dir.searches) != 1 || dir.searches[0].Filter != "(uid=ann)" {
+                t.Errorf("searches = %v, want one search for (uid=ann)", dir.searches)
+            }
+        })
+    }
+}
+
+func TestLDAPInactiveUserIsNotSynced(t *testing.T) {
+    dir := &testDirectory{
+        passwords: map[string]string{"cn=svc,dc=example,dc=com": "svc", testUserDN: "pw"},
+        entries:   []*ldap.Entry{testEntry(testUserDN, "cn=admins,ou=groups,dc=example,dc=com")},
+    }
+    cfg := dir.searchConfig()
+    cfg.GroupRoles = map[string]string{"admins": "ROLE_ADMIN"}
+    s := newTestService(t, WithAuthenticators(LDAPAuthenticator(cfg)))
+    c := context.Background()
+    user := newTestUser(t, s, "ann", "", "ROLE_USER")
+    if err := s.db.Model(user).Updates(map[string]interface{}{"backend": BackendLDAP, "password": ""}).Error; err != nil {
+        t.Fatal(err)
+    }
+    if err := s.SetStatus(c, user.ID, StatusLocked); err != nil {
+        t.Fatal(err)
+    }
+
+    if _, err := s.LoginUser(c, &LoginParams{Username: "ann", Password: "pw"}); !errors.Is(err, ErrAccountLocked) {
+        t.Fatalf("LoginUser = %v, want ErrAccountLocked", err)
+    }
+    stored, err := s.LoadUser(c, user.ID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stored.Roles != "ROLE_USER" || stored.Email != "ann@example.com" {
+        t.Errorf("locked user synced to roles %q email %q", stored.Roles, stored.Email)
+    }
+}
+
+func TestRenameToDirectoryUsername(t *testing.T) {
+    dir := &testDirectory{
+        passwords: map[string]string{"cn=svc,dc=example,dc=com": "svc"},
+        entries:   []*ldap.Entry{testEntry(testUserDN)},
+    }
+    s := newTestService(t, WithLDAP(dir.searchConfig()))
+    user := newTestUser(t, s, "bob", "secret")
+
+    username := "ann"
+    if _, err := s.UpdateProfile(context.Background(), user.ID, &ProfileParams{Username: &username}); !errors.Is(err, ErrUserExists) {
+        t.Errorf("UpdateProfile = %v, want ErrUserExists", err)
+    }
+}
+
+func TestFederatedUsernameOfDirectoryUser(t *testing.T) {
+    dir := &testDirectory{
+        passwords: map[string]string{"cn=svc,dc=example,dc=com": "svc"},
+        entries:   []*ldap.Entry{testEntry(testUserDN)},
+        filter:    "(uid=ann)",
+    }
+    idp := newTestIdP(t)
+    idp.claims = map[string]interface{}{"preferred_username": "ann"}
+    s := newTestService(t, WithLDAP(dir.searchConfig()), WithFederatedProviders(idp.provider(false)))
+
+    result, err := idp.federate(t, s, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.User.Username == "ann" || !strings.HasPrefix(result.User.Username, "ann-") {
+        t.Errorf("username = %q, want a suffixed ann", result.User.Username)
+    }
+}
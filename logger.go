@@ -0,0 +1,116 @@
+package authr
+
+import (
+    "strings"
+)
+
+// Logger leveled structured logger taking alternating key/value pairs, *slog.Logger satisfies it
+type Logger interface {
+    Debug(msg string, args ...any)
+    Info(msg string, args ...any)
+    Warn(msg string, args ...any)
+    Error(msg string, args ...any)
+}
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys any key ending in one of these has its value redacted, e.g. refresh_token, password_hash
+var sensitiveKeys = []string{"password", "secret", "token", "hash", "authorization", "cookie", "key"}
+
+// WithLogger log through l, every key/value pair is redacted before it reaches l
+func WithLogger(l Logger) Option {
+    return func(s *service) {
+        if l == nil {
+            s.log = nopLogger{}
+            return
+        }
+        s.log = redactLogger{l: l}
+    }
+}
+
+// nopLogger default logger, authr is silent unless a logger is configured
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// redactLogger scrubs secrets from the fields before delegating
+type redactLogger struct {
+    l Logger
+}
+
+func (r redactLogger) Debug(msg string, args ...any) { r.l.Debug(msg, redact(args)...) }
+func (r redactLogger) Info(msg string, args ...any)  { r.l.Info(msg, redact(args)...) }
+func (r redactLogger) Warn(msg string, args ...any)  { r.l.Warn(msg, redact(args)...) }
+func (r redactLogger) Error(msg string, args ...any) { r.l.Error(msg, redact(args)...) }
+
+// redact replace values of sensitive keys, and users or tokens with their identifiers
+func redact(args []any) []any {
+    out := make([]any, len(args))
+    copy(out, args)
+
+    for i := 0; i+1 < len(out); i += 2 {
+        key, ok := out[i].(string)
+        if !ok {
+            continue
+        }
+        if sensitiveKey(key) {
+            out[i+1] = redacted
+            continue
+        }
+        out[i+1] = redactValue(out[i+1])
+    }
+
+    // a trailing value without a key is dropped by slog, redact it anyway
+    if len(out)%2 == 1 {
+        out[len(out)-1] = redactValue(out[len(out)-1])
+    }
+    return out
+}
+
+func redactValue(v any) any {
+    switch t := v.(type) {
+    case *User:
+        if t == nil {
+            return nil
+        }
+        return t.ID
+    case User:
+        return t.ID
+    case *TokenDetails:
+        if t == nil {
+            return nil
+        }
+        return t.TokenUuid
+    case TokenDetails:
+        return t.TokenUuid
+    case *LoginParams:
+        if t == nil {
+            return nil
+        }
+        return t.Username
+    case *RegistrationParams:
+        if t == nil {
+            return nil
+        }
+        return t.Username
+    case *AccessDetails:
+        if t == nil {
+            return nil
+        }
+        return t.TokenUuid
+    }
+    return v
+}
+
+func sensitiveKey(key string) bool {
+    key = strings.ToLower(key)
+    for _, k := range sensitiveKeys {
+        if strings.HasSuffix(key, k) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,181 @@
+package authr
+
+import (
+    "errors"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "net/http"
+    "time"
+)
+
+const (
+    adapterGin  = "gin"
+    adapterHttp = "net-http"
+
+    outcomeSuccess = "success"
+    outcomeFailure = "failure"
+)
+
+// Metrics prometheus instrumentation of the auth service, a nil *Metrics records nothing
+type Metrics struct {
+    registry      *prometheus.Registry
+    logins        *prometheus.CounterVec
+    registrations *prometheus.CounterVec
+    refreshes     *prometheus.CounterVec
+    validations   *prometheus.CounterVec
+    revocations   *prometheus.CounterVec
+    dbLatency     *prometheus.HistogramVec
+}
+
+// NewMetrics create the authr collectors on their own registry
+func NewMetrics() *Metrics {
+    m := &Metrics{
+        registry: prometheus.NewRegistry(),
+        logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: "authr",
+            Name:      "logins_total",
+            Help:      "Login attempts by outcome and failure reason.",
+        }, []string{"adapter", "outcome", "reason"}),
+        registrations: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: "authr",
+            Name:      "registrations_total",
+            Help:      "Registration attempts by outcome and failure reason.",
+        }, []string{"adapter", "outcome", "reason"}),
+        refreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: "authr",
+            Name:      "refreshes_total",
+            Help:      "Token refresh attempts by outcome and failure reason.",
+        }, []string{"adapter", "outcome", "reason"}),
+        validations: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: "authr",
+            Name:      "token_validations_total",
+            Help:      "Access token validations in the auth middleware by outcome and failure reason.",
+        }, []string{"adapter", "outcome", "reason"}),
+        revocations: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: "authr",
+            Name:      "token_revocations_total",
+            Help:      "Token revocations by reason.",
+        }, []string{"adapter", "reason"}),
+        dbLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Namespace: "authr",
+            Name:      "db_duration_seconds",
+            Help:      "Latency of token store operations.",
+            Buckets:   prometheus.DefBuckets,
+        }, []string{"operation"}),
+    }
+
+    m.registry.MustRegister(m.logins, m.registrations, m.refreshes, m.validations, m.revocations, m.dbLatency)
+    return m
+}
+
+// WithMetrics record prometheus metrics, they are not collected unless this option is used
+func WithMetrics(m *Metrics) Option {
+    return func(s *service) {
+        s.metrics = m
+    }
+}
+
+// Handler serve the metrics in the prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+    if m == nil {
+        return http.NotFoundHandler()
+    }
+    return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Registry to register the collectors with another registry or gatherer
+func (m *Metrics) Registry() *prometheus.Registry {
+    if m == nil {
+        return nil
+    }
+    return m.registry
+}
+
+func (m *Metrics) login(adapter string, err error) {
+    if m != nil {
+        m.logins.WithLabelValues(adapter, outcome(err), failureReason(err)).Inc()
+    }
+}
+
+func (m *Metrics) registration(adapter string, err error) {
+    if m != nil {
+        m.registrations.WithLabelValues(adapter, outcome(err), failureReason(err)).Inc()
+    }
+}
+
+func (m *Metrics) refresh(adapter string, err error) {
+    if m != nil {
+        m.refreshes.WithLabelValues(adapter, outcome(err), failureReason(err)).Inc()
+    }
+}
+
+func (m *Metrics) validation(adapter string, err error) {
+    if m != nil {
+        m.validations.WithLabelValues(adapter, outcome(err), failureReason(err)).Inc()
+    }
+}
+
+func (m *Metrics) revocation(adapter, reason string) {
+    if m != nil {
+        m.revocations.WithLabelValues(adapter, reason).Inc()
+    }
+}
+
+// observeDB record the duration of a store operation since start
+func (m *Metrics) observeDB(operation string, start time.Time) {
+    if m != nil {
+        m.dbLatency.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+    }
+}
+
+func outcome(err error) string {
+    if err == nil {
+        return outcomeSuccess
+    }
+    return outcomeFailure
+}
+
+// errRefreshFailed placeholder error for refresh failures that are only reported as a reason
+var errRefreshFailed = errors.New("refresh failed")
+
+// reasonError carries a bounded failure reason for metric labels
+type reasonError struct {
+    reason string
+    err    error
+}
+
+func (e *reasonError) Error() string { return e.err.Error() }
+func (e *reasonError) Unwrap() error { return e.err }
+
+// withReason tag err with a metric reason label
+func withReason(reason string, err error) error {
+    if err == nil {
+        return nil
+    }
+    return &reasonError{reason: reason, err: err}
+}
+
+// failureReason bounded label value for err
+func failureReason(err error) string {
+    var re *reasonError
+    switch {
+    case err == nil:
+        return ""
+    case errors.As(err, &re):
+        return re.reason
+    case errors.Is(err, ErrInsufficientScope):
+        return "insufficient_scope"
+    case errors.Is(err, ErrAccountLocked):
+        return "locked"
+    case errors.Is(err, ErrAccountDisabled):
+        return "disabled"
+    case errors.Is(err, ErrAccountPending):
+        return "pending"
+    case errors.Is(err, ErrAccountInactive):
+        return "inactive"
+    case errors.Is(err, ErrInvalidCredentials):
+        return "invalid_credentials"
+    default:
+        return "error"
+    }
+}
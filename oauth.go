@@ -0,0 +1,493 @@
+package authr
+
+import (
+    "context"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "github.com/dgrijalva/jwt-go"
+    "github.com/twinj/uuid"
+    "gorm.io/gorm"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+const oauthCodeTTL = time.Minute * 5
+
+// OAuth 2.0 error codes, RFC 6749 sections 4.1.2.1 and 5.2
+const (
+    OAuthInvalidRequest          = "invalid_request"
+    OAuthInvalidClient           = "invalid_client"
+    OAuthInvalidGrant            = "invalid_grant"
+    OAuthUnauthorizedClient      = "unauthorized_client"
+    OAuthUnsupportedGrantType    = "unsupported_grant_type"
+    OAuthUnsupportedResponseType = "unsupported_response_type"
+    OAuthInvalidScope            = "invalid_scope"
+    OAuthAccessDenied            = "access_denied"
+    OAuthServerError             = "server_error"
+    // RFC 8628 section 3.5
+    OAuthAuthorizationPending    = "authorization_pending"
+    OAuthSlowDown                = "slow_down"
+    OAuthExpiredToken            = "expired_token"
+)
+
+// OAuthError error body of the authorization and token endpoints
+type OAuthError struct {
+    Code        string `json:"error"`
+    Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+    return fmt.Sprintf("oauth: %s: %s", e.Code, e.Description)
+}
+
+// Status http status of the error at the token endpoint
+func (e *OAuthError) Status() int {
+    switch e.Code {
+    case OAuthInvalidClient:
+        return http.StatusUnauthorized
+    case OAuthServerError:
+        return http.StatusInternalServerError
+    default:
+        return http.StatusBadRequest
+    }
+}
+
+func oauthErr(code, description string) *OAuthError {
+    return &OAuthError{Code: code, Description: description}
+}
+
+// toOAuthError anything that is not an OAuthError is reported as server_error without details
+func toOAuthError(err error) *OAuthError {
+    var oe *OAuthError
+    if errors.As(err, &oe) {
+        return oe
+    }
+    return oauthErr(OAuthServerError, "")
+}
+
+// OAuthService OAuth 2.0 authorization server, authorization code with PKCE, refresh token, client
+// credentials and device grants
+type OAuthService interface {
+    RegisterClient(c context.Context, args *ClientParams) (*ClientRegistration, error)
+    GetClient(c context.Context, clientId string) (*OAuthClient, error)
+    DeleteClient(c context.Context, clientId string) error
+    AuthorizeCode(c context.Context, session *AccessDetails, args *AuthorizeParams) (*AuthorizeResult, error)
+    ExchangeToken(c context.Context, args *TokenParams) (*OAuthToken, error)
+    IntrospectToken(c context.Context, args *TokenLookupParams) (*TokenIntrospection, error)
+    RevokeToken(c context.Context, args *TokenLookupParams) error
+    AuthorizeDevice(c context.Context, args *DeviceAuthorizationParams) (*DeviceAuthorization, error)
+    VerifyDevice(c context.Context, session *AccessDetails, args *DeviceVerifyParams) (*ConsentPrompt, error)
+}
+
+// RegisterClient store a new client, confidential clients get a secret that is only returned here
+func (s *service) RegisterClient(c context.Context, args *ClientParams) (*ClientRegistration, error) {
+    if args == nil || strings.TrimSpace(args.Name) == "" || len(args.RedirectURIs) == 0 {
+        return nil, invalidf("client params are invalid")
+    }
+    for _, uri := range args.RedirectURIs {
+        u, err := url.Parse(uri)
+        if err != nil || !u.IsAbs() || u.Fragment != "" {
+            return nil, invalidf("redirect uri %q is invalid", uri)
+        }
+    }
+
+    client := &OAuthClient{
+        ClientId:     uuid.NewV4().String(),
+        Name:         strings.TrimSpace(args.Name),
+        RedirectURIs: args.RedirectURIs,
+        Scopes:       args.Scopes,
+        FirstParty:   args.FirstParty,
+    }
+    reg := &ClientRegistration{OAuthClient: client}
+    if !args.Public {
+        secret, err := randomToken()
+        if err != nil {
+            return nil, err
+        }
+        if client.SecretHash, err = s.hashPassword(c, secret); err != nil {
+            return nil, err
+        }
+        reg.ClientSecret = secret
+    }
+
+    if err := s.db.WithContext(c).Create(client).Error; err != nil {
+        return nil, storeErr("RegisterClient", err)
+    }
+    return reg, nil
+}
+
+func (s *service) GetClient(c context.Context, clientId string) (*OAuthClient, error) {
+    if clientId == "" {
+        return nil, ErrNotFound
+    }
+    client := &OAuthClient{}
+    if err := s.db.WithContext(c).Where("client_id = ?", clientId).First(client).Error; err != nil {
+        return nil, storeErr("GetClient", err)
+    }
+    return client, nil
+}
+
+// DeleteClient remove the client with its consents and codes, revoking every token issued to it
+func (s *service) DeleteClient(c context.Context, clientId string) error {
+    return storeErr("DeleteClient", s.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+        if err := tx.Where("client_id = ?", clientId).Delete(&OAuthConsent{}).Error; err != nil {
+            return err
+        }
+        if err := tx.Where("client_id = ?", clientId).Delete(&OAuthCode{}).Error; err != nil {
+            return err
+        }
+        if err := tx.Where("client_id = ?", clientId).Delete(&AuthTokens{}).Error; err != nil {
+            return err
+        }
+        return tx.Where("client_id = ?", clientId).Delete(&OAuthClient{}).Error
+    }))
+}
+
+// AuthorizeCode handle an authorization request of the logged in user. An unknown client or redirect uri
+// is returned as an error, anything else is reported to the client through the redirect.
+func (s *service) AuthorizeCode(c context.Context, session *AccessDetails, args *AuthorizeParams) (*AuthorizeResult, error) {
+    client, err := s.GetClient(c, args.ClientId)
+    if errors.Is(err, ErrNotFound) {
+        return nil, oauthErr(OAuthInvalidClient, "client is unknown")
+    }
+    if err != nil {
+        return nil, err
+    }
+    redirectURI := args.RedirectURI
+    if redirectURI == "" && len(client.RedirectURIs) == 1 {
+        redirectURI = client.RedirectURIs[0]
+    }
+    if !client.RedirectURIs.Contains(redirectURI) {
+        return nil, oauthErr(OAuthInvalidRequest, "redirect_uri is not registered")
+    }
+
+    fail := func(e *OAuthError) (*AuthorizeResult, error) {
+        return &AuthorizeResult{Redirect: withQuery(redirectURI, url.Values{
+            "error":             {e.Code},
+            "error_description": {e.Description},
+            "state":             {args.State},
+        })}, nil
+    }
+
+    if args.ResponseType != "code" {
+        return fail(oauthErr(OAuthUnsupportedResponseType, "only the code response type is supported"))
+    }
+    if args.CodeChallenge == "" || args.CodeChallengeMethod != "S256" {
+        return fail(oauthErr(OAuthInvalidRequest, "a S256 code_challenge is required"))
+    }
+    scopes, ok := grantScopes(client.Scopes, args.Scope)
+    if !ok {
+        return fail(oauthErr(OAuthInvalidScope, "scope is not allowed for this client"))
+    }
+    scope := strings.Join(scopes, " ")
+
+    user, err := s.LoadUser(c, session.UserId)
+    if err != nil {
+        return nil, err
+    }
+    if err = statusError(user.Status); err != nil {
+        return nil, err
+    }
+
+    switch args.Consent {
+    case "deny":
+        return fail(oauthErr(OAuthAccessDenied, "the user denied the request"))
+    case "allow":
+        if err = s.saveConsent(c, user.ID, client.ClientId, scopes); err != nil {
+            return nil, err
+        }
+    default:
+        if !client.FirstParty && !s.hasConsent(c, user.ID, client.ClientId, scopes) {
+            return &AuthorizeResult{Consent: &ConsentPrompt{ClientId: client.ClientId, ClientName: client.Name, Scopes: scopes}}, nil
+        }
+    }
+
+    code, err := randomToken()
+    if err != nil {
+        return nil, err
+    }
+    err = s.db.WithContext(c).Create(&OAuthCode{
+        CodeHash:            hashToken(code),
+        ClientId:            client.ClientId,
+        UserId:              user.ID,
+        RedirectURI:         args.RedirectURI,
+        Scope:               scope,
+        CodeChallenge:       args.CodeChallenge,
+        CodeChallengeMethod: args.CodeChallengeMethod,
+        Nonce:               args.Nonce,
+        AuthTime:            claimInt(session.Claims, JwtAuthTime),
+        Expires:             time.Now().Add(oauthCodeTTL),
+    }).Error
+    if err != nil {
+        return nil, storeErr("AuthorizeCode", err)
+    }
+
+    return &AuthorizeResult{Redirect: withQuery(redirectURI, url.Values{"code": {code}, "state": {args.State}})}, nil
+}
+
+// ExchangeToken token endpoint, the client authenticates with its secret unless it is public.
+// client_credentials authenticates a service account instead of a client.
+func (s *service) ExchangeToken(c context.Context, args *TokenParams) (*OAuthToken, error) {
+    if args.GrantType == "client_credentials" {
+        return s.clientCredentialsGrant(c, args)
+    }
+    client, err := s.authenticateClient(c, args.ClientId, args.ClientSecret)
+    if err != nil {
+        return nil, err
+    }
+
+    switch args.GrantType {
+    case "authorization_code":
+        return s.codeGrant(c, client, args)
+    case "refresh_token":
+        return s.refreshGrant(c, client, args)
+    case GrantTypeDeviceCode:
+        return s.deviceGrant(c, client, args)
+    default:
+        return nil, oauthErr(OAuthUnsupportedGrantType, "grant_type is not supported")
+    }
+}
+
+func (s *service) authenticateClient(c context.Context, clientId, secret string) (*OAuthClient, error) {
+    client, err := s.GetClient(c, clientId)
+    if errors.Is(err, ErrNotFound) {
+        return nil, oauthErr(OAuthInvalidClient, "client authentication failed")
+    }
+    if err != nil {
+        return nil, err
+    }
+    if !client.Public() && (secret == "" || !s.checkPassword(c, secret, client.SecretHash)) {
+        return nil, oauthErr(OAuthInvalidClient, "client authentication failed")
+    }
+    return client, nil
+}
+
+func (s *service) codeGrant(c context.Context, client *OAuthClient, args *TokenParams) (*OAuthToken, error) {
+    if args.Code == "" {
+        return nil, oauthErr(OAuthInvalidRequest, "code is required")
+    }
+
+    grant := &OAuthCode{}
+    err := s.db.WithContext(c).Where("code_hash = ?", hashToken(args.Code)).First(grant).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && grant.ClientId != client.ClientId) {
+        return nil, oauthErr(OAuthInvalidGrant, "code is invalid")
+    }
+    if err != nil {
+        return nil, storeErr("ExchangeToken", err)
+    }
+
+    // redeem exactly once, a replayed code revokes what the first exchange issued (RFC 6749 section 4.1.2)
+    now := time.Now()
+    res := s.db.WithContext(c).Model(&OAuthCode{}).Where("id = ? AND used_at IS NULL", grant.ID).Update("used_at", &now)
+    if res.Error != nil {
+        return nil, storeErr("ExchangeToken", res.Error)
+    }
+    if res.RowsAffected == 0 {
+        if err = s.revokeClientTokens(c, grant.UserId, client.ClientId); err != nil {
+            return nil, err
+        }
+        return nil, oauthErr(OAuthInvalidGrant, "code already used")
+    }
+    if now.After(grant.Expires) {
+        return nil, oauthErr(OAuthInvalidGrant, "code is expired")
+    }
+    if args.RedirectURI != grant.RedirectURI {
+        return nil, oauthErr(OAuthInvalidGrant, "redirect_uri does not match")
+    }
+    if !verifyPKCE(args.CodeVerifier, grant.CodeChallenge) {
+        return nil, oauthErr(OAuthInvalidGrant, "code_verifier is invalid")
+    }
+
+    user, err := s.LoadUser(c, grant.UserId)
+    if err != nil || statusError(user.Status) != nil {
+        return nil, oauthErr(OAuthInvalidGrant, "user can not authenticate")
+    }
+    tok, err := s.issueOAuthToken(c, user, client.ClientId, grant.Scope, grant.AuthTime)
+    if err != nil {
+        return nil, err
+    }
+    if tok.IDToken, err = s.idToken(user, client.ClientId, grant.Scope, grant.Nonce, grant.AuthTime); err != nil {
+        return nil, err
+    }
+    return tok, nil
+}
+
+func (s *service) refreshGrant(c context.Context, client *OAuthClient, args *TokenParams) (*OAuthToken, error) {
+    claims, err := s.parseRefresh(args.RefreshToken)
+    if err != nil {
+        return nil, oauthErr(OAuthInvalidGrant, "refresh_token is invalid")
+    }
+    refreshUuid, _ := claims[JwtRefreshUuid].(string)
+    userId, _ := claims[JwtUserId].(string)
+    clientId, _ := claims[JwtClientId].(string)
+    if refreshUuid == "" || userId == "" || clientId != client.ClientId {
+        return nil, oauthErr(OAuthInvalidGrant, "refresh_token is invalid")
+    }
+
+    user, err := s.LoadUser(c, userId)
+    if err != nil || statusError(user.Status) != nil {
+        return nil, oauthErr(OAuthInvalidGrant, "user can not authenticate")
+    }
+
+    td, err := s.ts.RefreshToken(user, claims)
+    if err != nil {
+        return nil, err
+    }
+    td.clientId = client.ClientId
+    err = s.RotateRefresh(c, refreshUuid, userId, td)
+    if errors.Is(err, ErrTokenReused) {
+        if err = s.revokeClientTokens(c, userId, client.ClientId); err != nil {
+            return nil, err
+        }
+        return nil, oauthErr(OAuthInvalidGrant, "refresh_token already used")
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    scope, _ := claims[JwtScope].(string)
+    tok := oauthToken(td, user.ID, scope)
+    if tok.IDToken, err = s.idToken(user, client.ClientId, scope, "", claimInt(claims, JwtAuthTime)); err != nil {
+        return nil, err
+    }
+    return tok, nil
+}
+
+// parseRefresh verify the signature and expiry of a refresh token, not that it is still stored
+func (s *service) parseRefresh(refreshToken string) (jwt.MapClaims, error) {
+    token, err := jwt.Parse(refreshToken, func(token *jwt.Token) (interface{}, error) {
+        if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+            return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+        }
+        return []byte(s.ts.RefreshSecret()), nil
+    })
+    if err != nil {
+        return nil, tokenErr(err)
+    }
+    claims, ok := token.Claims.(jwt.MapClaims)
+    if !ok || !token.Valid {
+        return nil, ErrTokenInvalid
+    }
+    return claims, nil
+}
+
+// issueOAuthToken a JWT pair carrying the scope and client id claims, also in session mode
+func (s *service) issueOAuthToken(c context.Context, user *User, clientId, scope string, authTime int64) (*OAuthToken, error) {
+    user.details = s.projectAttributes(user)
+    if user.details == nil {
+        user.details = map[string]interface{}{}
+    }
+    user.details[JwtScope] = scope
+    user.details[JwtClientId] = clientId
+    if authTime != 0 {
+        user.details[JwtAuthTime] = authTime
+    }
+
+    td, err := s.ts.CreateToken(user)
+    if err != nil {
+        return nil, err
+    }
+    td.clientId = clientId
+    if err = s.SaveAuth(c, user.ID, td); err != nil {
+        return nil, err
+    }
+    return oauthToken(td, user.ID, scope), nil
+}
+
+func oauthToken(td *TokenDetails, userId, scope string) *OAuthToken {
+    return &OAuthToken{
+        AccessToken:  td.AccessToken,
+        TokenType:    "Bearer",
+        ExpiresIn:    td.AtExpires - time.Now().Unix(),
+        RefreshToken: td.RefreshToken,
+        Scope:        scope,
+        userId:       userId,
+        details:      td,
+    }
+}
+
+// revokeClientTokens delete every token of the user issued to the client
+func (s *service) revokeClientTokens(c context.Context, userId, clientId string) error {
+    err := s.db.WithContext(c).Where("user_id = ? AND client_id = ?", userId, clientId).Delete(&AuthTokens{}).Error
+    return storeErr("revokeClientTokens", err)
+}
+
+// grantScopes the requested scopes, all allowed scopes when none are requested
+func grantScopes(allowed StringList, requested string) ([]string, bool) {
+    scopes := strings.Fields(requested)
+    if len(scopes) == 0 {
+        return allowed, true
+    }
+    for _, scope := range scopes {
+        if !allowed.Contains(scope) {
+            return nil, false
+        }
+    }
+    return scopes, true
+}
+
+func (s *service) hasConsent(c context.Context, userId, clientId string, scopes []string) bool {
+    consent := &OAuthConsent{}
+    if err := s.db.WithContext(c).Where("user_id = ? AND client_id = ?", userId, clientId).First(consent).Error; err != nil {
+        return false
+    }
+    granted := StringList(strings.Fields(consent.Scope))
+    for _, scope := range scopes {
+        if !granted.Contains(scope) {
+            return false
+        }
+    }
+    return true
+}
+
+// saveConsent add scopes to what the user already granted the client
+func (s *service) saveConsent(c context.Context, userId, clientId string, scopes []string) error {
+    return storeErr("saveConsent", s.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+        consent := &OAuthConsent{}
+        err := tx.Where("user_id = ? AND client_id = ?", userId, clientId).First(consent).Error
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            return tx.Create(&OAuthConsent{UserId: userId, ClientId: clientId, Scope: strings.Join(scopes, " ")}).Error
+        }
+        if err != nil {
+            return err
+        }
+        granted := StringList(strings.Fields(consent.Scope))
+        for _, scope := range scopes {
+            if !granted.Contains(scope) {
+                granted = append(granted, scope)
+            }
+        }
+        return tx.Model(consent).Update("scope", strings.Join(granted, " ")).Error
+    }))
+}
+
+// verifyPKCE S256 check of RFC 7636 section 4.6
+func verifyPKCE(verifier, challenge string) bool {
+    if len(verifier) < 43 || len(verifier) > 128 {
+        return false
+    }
+    sum := sha256.Sum256([]byte(verifier))
+    expected := base64.RawURLEncoding.EncodeToString(sum[:])
+    return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// withQuery add the non empty params to the query of base
+func withQuery(base string, params url.Values) string {
+    u, err := url.Parse(base)
+    if err != nil {
+        return base
+    }
+    q := u.Query()
+    for k, v := range params {
+        if len(v) > 0 && v[0] != "" {
+            q.Set(k, v[0])
+        }
+    }
+    u.RawQuery = q.Encode()
+    return u.String()
+}
@@ -0,0 +1,243 @@
+package authr
+
+import (
+    "errors"
+    "github.com/gin-gonic/gin"
+    "net/http"
+)
+
+// GinOAuthAdapter gin OAuth 2.0 authorization server endpoints
+type GinOAuthAdapter interface {
+    Authorize(c *gin.Context)
+    Token(c *gin.Context)
+    Introspect(c *gin.Context)
+    Revoke(c *gin.Context)
+    DeviceCode(c *gin.Context)
+    Device(c *gin.Context)
+    UserInfo(c *gin.Context)
+    Discovery(c *gin.Context)
+    JWKS(c *gin.Context)
+}
+
+func NewGinOAuthAdapter(s AuthService) GinOAuthAdapter {
+    return &ginOAuthAdapter{s: s}
+}
+
+type ginOAuthAdapter struct {
+    s AuthService
+}
+
+// Authorize GET answers with the consent prompt or redirects back with a code, the user answers the
+// prompt by POSTing the same parameters with `consent`. The user is identified like in any other
+// handler, so browser navigation needs WithCookies or WithSessions.
+func (g *ginOAuthAdapter) Authorize(c *gin.Context) {
+    metadata, err := g.s.Authorize(c.Request)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ginProblem(c, ErrImpersonated)
+        return
+    }
+    if err := c.Request.ParseForm(); err != nil {
+        c.JSON(http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "form is invalid"))
+        return
+    }
+
+    args := authorizeParams(c.Request.Form)
+    if c.Request.Method != http.MethodPost {
+        args.Consent = ""
+    }
+    res, err := g.s.AuthorizeCode(c.Request.Context(), metadata, args)
+    var oe *OAuthError
+    if errors.As(err, &oe) {
+        c.JSON(http.StatusBadRequest, oe)
+        return
+    }
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+
+    if args.Consent != "" {
+        g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditOAuthConsent, ActorId: metadata.UserId, TargetId: metadata.UserId, Detail: args.ClientId + " " + args.Consent})
+    }
+    if res.Consent != nil {
+        c.JSON(http.StatusOK, res.Consent)
+        return
+    }
+    c.Redirect(http.StatusFound, res.Redirect)
+}
+
+// Token form encoded token request, clients authenticate with HTTP Basic or client_secret in the body
+func (g *ginOAuthAdapter) Token(c *gin.Context) {
+    c.Header("Cache-Control", "no-store")
+    c.Header("Pragma", "no-cache")
+    if c.Request.Method != http.MethodPost {
+        c.JSON(http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "token requests must be POST"))
+        return
+    }
+    if err := c.Request.ParseForm(); err != nil {
+        c.JSON(http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "form is invalid"))
+        return
+    }
+
+    args := tokenParams(c.Request)
+    tok, err := g.s.ExchangeToken(c.Request.Context(), args)
+    if err != nil {
+        ginOAuthProblem(c, err)
+        return
+    }
+
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditOAuthToken, ActorId: tok.userId, TargetId: tok.userId, Detail: args.ClientId + " " + args.GrantType})
+    g.s.Reporter().Publish(&Event{Type: EventTokenGranted, Request: c.Request, UserId: tok.userId, Token: tok.details})
+    c.JSON(http.StatusOK, tok)
+}
+
+// DeviceCode RFC 8628 device authorization endpoint, clients authenticate like at the token endpoint
+func (g *ginOAuthAdapter) DeviceCode(c *gin.Context) {
+    c.Header("Cache-Control", "no-store")
+    if c.Request.Method != http.MethodPost {
+        c.JSON(http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "device authorization requests must be POST"))
+        return
+    }
+    if err := c.Request.ParseForm(); err != nil {
+        c.JSON(http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "form is invalid"))
+        return
+    }
+
+    client := tokenParams(c.Request)
+    res, err := g.s.AuthorizeDevice(c.Request.Context(), &DeviceAuthorizationParams{ClientId: client.ClientId, ClientSecret: client.ClientSecret, Scope: client.Scope})
+    if errors.Is(err, ErrNotConfigured) {
+        ginProblem(c, err)
+        return
+    }
+    if err != nil {
+        ginOAuthProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, res)
+}
+
+// Device verification handler, GET answers with the consent prompt for `user_code`, the user answers
+// it by POSTing the code with `consent`
+func (g *ginOAuthAdapter) Device(c *gin.Context) {
+    metadata, err := g.s.Authorize(c.Request)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ginProblem(c, ErrImpersonated)
+        return
+    }
+    if err := c.Request.ParseForm(); err != nil {
+        ginProblem(c, invalidf("form is invalid"))
+        return
+    }
+
+    args := &DeviceVerifyParams{UserCode: c.Request.Form.Get("user_code"), Consent: c.Request.Form.Get("consent")}
+    if c.Request.Method != http.MethodPost {
+        args.Consent = ""
+    }
+    prompt, err := g.s.VerifyDevice(c.Request.Context(), metadata, args)
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    if prompt != nil {
+        c.JSON(http.StatusOK, prompt)
+        return
+    }
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditOAuthConsent, ActorId: metadata.UserId, TargetId: metadata.UserId, Detail: "device " + args.Consent})
+    if args.Consent == "deny" {
+        c.JSON(http.StatusOK, "Device denied")
+        return
+    }
+    c.JSON(http.StatusOK, "Device approved")
+}
+
+// Introspect RFC 7662 token introspection for resource servers that can not validate tokens themselves
+func (g *ginOAuthAdapter) Introspect(c *gin.Context) {
+    c.Header("Cache-Control", "no-store")
+    if c.Request.Method != http.MethodPost {
+        c.JSON(http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "introspection requests must be POST"))
+        return
+    }
+    if err := c.Request.ParseForm(); err != nil {
+        c.JSON(http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "form is invalid"))
+        return
+    }
+
+    res, err := g.s.IntrospectToken(c.Request.Context(), lookupParams(c.Request))
+    if err != nil {
+        ginOAuthProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, res)
+}
+
+// Revoke RFC 7009 token revocation, answers 200 for tokens that are unknown or already revoked
+func (g *ginOAuthAdapter) Revoke(c *gin.Context) {
+    if c.Request.Method != http.MethodPost {
+        c.JSON(http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "revocation requests must be POST"))
+        return
+    }
+    if err := c.Request.ParseForm(); err != nil {
+        c.JSON(http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "form is invalid"))
+        return
+    }
+
+    args := lookupParams(c.Request)
+    if err := g.s.RevokeToken(c.Request.Context(), args); err != nil {
+        ginOAuthProblem(c, err)
+        return
+    }
+    g.s.Metrics().revocation(adapterGin, "revocation_endpoint")
+    g.s.RecordAudit(c.Request, &AuditEvent{Type: AuditSessionRevoke, ActorId: args.ClientId, Detail: "revocation endpoint"})
+    c.Status(http.StatusOK)
+}
+
+// ginOAuthProblem OAuth error response, failed client authentication adds the Basic challenge
+func ginOAuthProblem(c *gin.Context, err error) {
+    oe := toOAuthError(err)
+    if oe.Code == OAuthInvalidClient {
+        c.Header("WWW-Authenticate", `Basic realm="authr"`)
+    }
+    c.JSON(oe.Status(), oe)
+}
+
+// UserInfo OpenID Connect userinfo endpoint, needs an access token granted the openid scope
+func (g *ginOAuthAdapter) UserInfo(c *gin.Context) {
+    metadata, err := g.s.AuthorizeScopes(c.Request, ScopeOpenID)
+    if err == nil {
+        var claims map[string]interface{}
+        if claims, err = g.s.UserInfo(c.Request.Context(), metadata); err == nil {
+            c.JSON(http.StatusOK, claims)
+            return
+        }
+    }
+    c.Header("WWW-Authenticate", bearerChallenge(err))
+    ginProblem(c, err)
+}
+
+// Discovery serve at /.well-known/openid-configuration below the issuer
+func (g *ginOAuthAdapter) Discovery(c *gin.Context) {
+    doc, err := g.s.Discovery()
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, doc)
+}
+
+// JWKS public keys of the ID token signatures
+func (g *ginOAuthAdapter) JWKS(c *gin.Context) {
+    keys, err := g.s.JWKS()
+    if err != nil {
+        ginProblem(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, keys)
+}
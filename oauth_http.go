@@ -0,0 +1,304 @@
+package authr
+
+import (
+    "errors"
+    "net/http"
+    "net/url"
+)
+
+// HttpOAuthAdapter mux OAuth 2.0 authorization server endpoints
+type HttpOAuthAdapter interface {
+    Authorize(w http.ResponseWriter, r *http.Request)
+    Token(w http.ResponseWriter, r *http.Request)
+    Introspect(w http.ResponseWriter, r *http.Request)
+    Revoke(w http.ResponseWriter, r *http.Request)
+    DeviceCode(w http.ResponseWriter, r *http.Request)
+    Device(w http.ResponseWriter, r *http.Request)
+    UserInfo(w http.ResponseWriter, r *http.Request)
+    Discovery(w http.ResponseWriter, r *http.Request)
+    JWKS(w http.ResponseWriter, r *http.Request)
+}
+
+func NewHttpOAuthAdapter(s AuthService) HttpOAuthAdapter {
+    return &httpOAuthAdapter{s: s}
+}
+
+type httpOAuthAdapter struct {
+    s AuthService
+}
+
+// Authorize GET answers with the consent prompt or redirects back with a code, the user answers the
+// prompt by POSTing the same parameters with `consent`. The user is identified like in any other
+// handler, so browser navigation needs WithCookies or WithSessions.
+func (g *httpOAuthAdapter) Authorize(w http.ResponseWriter, r *http.Request) {
+    metadata, err := g.s.Authorize(r)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ProblemJSON(w, r, ErrImpersonated)
+        return
+    }
+    if err := r.ParseForm(); err != nil {
+        JSON(w, http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "form is invalid"))
+        return
+    }
+
+    args := authorizeParams(r.Form)
+    if r.Method != http.MethodPost {
+        args.Consent = ""
+    }
+    res, err := g.s.AuthorizeCode(r.Context(), metadata, args)
+    var oe *OAuthError
+    if errors.As(err, &oe) {
+        JSON(w, http.StatusBadRequest, oe)
+        return
+    }
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+
+    if args.Consent != "" {
+        g.s.RecordAudit(r, &AuditEvent{Type: AuditOAuthConsent, ActorId: metadata.UserId, TargetId: metadata.UserId, Detail: args.ClientId + " " + args.Consent})
+    }
+    if res.Consent != nil {
+        JSON(w, http.StatusOK, res.Consent)
+        return
+    }
+    http.Redirect(w, r, res.Redirect, http.StatusFound)
+}
+
+// Token form encoded token request, clients authenticate with HTTP Basic or client_secret in the body
+func (g *httpOAuthAdapter) Token(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Cache-Control", "no-store")
+    w.Header().Set("Pragma", "no-cache")
+    if r.Method != http.MethodPost {
+        JSON(w, http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "token requests must be POST"))
+        return
+    }
+    if err := r.ParseForm(); err != nil {
+        JSON(w, http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "form is invalid"))
+        return
+    }
+
+    args := tokenParams(r)
+    tok, err := g.s.ExchangeToken(r.Context(), args)
+    if err != nil {
+        oauthProblem(w, err)
+        return
+    }
+
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditOAuthToken, ActorId: tok.userId, TargetId: tok.userId, Detail: args.ClientId + " " + args.GrantType})
+    g.s.Reporter().Publish(&Event{Type: EventTokenGranted, Request: r, UserId: tok.userId, Token: tok.details})
+    JSON(w, http.StatusOK, tok)
+}
+
+// DeviceCode RFC 8628 device authorization endpoint, clients authenticate like at the token endpoint
+func (g *httpOAuthAdapter) DeviceCode(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Cache-Control", "no-store")
+    if r.Method != http.MethodPost {
+        JSON(w, http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "device authorization requests must be POST"))
+        return
+    }
+    if err := r.ParseForm(); err != nil {
+        JSON(w, http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "form is invalid"))
+        return
+    }
+
+    client := tokenParams(r)
+    res, err := g.s.AuthorizeDevice(r.Context(), &DeviceAuthorizationParams{ClientId: client.ClientId, ClientSecret: client.ClientSecret, Scope: client.Scope})
+    if errors.Is(err, ErrNotConfigured) {
+        ProblemJSON(w, r, err)
+        return
+    }
+    if err != nil {
+        oauthProblem(w, err)
+        return
+    }
+    JSON(w, http.StatusOK, res)
+}
+
+// Device verification handler, GET answers with the consent prompt for `user_code`, the user answers
+// it by POSTing the code with `consent`
+func (g *httpOAuthAdapter) Device(w http.ResponseWriter, r *http.Request) {
+    metadata, err := g.s.Authorize(r)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    if metadata.Impersonated() {
+        ProblemJSON(w, r, ErrImpersonated)
+        return
+    }
+    if err := r.ParseForm(); err != nil {
+        ProblemJSON(w, r, invalidf("form is invalid"))
+        return
+    }
+
+    args := &DeviceVerifyParams{UserCode: r.Form.Get("user_code"), Consent: r.Form.Get("consent")}
+    if r.Method != http.MethodPost {
+        args.Consent = ""
+    }
+    prompt, err := g.s.VerifyDevice(r.Context(), metadata, args)
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    if prompt != nil {
+        JSON(w, http.StatusOK, prompt)
+        return
+    }
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditOAuthConsent, ActorId: metadata.UserId, TargetId: metadata.UserId, Detail: "device " + args.Consent})
+    if args.Consent == "deny" {
+        JSON(w, http.StatusOK, "Device denied")
+        return
+    }
+    JSON(w, http.StatusOK, "Device approved")
+}
+
+// Introspect RFC 7662 token introspection for resource servers that can not validate tokens themselves
+func (g *httpOAuthAdapter) Introspect(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Cache-Control", "no-store")
+    if r.Method != http.MethodPost {
+        JSON(w, http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "introspection requests must be POST"))
+        return
+    }
+    if err := r.ParseForm(); err != nil {
+        JSON(w, http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "form is invalid"))
+        return
+    }
+
+    res, err := g.s.IntrospectToken(r.Context(), lookupParams(r))
+    if err != nil {
+        oauthProblem(w, err)
+        return
+    }
+    JSON(w, http.StatusOK, res)
+}
+
+// Revoke RFC 7009 token revocation, answers 200 for tokens that are unknown or already revoked
+func (g *httpOAuthAdapter) Revoke(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        JSON(w, http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "revocation requests must be POST"))
+        return
+    }
+    if err := r.ParseForm(); err != nil {
+        JSON(w, http.StatusBadRequest, oauthErr(OAuthInvalidRequest, "form is invalid"))
+        return
+    }
+
+    args := lookupParams(r)
+    if err := g.s.RevokeToken(r.Context(), args); err != nil {
+        oauthProblem(w, err)
+        return
+    }
+    g.s.Metrics().revocation(adapterHttp, "revocation_endpoint")
+    g.s.RecordAudit(r, &AuditEvent{Type: AuditSessionRevoke, ActorId: args.ClientId, Detail: "revocation endpoint"})
+    w.WriteHeader(http.StatusOK)
+}
+
+// oauthProblem OAuth error response, failed client authentication adds the Basic challenge
+func oauthProblem(w http.ResponseWriter, err error) {
+    oe := toOAuthError(err)
+    if oe.Code == OAuthInvalidClient {
+        w.Header().Set("WWW-Authenticate", `Basic realm="authr"`)
+    }
+    JSON(w, oe.Status(), oe)
+}
+
+// UserInfo OpenID Connect userinfo endpoint, needs an access token granted the openid scope
+func (g *httpOAuthAdapter) UserInfo(w http.ResponseWriter, r *http.Request) {
+    metadata, err := g.s.AuthorizeScopes(r, ScopeOpenID)
+    if err == nil {
+        var claims map[string]interface{}
+        if claims, err = g.s.UserInfo(r.Context(), metadata); err == nil {
+            JSON(w, http.StatusOK, claims)
+            return
+        }
+    }
+    w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+    ProblemJSON(w, r, err)
+}
+
+// Discovery serve at /.well-known/openid-configuration below the issuer
+func (g *httpOAuthAdapter) Discovery(w http.ResponseWriter, r *http.Request) {
+    doc, err := g.s.Discovery()
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    JSON(w, http.StatusOK, doc)
+}
+
+// JWKS public keys of the ID token signatures
+func (g *httpOAuthAdapter) JWKS(w http.ResponseWriter, r *http.Request) {
+    keys, err := g.s.JWKS()
+    if err != nil {
+        ProblemJSON(w, r, err)
+        return
+    }
+    JSON(w, http.StatusOK, keys)
+}
+
+// bearerChallenge WWW-Authenticate of a failed userinfo request, RFC 6750 section 3.1
+func bearerChallenge(err error) string {
+    switch {
+    case errors.Is(err, ErrInsufficientScope):
+        return `Bearer realm="authr", error="insufficient_scope", scope="openid"`
+    case errors.Is(err, ErrUnauthorized):
+        return `Bearer realm="authr"`
+    default:
+        return `Bearer realm="authr", error="invalid_token"`
+    }
+}
+
+func authorizeParams(v url.Values) *AuthorizeParams {
+    return &AuthorizeParams{
+        ResponseType:        v.Get("response_type"),
+        ClientId:            v.Get("client_id"),
+        RedirectURI:         v.Get("redirect_uri"),
+        Scope:               v.Get("scope"),
+        State:               v.Get("state"),
+        CodeChallenge:       v.Get("code_challenge"),
+        CodeChallengeMethod: v.Get("code_challenge_method"),
+        Nonce:               v.Get("nonce"),
+        Consent:             v.Get("consent"),
+    }
+}
+
+// tokenParams read a parsed token request, HTTP Basic credentials are form encoded (RFC 6749 section 2.3.1)
+func tokenParams(r *http.Request) *TokenParams {
+    args := &TokenParams{
+        GrantType:    r.PostForm.Get("grant_type"),
+        Code:         r.PostForm.Get("code"),
+        DeviceCode:   r.PostForm.Get("device_code"),
+        RedirectURI:  r.PostForm.Get("redirect_uri"),
+        ClientId:     r.PostForm.Get("client_id"),
+        ClientSecret: r.PostForm.Get("client_secret"),
+        CodeVerifier: r.PostForm.Get("code_verifier"),
+        RefreshToken: r.PostForm.Get("refresh_token"),
+        Scope:        r.PostForm.Get("scope"),
+    }
+    if id, secret, ok := r.BasicAuth(); ok {
+        if v, err := url.QueryUnescape(id); err == nil {
+            args.ClientId = v
+        }
+        if v, err := url.QueryUnescape(secret); err == nil {
+            args.ClientSecret = v
+        }
+    }
+    return args
+}
+
+// lookupParams read a parsed introspection or revocation request, the client authenticates like at the token endpoint
+func lookupParams(r *http.Request) *TokenLookupParams {
+    client := tokenParams(r)
+    return &TokenLookupParams{
+        Token:         r.PostForm.Get("token"),
+        TokenTypeHint: r.PostForm.Get("token_type_hint"),
+        ClientId:      client.ClientId,
+        ClientSecret:  client.ClientSecret,
+    }
+}
@@ -0,0 +1,188 @@
+package authr
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// oauthCode the OAuth error code of err, empty when it is not an OAuthError
+func oauthCode(err error) string {
+    var oe *OAuthError
+    if errors.As(err, &oe) {
+        return oe.Code
+    }
+    return ""
+}
+
+func TestCodeGrantPKCE(t *testing.T) {
+    tests := []struct {
+        name     string
+        verifier string
+        wantCode string
+    }{
+        {"matching verifier", testVerifier, ""},
+        {"wrong verifier", "x" + testVerifier[1:], OAuthInvalidGrant},
+        {"missing verifier", "", OAuthInvalidGrant},
+        {"short verifier", testVerifier[:42], OAuthInvalidGrant},
+        {"challenge as verifier", pkceChallenge(testVerifier), OAuthInvalidGrant},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := newTestService(t)
+            user := newTestUser(t, s, "ann", "secret")
+            client := newTestClient(t, s, "read")
+            args := codeParams(client, authorizeCode(t, s, user, client, "read"))
+            args.CodeVerifier = tt.verifier
+
+            tok, err := s.ExchangeToken(context.Background(), args)
+            if got := oauthCode(err); got != tt.wantCode || (tt.wantCode == "" && err != nil) {
+                t.Fatalf("ExchangeToken = %v, want code %q", err, tt.wantCode)
+            }
+            if tt.wantCode == "" && tok.AccessToken == "" {
+                t.Error("no access token issued")
+            }
+        })
+    }
+}
+
+func TestCodeGrantReplayRevokesTokens(t *testing.T) {
+    s := newTestService(t)
+    c := context.Background()
+    user := newTestUser(t, s, "ann", "secret")
+    client := newTestClient(t, s, "read")
+    args := codeParams(client, authorizeCode(t, s, user, client, "read"))
+
+    tok, err := s.ExchangeToken(c, args)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err = s.AuthorizeScopes(bearerRequest(tok.AccessToken), "read"); err != nil {
+        t.Fatalf("AuthorizeScopes = %v", err)
+    }
+
+    if _, err = s.ExchangeToken(c, args); oauthCode(err) != OAuthInvalidGrant {
+        t.Fatalf("replayed ExchangeToken = %v, want %s", err, OAuthInvalidGrant)
+    }
+    if _, err = s.AuthorizeScopes(bearerRequest(tok.AccessToken), "read"); !errors.Is(err, ErrTokenRevoked) {
+        t.Errorf("access token after replay = %v, want ErrTokenRevoked", err)
+    }
+    refresh := &TokenParams{GrantType: "refresh_token", RefreshToken: tok.RefreshToken, ClientId: client.ClientId, ClientSecret: client.ClientSecret}
+    if _, err = s.ExchangeToken(c, refresh); err == nil {
+        t.Error("refresh token still usable after replay")
+    }
+}
+
+func TestCodeGrantRejectsOtherClient(t *testing.T) {
+    s := newTestService(t)
+    user := newTestUser(t, s, "ann", "secret")
+    client := newTestClient(t, s, "read")
+    other := newTestClient(t, s, "read")
+
+    args := codeParams(other, authorizeCode(t, s, user, client, "read"))
+    if _, err := s.ExchangeToken(context.Background(), args); oauthCode(err) != OAuthInvalidGrant {
+        t.Errorf("ExchangeToken = %v, want %s", err, OAuthInvalidGrant)
+    }
+}
+
+func TestOAuthTokenScopes(t *testing.T) {
+    s := newTestService(t)
+    user := newTestUser(t, s, "ann", "secret")
+    client := newTestClient(t, s, "read", "write")
+    tok, err := s.ExchangeToken(context.Background(), codeParams(client, authorizeCode(t, s, user, client, "read")))
+    if err != nil {
+        t.Fatal(err)
+    }
+    session := newTestLogin(t, s, user)
+
+    tests := []struct {
+        name   string
+        token  string
+        scopes []string
+        first  bool
+        want   error
+    }{
+        {"oauth token on first party endpoint", tok.AccessToken, nil, true, ErrInsufficientScope},
+        {"oauth token with granted scope", tok.AccessToken, []string{"read"}, false, nil},
+        {"oauth token without scope", tok.AccessToken, []string{"write"}, false, ErrInsufficientScope},
+        {"oauth token on unscoped route", tok.AccessToken, nil, false, nil},
+        {"session on first party endpoint", session.AccessToken, nil, true, nil},
+        {"session on scoped route", session.AccessToken, []string{"write"}, false, nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var err error
+            if tt.first {
+                _, err = s.Authorize(bearerRequest(tt.token))
+            } else {
+                _, err = s.AuthorizeScopes(bearerRequest(tt.token), tt.scopes...)
+            }
+            if !errors.Is(err, tt.want) {
+                t.Errorf("got %v, want %v", err, tt.want)
+            }
+        })
+    }
+}
+
+func TestFirstPartyRefreshRejectsOAuthTokens(t *testing.T) {
+    s := newTestService(t)
+    user := newTestUser(t, s, "ann", "secret")
+    client := newTestClient(t, s, "read")
+    tok, err := s.ExchangeToken(context.Background(), codeParams(client, authorizeCode(t, s, user, client, "read")))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    w := httptest.NewRecorder()
+    r := httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(`{"refresh_token":"`+tok.RefreshToken+`"}`))
+    r.Header.Set("Content-Type", "application/json")
+    NewHttpAdapter(s).Refresh(w, r)
+    if w.Code != http.StatusUnauthorized {
+        t.Fatalf("Refresh status = %d, want %d: %s", w.Code, http.StatusUnauthorized, w.Body.String())
+    }
+
+    refresh := &TokenParams{GrantType: "refresh_token", RefreshToken: tok.RefreshToken, ClientId: client.ClientId}
+    if _, err = s.ExchangeToken(context.Background(), refresh); err != nil {
+        t.Errorf("refresh grant after refused refresh = %v", err)
+    }
+}
+
+func TestUserInfoChallenge(t *testing.T) {
+    s := newTestService(t, WithOIDC(OIDCConfig{Issuer: "https://authr.example.com", SigningKey: testRSAKey(t, 0)}))
+    user := newTestUser(t, s, "ann", "secret")
+    client := newTestClient(t, s, "read", ScopeOpenID)
+    read, err := s.ExchangeToken(context.Background(), codeParams(client, authorizeCode(t, s, user, client, "read")))
+    if err != nil {
+        t.Fatal(err)
+    }
+    openid, err := s.ExchangeToken(context.Background(), codeParams(client, authorizeCode(t, s, user, client, ScopeOpenID)))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name      string
+        token     string
+        want      int
+        challenge string
+    }{
+        {"openid token", openid.AccessToken, http.StatusOK, ""},
+        {"token without openid", read.AccessToken, http.StatusForbidden, `Bearer realm="authr", error="insufficient_scope", scope="openid"`},
+        {"forged token", "forged", http.StatusUnauthorized, `Bearer realm="authr", error="invalid_token"`},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            w := httptest.NewRecorder()
+            NewHttpOAuthAdapter(s).UserInfo(w, bearerRequest(tt.token))
+            if w.Code != tt.want {
+                t.Fatalf("UserInfo status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+            }
+            if got := w.Header().Get("WWW-Authenticate"); got != tt.challenge {
+                t.Errorf("WWW-Authenticate = %q, want %q", got, tt.challenge)
+            }
+        })
+    }
+}
@@ -0,0 +1,198 @@
+package authr
+
+import (
+    "context"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "github.com/dgrijalva/jwt-go"
+    "math/big"
+    "strings"
+    "time"
+)
+
+// ScopeOpenID the scope that turns an authorization request into an OpenID Connect request
+const ScopeOpenID = "openid"
+
+// OIDCConfig OpenID Connect provider on top of the OAuth 2.0 authorization server
+type OIDCConfig struct {
+    // Issuer https URL without trailing slash, the discovery document is served below it
+    Issuer string
+    // SigningKey RS256 key of the ID tokens, its public part is published at the JWKS endpoint
+    SigningKey *rsa.PrivateKey
+    // KeyId kid of the signing key, derived from the public key when empty
+    KeyId string
+    // IDTokenTTL defaults to an hour
+    IDTokenTTL time.Duration
+    // endpoints of the adapters, default to Issuer + /authorize, /token, /userinfo, /jwks, /introspect and /revoke
+    AuthorizationEndpoint string
+    TokenEndpoint         string
+    UserinfoEndpoint      string
+    JWKSURI               string
+    IntrospectionEndpoint string
+    RevocationEndpoint    string
+    // DeviceAuthorizationEndpoint defaults to Issuer + /device/code
+    DeviceAuthorizationEndpoint string
+}
+
+// WithOIDC issue ID tokens for requests with the openid scope and serve userinfo, discovery and JWKS
+func WithOIDC(cfg OIDCConfig) Option {
+    return func(s *service) {
+        cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+        if cfg.IDTokenTTL <= 0 {
+            cfg.IDTokenTTL = time.Hour
+        }
+        if cfg.KeyId == "" && cfg.SigningKey != nil {
+            der, _ := x509.MarshalPKIXPublicKey(&cfg.SigningKey.PublicKey)
+            sum := sha256.Sum256(der)
+            cfg.KeyId = base64.RawURLEncoding.EncodeToString(sum[:12])
+        }
+        if cfg.AuthorizationEndpoint == "" {
+            cfg.AuthorizationEndpoint = cfg.Issuer + "/authorize"
+        }
+        if cfg.TokenEndpoint == "" {
+            cfg.TokenEndpoint = cfg.Issuer + "/token"
+        }
+        if cfg.UserinfoEndpoint == "" {
+            cfg.UserinfoEndpoint = cfg.Issuer + "/userinfo"
+        }
+        if cfg.JWKSURI == "" {
+            cfg.JWKSURI = cfg.Issuer + "/jwks"
+        }
+        if cfg.IntrospectionEndpoint == "" {
+            cfg.IntrospectionEndpoint = cfg.Issuer + "/introspect"
+        }
+        if cfg.RevocationEndpoint == "" {
+            cfg.RevocationEndpoint = cfg.Issuer + "/revoke"
+        }
+        if cfg.DeviceAuthorizationEndpoint == "" {
+            cfg.DeviceAuthorizationEndpoint = cfg.Issuer + "/device/code"
+        }
+        s.oidc = &cfg
+    }
+}
+
+// OIDCService OpenID Connect provider, every call fails with ErrNotConfigured without WithOIDC
+type OIDCService interface {
+    UserInfo(c context.Context, session *AccessDetails) (map[string]interface{}, error)
+    Discovery() (*OIDCDiscovery, error)
+    JWKS() (*JSONWebKeySet, error)
+}
+
+// UserInfo claims of the user behind an access token that was granted the openid scope
+func (s *service) UserInfo(c context.Context, session *AccessDetails) (map[string]interface{}, error) {
+    if s.oidc == nil {
+        return nil, ErrNotConfigured
+    }
+    scope, _ := session.Claims[JwtScope].(string)
+    scopes := StringList(strings.Fields(scope))
+    if !scopes.Contains(ScopeOpenID) {
+        return nil, ErrInsufficientScope
+    }
+
+    user, err := s.LoadUser(c, session.UserId)
+    if err != nil {
+        return nil, err
+    }
+    return userClaims(user, scopes), nil
+}
+
+func (s *service) Discovery() (*OIDCDiscovery, error) {
+    if s.oidc == nil {
+        return nil, ErrNotConfigured
+    }
+    return &OIDCDiscovery{
+        Issuer:                            s.oidc.Issuer,
+        AuthorizationEndpoint:             s.oidc.AuthorizationEndpoint,
+        TokenEndpoint:                     s.oidc.TokenEndpoint,
+        UserinfoEndpoint:                  s.oidc.UserinfoEndpoint,
+        JWKSURI:                           s.oidc.JWKSURI,
+        IntrospectionEndpoint:             s.oidc.IntrospectionEndpoint,
+        RevocationEndpoint:                s.oidc.RevocationEndpoint,
+        DeviceAuthorizationEndpoint:       s.oidc.DeviceAuthorizationEndpoint,
+        ScopesSupported:                   []string{ScopeOpenID, "email", "profile"},
+        ResponseTypesSupported:            []string{"code"},
+        GrantTypesSupported:               []string{"authorization_code", "refresh_token", "client_credentials", GrantTypeDeviceCode},
+        SubjectTypesSupported:             []string{"public"},
+        IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+        TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+        CodeChallengeMethodsSupported:     []string{"S256"},
+        ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "email", "email_verified", "preferred_username"},
+    }, nil
+}
+
+func (s *service) JWKS() (*JSONWebKeySet, error) {
+    if s.oidc == nil {
+        return nil, ErrNotConfigured
+    }
+    pub := s.oidc.SigningKey.PublicKey
+    return &JSONWebKeySet{Keys: []JSONWebKey{{
+        Kty: "RSA",
+        Use: "sig",
+        Alg: "RS256",
+        Kid: s.oidc.KeyId,
+        N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+        E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+    }}}, nil
+}
+
+// idToken signed ID token for the client, "" unless OIDC is configured and scope includes openid
+func (s *service) idToken(user *User, clientId, scope, nonce string, authTime int64) (string, error) {
+    scopes := StringList(strings.Fields(scope))
+    if s.oidc == nil || !scopes.Contains(ScopeOpenID) {
+        return "", nil
+    }
+
+    now := time.Now()
+    claims := jwt.MapClaims{
+        "iss": s.oidc.Issuer,
+        "aud": clientId,
+        "azp": clientId,
+        "iat": now.Unix(),
+        "exp": now.Add(s.oidc.IDTokenTTL).Unix(),
+    }
+    if authTime != 0 {
+        claims[JwtAuthTime] = authTime
+    }
+    if nonce != "" {
+        claims["nonce"] = nonce
+    }
+    for k, v := range userClaims(user, scopes) {
+        claims[k] = v
+    }
+
+    token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+    token.Header["kid"] = s.oidc.KeyId
+    return token.SignedString(s.oidc.SigningKey)
+}
+
+// userClaims standard claims of the user released by the granted scopes
+func userClaims(user *User, scopes StringList) map[string]interface{} {
+    claims := map[string]interface{}{"sub": user.ID}
+    if scopes.Contains("email") {
+        claims["email"] = user.Email
+        claims["email_verified"] = user.EmailVerified
+    }
+    if scopes.Contains("profile") {
+        claims["preferred_username"] = user.Username
+    }
+    return claims
+}
+
+// claimInt numeric claim of a parsed JWT (float64) or of synthetic session claims
+func claimInt(claims map[string]interface{}, name string) int64 {
+    switch v := claims[name].(type) {
+    case float64:
+        return int64(v)
+    case int64:
+        return v
+    case int:
+        return int64(v)
+    case json.Number:
+        n, _ := v.Int64()
+        return n
+    }
+    return 0
+}
@@ -0,0 +1,172 @@
+package authr
+
+import (
+    "context"
+    "reflect"
+    "strings"
+)
+
+// reservedClaims can never be overwritten by user attributes
+var reservedClaims = map[string]bool{
+    JwtUserId:      true,
+    JwtAccessUuid:  true,
+    JwtRefreshUuid: true,
+    JwtExpires:     true,
+    JwtRole:        true,
+    JwtActor:       true,
+    JwtScope:       true,
+    JwtClientId:    true,
+    JwtAuthTime:    true,
+    JwtPrincipal:   true,
+    JwtAuthBackend: true,
+}
+
+// GetProfile load the profile of a user
+func (s *service) GetProfile(c context.Context, userId string) (*Profile, error) {
+    user, err := s.LoadUser(c, userId)
+    if err != nil {
+        return nil, err
+    }
+    return user.Profile(), nil
+}
+
+// UpdateProfile update username and attributes of a user, an email change is started if the email differs.
+// Attributes allow-listed by WithClaimAttributes can only be changed by admins, see SetAttributes.
+func (s *service) UpdateProfile(c context.Context, userId string, args *ProfileParams) (*Profile, error) {
+    if args == nil {
+        return nil, invalidf("profile params are invalid")
+    }
+
+    user, err := s.LoadUser(c, userId)
+    if err != nil {
+        return nil, err
+    }
+
+    if args.Username != nil && *args.Username != user.Username {
+        username := strings.TrimSpace(*args.Username)
+        if username == "" {
+            return nil, invalidf("username is invalid")
+        }
+
+        var count int64
+        if err = s.db.WithContext(c).Model(&User{}).Unscoped().Where("username = ? AND id <> ?", username, user.ID).Count(&count).Error; err != nil {
+            return nil, storeErr("UpdateProfile", err)
+        }
+        if count > 0 {
+            return nil, ErrUserExists
+        }
+        // the name of a directory user would shadow its login
+        if err = s.backendUsername(c, username); err != nil {
+            return nil, err
+        }
+        user.Username = username
+    }
+
+    // the email is only swapped once the new address is confirmed
+    var email string
+    if args.Email != nil && *args.Email != user.Email {
+        if email, err = s.newEmail(user, *args.Email); err != nil {
+            return nil, err
+        }
+    }
+
+    for k, v := range args.Attributes {
+        if s.claimAttribute(k) && !reflect.DeepEqual(user.Attributes[k], v) {
+            return nil, invalidf("attribute %q is managed by an administrator", k)
+        }
+    }
+    user.Attributes = mergeAttributes(user.Attributes, args.Attributes)
+
+    err = s.db.WithContext(c).Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+        "username":   user.Username,
+        "attributes": user.Attributes,
+    }).Error
+    if err != nil {
+        return nil, storeErr("UpdateProfile", err)
+    }
+    // mails go out once everything else was accepted
+    if email != "" {
+        if err = s.startEmailChange(c, user, email); err != nil {
+            return nil, err
+        }
+    }
+    return user.Profile(), nil
+}
+
+// ChangePassword set a new password after checking the current one
+func (s *service) ChangePassword(c context.Context, userId string, args *ChangePasswordParams) error {
+    if args == nil || args.CurrentPassword == "" || args.NewPassword == "" {
+        return invalidf("change password params are invalid")
+    }
+
+    user, err := s.LoadUser(c, userId)
+    if err != nil {
+        return err
+    }
+    if !s.checkPassword(c, args.CurrentPassword, user.Password) {
+        return ErrInvalidCredentials
+    }
+
+    hash, err := s.hashPassword(c, args.NewPassword)
+    if err != nil {
+        return err
+    }
+    return storeErr("ChangePassword", s.db.WithContext(c).Model(&User{}).Where("id = ?", user.ID).Update("password", hash).Error)
+}
+
+// claimAttribute the attribute is projected into the token claims, only admins may change it
+func (s *service) claimAttribute(name string) bool {
+    for _, claim := range s.claimAttributes {
+        if claim == name {
+            return true
+        }
+    }
+    return false
+}
+
+// mergeAttributes apply changes to attrs, a nil value removes the attribute
+func mergeAttributes(attrs Attributes, changes map[string]interface{}) Attributes {
+    if len(changes) == 0 {
+        return attrs
+    }
+    if attrs == nil {
+        attrs = Attributes{}
+    }
+    for k, v := range changes {
+        if v == nil {
+            delete(attrs, k)
+            continue
+        }
+        attrs[k] = v
+    }
+    return attrs
+}
+
+// projectAttributes returns the allow-listed attributes to be copied into the token claims
+func (s *service) projectAttributes(u *User) map[string]interface{} {
+    if len(s.claimAttributes) == 0 || len(u.Attributes) == 0 {
+        return nil
+    }
+
+    details := make(map[string]interface{})
+    for _, name := range s.claimAttributes {
+        if reservedClaims[name] {
+            continue
+        }
+        if v, ok := u.Attributes[name]; ok {
+            details[name] = v
+        }
+    }
+    return details
+}
+
+// Profile public view of the user
+func (u *User) Profile() *Profile {
+    return &Profile{
+        ID:         u.ID,
+        Username:   u.Username,
+        Email:      u.Email,
+        Roles:      splitRoles(u.Roles),
+        Attributes: u.Attributes,
+    }
+}
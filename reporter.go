@@ -0,0 +1,128 @@
+package authr
+
+import (
+    "net/http"
+    "sync"
+    "time"
+)
+
+// EventType kind of auth event published on the AuthReporter
+type EventType string
+
+const (
+    EventLoginSuccess       EventType = "login_success"
+    EventLoginFailure       EventType = "login_failure"
+    EventRegister           EventType = "register"
+    EventRefresh            EventType = "refresh"
+    EventLogout             EventType = "logout"
+    EventTokenGranted       EventType = "token_granted"
+    EventTokenRevoked       EventType = "token_revoked"
+    EventTokenReuse         EventType = "token_reuse"
+    // EventLockedLogin a login attempt on an account locked with SetStatus, authr never locks accounts itself
+    EventLockedLogin        EventType = "locked_login"
+    EventPasswordChange     EventType = "password_change"
+    EventProfileUpdate      EventType = "profile_update"
+    EventImpersonationStart EventType = "impersonation_start"
+    EventImpersonationStop  EventType = "impersonation_stop"
+)
+
+// Event published to the subscribers of an AuthReporter
+type Event struct {
+    Type     EventType
+    Time     time.Time
+    Request  *http.Request
+    UserId   string
+    ActorId  string
+    Username string
+    Reason   string
+    Token    *TokenDetails
+}
+
+// Subscriber receives events, it is called synchronously from the handler
+type Subscriber func(*Event)
+
+type LoginFailure func(*http.Request, string)
+type TokenGranted func(*http.Request, *TokenDetails)
+type TokenRevoked func(*http.Request, *TokenDetails)
+type ImpersonationEvent func(r *http.Request, actorId, targetId string)
+
+// AuthReporter event bus of the auth service, the zero value is ready to use
+type AuthReporter struct {
+    mu   sync.RWMutex
+    all  []Subscriber
+    subs map[EventType][]Subscriber
+}
+
+// NewAuthReporter create new event bus
+func NewAuthReporter() *AuthReporter {
+    return &AuthReporter{}
+}
+
+// Subscribe register fn for the given event types, or for every event when none are given
+func (a *AuthReporter) Subscribe(fn Subscriber, types ...EventType) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    if len(types) == 0 {
+        a.all = append(a.all, fn)
+        return
+    }
+    if a.subs == nil {
+        a.subs = make(map[EventType][]Subscriber)
+    }
+    for _, t := range types {
+        a.subs[t] = append(a.subs[t], fn)
+    }
+}
+
+// Publish deliver the event to every matching subscriber, safe on a nil reporter
+func (a *AuthReporter) Publish(ev *Event) {
+    if a == nil {
+        return
+    }
+    if ev.Time.IsZero() {
+        ev.Time = time.Now()
+    }
+
+    a.mu.RLock()
+    subs := make([]Subscriber, 0, len(a.all)+len(a.subs[ev.Type]))
+    subs = append(subs, a.subs[ev.Type]...)
+    subs = append(subs, a.all...)
+    a.mu.RUnlock()
+
+    for _, fn := range subs {
+        fn(ev)
+    }
+}
+
+// OnLoginFailure called with the username of every failed login
+func (a *AuthReporter) OnLoginFailure(fn LoginFailure) {
+    a.Subscribe(func(ev *Event) {
+        fn(ev.Request, ev.Username)
+    }, EventLoginFailure)
+}
+
+// OnTokenGranted called for every token pair issued
+func (a *AuthReporter) OnTokenGranted(fn TokenGranted) {
+    a.Subscribe(func(ev *Event) {
+        fn(ev.Request, ev.Token)
+    }, EventTokenGranted)
+}
+
+// OnTokenRevoked called for every token revoked, Token is nil when the whole session set of a user is revoked
+func (a *AuthReporter) OnTokenRevoked(fn TokenRevoked) {
+    a.Subscribe(func(ev *Event) {
+        fn(ev.Request, ev.Token)
+    }, EventTokenRevoked)
+}
+
+// OnImpersonation register callbacks for the start and stop of an impersonated session
+func (a *AuthReporter) OnImpersonation(start, stop ImpersonationEvent) {
+    a.Subscribe(func(ev *Event) {
+        if ev.Type == EventImpersonationStart {
+            start(ev.Request, ev.ActorId, ev.UserId)
+        } else {
+            stop(ev.Request, ev.ActorId, ev.UserId)
+        }
+    }, EventImpersonationStart, EventImpersonationStop)
+}
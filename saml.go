@@ -0,0 +1,243 @@
+package authr
+
+import (
+    "context"
+    "crypto/rsa"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/xml"
+    "fmt"
+    "github.com/russellhaering/gosaml2"
+    "github.com/russellhaering/goxmldsig"
+    "time"
+)
+
+// BackendSAML default SAMLConfig.Name, the Backend of the users provisioned by the identity provider of WithSAML
+const BackendSAML = "saml"
+
+// SAMLConfig SAML 2.0 service provider in front of one identity provider
+type SAMLConfig struct {
+    // Name provider of the linked identities and Backend of the provisioned users, defaults to "saml"
+    Name string
+    // EntityID of this service provider, defaults to MetadataURL
+    EntityID string
+    // MetadataURL and ACSURL endpoints of the adapters as reachable by the browser
+    MetadataURL string
+    ACSURL      string
+    // IDPEntityID issuer of the responses, IDPSSOURL its single sign on service
+    IDPEntityID string
+    IDPSSOURL   string
+    // IDPPostBinding send the AuthnRequest with the HTTP-POST binding instead of HTTP-Redirect
+    IDPPostBinding bool
+    // IDPCertificates verify the signatures, the response or every assertion must be signed by one of them
+    IDPCertificates []*x509.Certificate
+    // Key and Certificate of this service provider, when set AuthnRequests are signed and encrypted assertions accepted
+    Key         *rsa.PrivateKey
+    Certificate *x509.Certificate
+    // NameIDFormat requested from the identity provider, it chooses when empty. The NameID must be stable per user.
+    NameIDFormat string
+    // UsernameAttribute defaults to the NameID, EmailAttribute to email and GroupsAttribute to groups
+    UsernameAttribute string
+    EmailAttribute    string
+    GroupsAttribute   string
+    // GroupRoles role of a group value, keyed like MapRoles. The roles of provisioned users follow their groups on every login.
+    GroupRoles   map[string]string
+    DefaultRoles []string
+    // LinkByEmail sign in to the existing user with the same verified email, the identity provider is
+    // trusted to have verified its addresses
+    LinkByEmail bool
+}
+
+// WithSAML sign in with a SAML 2.0 identity provider, only logins started by BeginSAMLLogin are accepted
+func WithSAML(cfg SAMLConfig) Option {
+    return func(s *service) {
+        if cfg.Name == "" {
+            cfg.Name = BackendSAML
+        }
+        if cfg.EntityID == "" {
+            cfg.EntityID = cfg.MetadataURL
+        }
+        if cfg.EmailAttribute == "" {
+            cfg.EmailAttribute = "email"
+        }
+        if cfg.GroupsAttribute == "" {
+            cfg.GroupsAttribute = "groups"
+        }
+
+        sp := &saml2.SAMLServiceProvider{
+            IdentityProviderSSOURL:      cfg.IDPSSOURL,
+            IdentityProviderSSOBinding:  saml2.BindingHttpRedirect,
+            IdentityProviderIssuer:      cfg.IDPEntityID,
+            ServiceProviderIssuer:       cfg.EntityID,
+            AssertionConsumerServiceURL: cfg.ACSURL,
+            AudienceURI:                 cfg.EntityID,
+            IDPCertificateStore:         &dsig.MemoryX509CertificateStore{Roots: cfg.IDPCertificates},
+            NameIdFormat:                cfg.NameIDFormat,
+            AllowMissingAttributes:      true,
+        }
+        if cfg.IDPPostBinding {
+            sp.IdentityProviderSSOBinding = saml2.BindingHttpPost
+        }
+        if cfg.Key != nil && cfg.Certificate != nil {
+            sp.SPKeyStore = dsig.TLSCertKeyStore(tls.Certificate{Certificate: [][]byte{cfg.Certificate.Raw}, PrivateKey: cfg.Key})
+            sp.SignAuthnRequests = true
+        }
+        s.saml = &samlProvider{SAMLConfig: cfg, sp: sp}
+    }
+}
+
+// SAMLService SAML 2.0 service provider, every call fails with ErrNotConfigured without WithSAML
+type SAMLService interface {
+    SAMLMetadata() ([]byte, error)
+    BeginSAMLLogin(c context.Context) (*FederatedRedirect, error)
+    CompleteSAMLLogin(c context.Context, args *SAMLResponseParams) (*FederatedLoginResult, error)
+}
+
+type samlProvider struct {
+    SAMLConfig
+    sp *saml2.SAMLServiceProvider
+}
+
+func (p *samlProvider) validate() error {
+    if p.EntityID == "" || p.ACSURL == "" || p.IDPEntityID == "" || p.IDPSSOURL == "" {
+        return fmt.Errorf("%w: WithSAML needs the EntityID or MetadataURL, ACSURL, IDPEntityID and IDPSSOURL", ErrNotConfigured)
+    }
+    if len(p.IDPCertificates) == 0 {
+        return fmt.Errorf("%w: WithSAML needs the IDPCertificates", ErrNotConfigured)
+    }
+    return nil
+}
+
+// SAMLMetadata EntityDescriptor of this service provider for the identity provider
+func (s *service) SAMLMetadata() ([]byte, error) {
+    if s.saml == nil {
+        return nil, ErrNotConfigured
+    }
+    ed, err := s.saml.sp.Metadata()
+    if err != nil {
+        return nil, err
+    }
+    b, err := xml.MarshalIndent(ed, "", "  ")
+    if err != nil {
+        return nil, err
+    }
+    return append([]byte(xml.Header), b...), nil
+}
+
+// BeginSAMLLogin AuthnRequest for the identity provider, URL for the redirect binding or Form for the POST binding.
+// The adapters keep State in a cookie, it comes back as the RelayState.
+func (s *service) BeginSAMLLogin(c context.Context) (*FederatedRedirect, error) {
+    if s.saml == nil {
+        return nil, ErrNotConfigured
+    }
+    p := s.saml
+
+    post := p.sp.IdentityProviderSSOBinding == saml2.BindingHttpPost
+    // the redirect binding signs the query instead of the document
+    doc, err := p.sp.BuildAuthRequestDocumentNoSig()
+    if post {
+        doc, err = p.sp.BuildAuthRequestDocument()
+    }
+    if err != nil {
+        return nil, err
+    }
+    state, err := randomToken()
+    if err != nil {
+        return nil, err
+    }
+    err = s.db.WithContext(c).Create(&FederatedLogin{
+        StateHash: hashToken(state),
+        Provider:  p.Name,
+        // the response must answer this request, unsolicited responses are refused
+        Nonce:   doc.Root().SelectAttrValue("ID", ""),
+        Expires: time.Now().Add(federatedLoginTTL),
+    }).Error
+    if err != nil {
+        return nil, storeErr("BeginSAMLLogin", err)
+    }
+
+    redirect := &FederatedRedirect{State: state}
+    if post {
+        redirect.Form, err = p.sp.BuildAuthBodyPostFromDocument(state, doc)
+    } else {
+        redirect.URL, err = p.sp.BuildAuthURLRedirect(state, doc)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return redirect, nil
+}
+
+// CompleteSAMLLogin verify the response posted to the ACS and resolve the user behind its NameID
+func (s *service) CompleteSAMLLogin(c context.Context, args *SAMLResponseParams) (*FederatedLoginResult, error) {
+    if s.saml == nil {
+        return nil, ErrNotConfigured
+    }
+    p := s.saml
+
+    login, err := s.consumeFederatedLogin(c, p.Name, args.RelayState, args.BrowserState)
+    if err != nil {
+        return nil, err
+    }
+    if args.SAMLResponse == "" {
+        return nil, invalidf("SAMLResponse is required")
+    }
+
+    // signature, issuer, destination, recipient, status and validity window
+    info, err := p.sp.RetrieveAssertionInfo(args.SAMLResponse)
+    if err != nil {
+        s.log.Info("CompleteSAMLLogin invalid response", "err", err)
+        return nil, fmt.Errorf("%w: saml response: %v", ErrProvider, err)
+    }
+    if info.WarningInfo.InvalidTime || info.WarningInfo.NotInAudience {
+        return nil, fmt.Errorf("%w: saml assertion is expired or for another audience", ErrProvider)
+    }
+    for _, assertion := range info.Assertions {
+        confirmation := assertion.Subject.SubjectConfirmation.SubjectConfirmationData
+        if confirmation.InResponseTo != login.Nonce {
+            return nil, fmt.Errorf("%w: saml assertion does not answer the request", ErrProvider)
+        }
+    }
+    if info.NameID == "" {
+        return nil, fmt.Errorf("%w: saml assertion has no NameID", ErrProvider)
+    }
+
+    username := info.NameID
+    if p.UsernameAttribute != "" {
+        username = info.Values.Get(p.UsernameAttribute)
+    }
+    email := info.Values.Get(p.EmailAttribute)
+    claims := map[string]interface{}{"username": username, "email": email, "email_verified": email != ""}
+    fp := &federatedProvider{FederatedProvider: FederatedProvider{
+        Name:               p.Name,
+        EmailClaim:         "email",
+        EmailVerifiedClaim: "email_verified",
+        UsernameClaim:      "username",
+        LinkByEmail:        p.LinkByEmail,
+    }}
+    result, err := s.federatedUser(c, fp, "", info.NameID, claims)
+    if err != nil {
+        return nil, err
+    }
+
+    user := result.User
+    // an inactive user keeps the roles it had
+    if err = statusError(user.Status); err != nil {
+        return nil, err
+    }
+    if result.Created || user.Backend == p.Name {
+        roles, err := joinRoles(mapRoles(info.Values.GetAll(p.GroupsAttribute), p.GroupRoles, p.DefaultRoles))
+        if err != nil {
+            return nil, err
+        }
+        user.Backend = p.Name
+        user.Roles = roles
+        err = s.db.WithContext(c).Model(&User{}).Where("id = ?", user.ID).
+            Updates(map[string]interface{}{"backend": user.Backend, "roles": user.Roles}).Error
+        if err != nil {
+            return nil, storeErr("CompleteSAMLLogin", err)
+        }
+    }
+    user.authBackend = "federated:" + p.Name
+    return result, nil
+}
@@ -0,0 +1,269 @@
+package authr
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "github.com/beevik/etree"
+    "github.com/russellhaering/goxmldsig"
+    "math/big"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+const (
+    testSPEntityID  = "https://sp.example.com/saml/metadata"
+    testACSURL      = "https://sp.example.com/saml/acs"
+    testIDPEntityID = "https://idp.example.com"
+)
+
+var (
+    testCertsMu sync.Mutex
+    testCerts   [2]*x509.Certificate
+)
+
+// testCertificate self signed certificate of testRSAKey i, the same certificate on every call so the one
+// the service trusts matches the one that signs
+func testCertificate(t *testing.T, i int) *x509.Certificate {
+    t.Helper()
+    testCertsMu.Lock()
+    defer testCertsMu.Unlock()
+    if testCerts[i] != nil {
+        return testCerts[i]
+    }
+    key := testRSAKey(t, i)
+    tmpl := &x509.Certificate{
+        SerialNumber: big.NewInt(int64(i + 1)),
+        Subject:      pkix.Name{CommonName: "idp.example.com"},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if testCerts[i], err = x509.ParseCertificate(der); err != nil {
+        t.Fatal(err)
+    }
+    return testCerts[i]
+}
+
+// testSAMLConfig service provider trusting the certificate of testRSAKey 0
+func testSAMLConfig(t *testing.T) SAMLConfig {
+    return SAMLConfig{
+        MetadataURL:     testSPEntityID,
+        ACSURL:          testACSURL,
+        IDPEntityID:     testIDPEntityID,
+        IDPSSOURL:       testIDPEntityID + "/sso",
+        IDPCertificates: []*x509.Certificate{testCertificate(t, 0)},
+        GroupRoles:      map[string]string{"admins": "ROLE_ADMIN"},
+        DefaultRoles:    []string{"ROLE_USER"},
+    }
+}
+
+// samlAssertion a response of the identity provider, signed by the certificate of testRSAKey signer
+type samlAssertion struct {
+    inResponseTo string
+    audience     string
+    notOnOrAfter time.Time
+    signer       int
+    // tamper change the NameID after signing
+    tamper bool
+}
+
+// encode the base64 SAMLResponse form value
+func (a samlAssertion) encode(t *testing.T) string {
+    t.Helper()
+    now := time.Now().UTC()
+    stamp := func(t time.Time) string { return t.UTC().Format(time.RFC3339) }
+    inResponseTo := ""
+    if a.inResponseTo != "" {
+        inResponseTo = fmt.Sprintf(` InResponseTo="%s"`, a.inResponseTo)
+    }
+
+    raw := fmt.Sprintf(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_response" Version="2.0" IssueInstant="%[1]s" Destination="%[2]s"%[3]s>
+<saml:Issuer>%[4]s</saml:Issuer>
+<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>
+<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_assertion" Version="2.0" IssueInstant="%[1]s">
+<saml:Issuer>%[4]s</saml:Issuer>
+<saml:Subject>
+<saml:NameID>ann@idp.example.com</saml:NameID>
+<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+<saml:SubjectConfirmationData%[3]s Recipient="%[2]s" NotOnOrAfter="%[5]s"/>
+</saml:SubjectConfirmation>
+</saml:Subject>
+<saml:Conditions NotBefore="%[6]s" NotOnOrAfter="%[7]s">
+<saml:AudienceRestriction><saml:Audience>%[8]s</saml:Audience></saml:AudienceRestriction>
+</saml:Conditions>
+<saml:AuthnStatement AuthnInstant="%[1]s" SessionIndex="_session"/>
+<saml:AttributeStatement>
+<saml:Attribute Name="email"><saml:AttributeValue>ann@example.com</saml:AttributeValue></saml:Attribute>
+<saml:Attribute Name="groups"><saml:AttributeValue>admins</saml:AttributeValue><saml:AttributeValue>staff</saml:AttributeValue></saml:Attribute>
+</saml:AttributeStatement>
+</saml:Assertion>
+</samlp:Response>`, stamp(now), testACSURL, inResponseTo, testIDPEntityID, stamp(now.Add(time.Minute*5)),
+        stamp(now.Add(-time.Minute)), stamp(a.notOnOrAfter), a.audience)
+
+    doc := etree.NewDocument()
+    if err := doc.ReadFromString(raw); err != nil {
+        t.Fatal(err)
+    }
+    assertion := doc.Root().SelectElement("Assertion")
+    ctx := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(tls.Certificate{
+        Certificate: [][]byte{testCertificate(t, a.signer).Raw},
+        PrivateKey:  testRSAKey(t, a.signer),
+    }))
+    ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+    signed, err := ctx.SignEnveloped(assertion)
+    if err != nil {
+        t.Fatal(err)
+    }
+    doc.Root().RemoveChild(assertion)
+    doc.Root().AddChild(signed)
+    if a.tamper {
+        signed.FindElement("./Subject/NameID").SetText("admin@idp.example.com")
+    }
+
+    out, err := doc.WriteToString()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return base64.StdEncoding.EncodeToString([]byte(out))
+}
+
+// beginSAML start a login, the state cookie value and the ID of the AuthnRequest
+func beginSAML(t *testing.T, s *service) (string, string) {
+    t.Helper()
+    redirect, err := s.BeginSAMLLogin(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    login := &FederatedLogin{}
+    if err = s.db.Where("state_hash = ?", hashToken(redirect.State)).First(login).Error; err != nil {
+        t.Fatal(err)
+    }
+    return redirect.State, login.Nonce
+}
+
+func TestCompleteSAMLLogin(t *testing.T) {
+    tests := []struct {
+        name      string
+        assertion func(requestId string) samlAssertion
+        wantErr   error
+    }{
+        {"valid", func(id string) samlAssertion {
+            return samlAssertion{inResponseTo: id, audience: testSPEntityID, notOnOrAfter: time.Now().Add(time.Minute * 5)}
+        }, nil},
+        {"signed by an untrusted key", func(id string) samlAssertion {
+            return samlAssertion{inResponseTo: id, audience: testSPEntityID, notOnOrAfter: time.Now().Add(time.Minute * 5), signer: 1}
+        }, ErrProvider},
+        {"tampered after signing", func(id string) samlAssertion {
+            return samlAssertion{inResponseTo: id, audience: testSPEntityID, notOnOrAfter: time.Now().Add(time.Minute * 5), tamper: true}
+        }, ErrProvider},
+        {"another audience", func(id string) samlAssertion {
+            return samlAssertion{inResponseTo: id, audience: "https://other.example.com", notOnOrAfter: time.Now().Add(time.Minute * 5)}
+        }, ErrProvider},
+        {"expired", func(id string) samlAssertion {
+            return samlAssertion{inResponseTo: id, audience: testSPEntityID, notOnOrAfter: time.Now().Add(-time.Minute)}
+        }, ErrProvider},
+        {"answers another request", func(id string) samlAssertion {
+            return samlAssertion{inResponseTo: "_other", audience: testSPEntityID, notOnOrAfter: time.Now().Add(time.Minute * 5)}
+        }, ErrProvider},
+        {"unsolicited", func(id string) samlAssertion {
+            return samlAssertion{audience: testSPEntityID, notOnOrAfter: time.Now().Add(time.Minute * 5)}
+        }, ErrProvider},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := newTestService(t, WithSAML(testSAMLConfig(t)))
+            state, requestId := beginSAML(t, s)
+
+            result, err := s.CompleteSAMLLogin(context.Background(), &SAMLResponseParams{
+                SAMLResponse: tt.assertion(requestId).encode(t),
+                RelayState:   state,
+                BrowserState: state,
+            })
+            if !errors.Is(err, tt.wantErr) {
+                t.Fatalf("CompleteSAMLLogin = %v, want %v", err, tt.wantErr)
+            }
+            if err != nil {
+                return
+            }
+            user := result.User
+            if !result.Created || user.Backend != BackendSAML || user.Email != "ann@example.com" {
+                t.Errorf("user = %+v, want a provisioned saml user", user)
+            }
+            if roles := strings.Split(user.Roles, ","); len(roles) != 2 || roles[0] != "ROLE_USER" || roles[1] != "ROLE_ADMIN" {
+                t.Errorf("roles = %q, want ROLE_USER,ROLE_ADMIN", user.Roles)
+            }
+        })
+    }
+}
+
+func TestCompleteSAMLLoginState(t *testing.T) {
+    tests := []struct {
+        name    string
+        state   func(state string) (string, string)
+        replay  bool
+        wantErr error
+    }{
+        {"relay state mismatch", func(s string) (string, string) { return s, "other" }, false, ErrCSRF},
+        {"no browser state", func(s string) (string, string) { return s, "" }, false, ErrCSRF},
+        {"no relay state", func(s string) (string, string) { return "", s }, false, ErrCSRF},
+        {"unknown state", func(s string) (string, string) { return "forged", "forged" }, false, ErrInvalidRequest},
+        {"replayed response", func(s string) (string, string) { return s, s }, true, ErrInvalidRequest},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := newTestService(t, WithSAML(testSAMLConfig(t)))
+            state, requestId := beginSAML(t, s)
+            relay, browser := tt.state(state)
+            args := &SAMLResponseParams{
+                SAMLResponse: samlAssertion{inResponseTo: requestId, audience: testSPEntityID, notOnOrAfter: time.Now().Add(time.Minute * 5)}.encode(t),
+                RelayState:   relay,
+                BrowserState: browser,
+            }
+            if tt.replay {
+                if _, err := s.CompleteSAMLLogin(context.Background(), args); err != nil {
+                    t.Fatal(err)
+                }
+            }
+
+            if _, err := s.CompleteSAMLLogin(context.Background(), args); !errors.Is(err, tt.wantErr) {
+                t.Errorf("CompleteSAMLLogin = %v, want %v", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestCompleteSAMLLoginProviderName(t *testing.T) {
+    cfg := testSAMLConfig(t)
+    cfg.Name = "okta"
+    s := newTestService(t, WithSAML(cfg))
+    c := context.Background()
+
+    for i := 0; i < 2; i++ {
+        state, requestId := beginSAML(t, s)
+        result, err := s.CompleteSAMLLogin(c, &SAMLResponseParams{
+            SAMLResponse: samlAssertion{inResponseTo: requestId, audience: testSPEntityID, notOnOrAfter: time.Now().Add(time.Minute * 5)}.encode(t),
+            RelayState:   state,
+            BrowserState: state,
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+        if result.User.Backend != "okta" || result.Identity.Provider != "okta" {
+            t.Errorf("login %d: backend %q provider %q, want okta", i, result.User.Backend, result.Identity.Provider)
+        }
+        if result.Created != (i == 0) {
+            t.Errorf("login %d: Created = %v", i, result.Created)
+        }
+    }
+}
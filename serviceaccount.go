@@ -0,0 +1,139 @@
+package authr
+
+import (
+    "context"
+    "errors"
+    "github.com/twinj/uuid"
+    "gorm.io/gorm"
+    "strings"
+)
+
+// ServiceAccountService machine principals for backend jobs, they obtain access tokens from the
+// client_credentials grant of ExchangeToken and never get a refresh token
+type ServiceAccountService interface {
+    CreateServiceAccount(c context.Context, args *ServiceAccountParams) (*ServiceAccountRegistration, error)
+    ListServiceAccounts(c context.Context) ([]*ServiceAccount, error)
+    RotateServiceAccountSecret(c context.Context, clientId string) (*ServiceAccountRegistration, error)
+    DeleteServiceAccount(c context.Context, clientId string) error
+}
+
+// CreateServiceAccount the secret is hashed like a password and only returned here
+func (s *service) CreateServiceAccount(c context.Context, args *ServiceAccountParams) (*ServiceAccountRegistration, error) {
+    if args == nil || strings.TrimSpace(args.Name) == "" {
+        return nil, invalidf("service account params are invalid")
+    }
+    roles, err := joinRoles(args.Roles)
+    if err != nil {
+        return nil, err
+    }
+
+    account := &ServiceAccount{
+        ClientId: uuid.NewV4().String(),
+        Name:     strings.TrimSpace(args.Name),
+        Roles:    roles,
+        Scopes:   args.Scopes,
+    }
+    secret, err := randomToken()
+    if err != nil {
+        return nil, err
+    }
+    if account.SecretHash, err = s.hashPassword(c, secret); err != nil {
+        return nil, err
+    }
+
+    if err = s.db.WithContext(c).Create(account).Error; err != nil {
+        return nil, storeErr("CreateServiceAccount", err)
+    }
+    return &ServiceAccountRegistration{ServiceAccount: account, ClientSecret: secret}, nil
+}
+
+func (s *service) ListServiceAccounts(c context.Context) ([]*ServiceAccount, error) {
+    var accounts []*ServiceAccount
+    if err := s.db.WithContext(c).Order("name").Find(&accounts).Error; err != nil {
+        return nil, storeErr("ListServiceAccounts", err)
+    }
+    return accounts, nil
+}
+
+// RotateServiceAccountSecret replace the secret, tokens issued with the old one stay valid until they expire
+func (s *service) RotateServiceAccountSecret(c context.Context, clientId string) (*ServiceAccountRegistration, error) {
+    account, err := s.loadServiceAccount(c, clientId)
+    if err != nil {
+        return nil, err
+    }
+    secret, err := randomToken()
+    if err != nil {
+        return nil, err
+    }
+    if account.SecretHash, err = s.hashPassword(c, secret); err != nil {
+        return nil, err
+    }
+    if err = s.db.WithContext(c).Model(account).Update("secret_hash", account.SecretHash).Error; err != nil {
+        return nil, storeErr("RotateServiceAccountSecret", err)
+    }
+    return &ServiceAccountRegistration{ServiceAccount: account, ClientSecret: secret}, nil
+}
+
+// DeleteServiceAccount remove the account and revoke its tokens
+func (s *service) DeleteServiceAccount(c context.Context, clientId string) error {
+    account, err := s.loadServiceAccount(c, clientId)
+    if err != nil {
+        return err
+    }
+    return storeErr("DeleteServiceAccount", s.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+        if err := s.revokeUserTokens(tx, account.ClientId); err != nil {
+            return err
+        }
+        return tx.Delete(account).Error
+    }))
+}
+
+func (s *service) loadServiceAccount(c context.Context, clientId string) (*ServiceAccount, error) {
+    if clientId == "" {
+        return nil, ErrNotFound
+    }
+    account := &ServiceAccount{}
+    if err := s.db.WithContext(c).Where("client_id = ?", clientId).First(account).Error; err != nil {
+        return nil, storeErr("loadServiceAccount", err)
+    }
+    return account, nil
+}
+
+// clientCredentialsGrant RFC 6749 section 4.4, an access token for the service account itself
+func (s *service) clientCredentialsGrant(c context.Context, args *TokenParams) (*OAuthToken, error) {
+    account, err := s.loadServiceAccount(c, args.ClientId)
+    if err != nil && !errors.Is(err, ErrNotFound) {
+        return nil, err
+    }
+    if account == nil || args.ClientSecret == "" || !s.checkPassword(c, args.ClientSecret, account.SecretHash) {
+        return nil, oauthErr(OAuthInvalidClient, "client authentication failed")
+    }
+    scopes, ok := grantScopes(account.Scopes, args.Scope)
+    if !ok {
+        return nil, oauthErr(OAuthInvalidScope, "scope is not allowed for this service account")
+    }
+    scope := strings.Join(scopes, " ")
+
+    principal := &User{
+        ID:       account.ClientId,
+        Username: account.Name,
+        Roles:    account.Roles,
+        details: map[string]interface{}{
+            JwtPrincipal: string(PrincipalService),
+            JwtScope:     scope,
+            JwtClientId:  account.ClientId,
+        },
+    }
+    td, err := s.ts.CreateToken(principal)
+    if err != nil {
+        return nil, err
+    }
+    // access token only, the refresh token is never stored so it could not be redeemed anyway
+    td.RefreshToken = ""
+    td.RefreshUuid = ""
+    td.clientId = account.ClientId
+    if err = s.SaveAuth(c, account.ClientId, td); err != nil {
+        return nil, err
+    }
+    return oauthToken(td, account.ClientId, scope), nil
+}
@@ -0,0 +1,142 @@
+package authr
+
+import (
+    "errors"
+    "github.com/dgrijalva/jwt-go"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// tokenTypeSession AuthTokens.TokenType of a server side session, 0 and 1 are access and refresh tokens
+const tokenTypeSession uint = 2
+
+// SessionConfig server side session mode, zero durations take the defaults of WithSessions
+type SessionConfig struct {
+    // IdleTimeout sliding expiry, extended on every authenticated request
+    IdleTimeout time.Duration
+    // MaxLifetime absolute expiry regardless of activity
+    MaxLifetime time.Duration
+}
+
+// WithSessions replace JWTs by opaque random session ids kept in the token store. Login, Register and
+// Logout keep working unchanged, the session id travels in the access cookie of WithCookies, which is
+// enabled with its defaults when not given.
+func WithSessions(cfg SessionConfig) Option {
+    return func(s *service) {
+        if cfg.IdleTimeout <= 0 {
+            cfg.IdleTimeout = time.Minute * 30
+        }
+        if cfg.MaxLifetime <= 0 {
+            cfg.MaxLifetime = time.Hour * 24 * 7
+        }
+        s.sessions = &cfg
+    }
+}
+
+// newSession the session id is returned as the access token, only its hash is stored.
+// RtExpires carries the absolute expiry, there is no refresh token.
+func (s *service) newSession(u *User) (*TokenDetails, error) {
+    id, err := randomToken()
+    if err != nil {
+        return nil, err
+    }
+
+    now := time.Now()
+    td := &TokenDetails{
+        ID:          u.ID,
+        Username:    u.Username,
+        Email:       u.Email,
+        Roles:       splitRoles(u.Roles),
+        AccessToken: id,
+        TokenUuid:   hashToken(id),
+        AtExpires:   now.Add(s.sessions.IdleTimeout).Unix(),
+        RtExpires:   now.Add(s.sessions.MaxLifetime).Unix(),
+        session:     true,
+    }
+    if act, ok := u.details[JwtActor].(map[string]interface{}); ok {
+        td.actorId, _ = act["sub"].(string)
+    }
+    return td, nil
+}
+
+// sessionRequest the token of the request is a session id. OAuth clients and service accounts are
+// issued JWTs in session mode too, those still take the JWT path.
+func (s *service) sessionRequest(r *http.Request) bool {
+    if s.sessions == nil {
+        return false
+    }
+    token, err := s.requestExtractors(r).ExtractToken(r)
+    return err != nil || strings.Count(token, ".") != 2
+}
+
+// sessionMetadata resolve the session id of the request to the user and slide its expiry
+func (s *service) sessionMetadata(r *http.Request) (*AccessDetails, error) {
+    id, err := s.requestExtractors(r).ExtractToken(r)
+    if err != nil {
+        return nil, err
+    }
+    if id == "" {
+        return nil, ErrUnauthorized
+    }
+
+    info, err := s.FetchAuth(r.Context(), hashToken(id))
+    if errors.Is(err, ErrNotFound) {
+        return nil, ErrTokenInvalid
+    }
+    if err != nil {
+        return nil, err
+    }
+    if info.TokenType != tokenTypeSession {
+        return nil, ErrTokenInvalid
+    }
+
+    now := time.Now()
+    end := info.CreatedAt.Add(s.sessions.MaxLifetime)
+    if now.After(end) {
+        return nil, ErrTokenExpired
+    }
+    // at most one write a minute per session
+    if expires := now.Add(s.sessions.IdleTimeout); expires.Sub(info.Expires) > time.Minute {
+        if expires.After(end) {
+            expires = end
+        }
+        err = s.db.WithContext(r.Context()).Model(&AuthTokens{}).Where("id = ?", info.ID).Update("expires", expires).Error
+        if err != nil {
+            return nil, storeErr("sessionMetadata", err)
+        }
+        info.Expires = expires
+    }
+
+    user, err := s.LoadUser(r.Context(), info.UserId)
+    if err != nil {
+        return nil, err
+    }
+
+    // the claims a JWT of the same user would carry
+    claims := jwt.MapClaims{
+        JwtAccessUuid: info.TokenUuid,
+        JwtUserId:     user.ID,
+        JwtRole:       user.Roles,
+        JwtExpires:    info.Expires.Unix(),
+        JwtAuthTime:   info.CreatedAt.Unix(),
+    }
+    for k, v := range s.projectAttributes(user) {
+        claims[k] = v
+    }
+    if info.ActorId != "" {
+        claims[JwtActor] = map[string]interface{}{"sub": info.ActorId}
+    }
+    if info.Backend != "" {
+        claims[JwtAuthBackend] = info.Backend
+    }
+
+    return &AccessDetails{
+        TokenUuid: info.TokenUuid,
+        UserId:    user.ID,
+        Role:      user.Roles,
+        ActorId:   info.ActorId,
+        Principal: PrincipalUser,
+        Claims:    claims,
+    }, nil
+}
@@ -0,0 +1,72 @@
+package authr
+
+import (
+    "context"
+    "errors"
+    "testing"
+)
+
+func TestSessionModeAcceptsOAuthTokens(t *testing.T) {
+    s := newTestService(t, WithSessions(SessionConfig{}))
+    c := context.Background()
+    user := newTestUser(t, s, "ann", "secret")
+    client := newTestClient(t, s, "read")
+
+    session := newTestLogin(t, s, user)
+    tok, err := s.ExchangeToken(c, codeParams(client, authorizeCode(t, s, user, client, "read")))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name      string
+        token     string
+        tokenUuid string
+        tokenType uint
+        clientId  string
+    }{
+        {"session id", session.AccessToken, session.TokenUuid, tokenTypeSession, ""},
+        {"oauth access token", tok.AccessToken, tok.details.TokenUuid, 0, client.ClientId},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            access, err := s.AuthorizeScopes(bearerRequest(tt.token), "read")
+            if err != nil {
+                t.Fatalf("AuthorizeScopes = %v", err)
+            }
+            if access.UserId != user.ID {
+                t.Errorf("UserId = %q, want %q", access.UserId, user.ID)
+            }
+            if got, _ := access.Claims[JwtClientId].(string); got != tt.clientId {
+                t.Errorf("client id claim = %q, want %q", got, tt.clientId)
+            }
+            info, err := s.FetchAuth(c, tt.tokenUuid)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if info.TokenType != tt.tokenType {
+                t.Errorf("TokenType = %d, want %d", info.TokenType, tt.tokenType)
+            }
+        })
+    }
+
+    refreshed, err := s.ExchangeToken(c, &TokenParams{
+        GrantType:    "refresh_token",
+        RefreshToken: tok.RefreshToken,
+        ClientId:     client.ClientId,
+        ClientSecret: client.ClientSecret,
+    })
+    if err != nil {
+        t.Fatalf("refresh_token grant = %v", err)
+    }
+    if _, err = s.AuthorizeScopes(bearerRequest(refreshed.AccessToken), "read"); err != nil {
+        t.Errorf("AuthorizeScopes refreshed token = %v", err)
+    }
+}
+
+func TestSessionModeRejectsForgedSessionIds(t *testing.T) {
+    s := newTestService(t, WithSessions(SessionConfig{}))
+    if _, err := s.Authorize(bearerRequest("not-a-session")); !errors.Is(err, ErrTokenInvalid) {
+        t.Errorf("Authorize = %v, want ErrTokenInvalid", err)
+    }
+}
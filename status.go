@@ -0,0 +1,166 @@
+package authr
+
+import (
+    "context"
+    "errors"
+    "gorm.io/gorm"
+    "net/http"
+)
+
+// UserStatus account lifecycle state
+type UserStatus string
+
+const (
+    StatusPending  UserStatus = "pending"
+    StatusActive   UserStatus = "active"
+    StatusLocked   UserStatus = "locked"
+    StatusDisabled UserStatus = "disabled"
+    StatusDeleted  UserStatus = "deleted"
+)
+
+// statusTransitions allowed moves from each state, deleted is terminal
+var statusTransitions = map[UserStatus][]UserStatus{
+    StatusPending:  {StatusActive, StatusDisabled, StatusDeleted},
+    StatusActive:   {StatusLocked, StatusDisabled, StatusDeleted},
+    StatusLocked:   {StatusActive, StatusDisabled, StatusDeleted},
+    StatusDisabled: {StatusActive, StatusDeleted},
+}
+
+func (s UserStatus) String() string {
+    if s == "" {
+        return string(StatusActive)
+    }
+    return string(s)
+}
+
+// Valid known status
+func (s UserStatus) Valid() bool {
+    _, ok := statusTransitions[s]
+    return ok || s == StatusDeleted
+}
+
+// CanTransition check the state machine allows moving to status `to`
+func (s UserStatus) CanTransition(to UserStatus) bool {
+    for _, next := range statusTransitions[UserStatus(s.String())] {
+        if next == to {
+            return true
+        }
+    }
+    return false
+}
+
+// revokes statuses that invalidate all outstanding tokens
+func (s UserStatus) revokes() bool {
+    return s == StatusLocked || s == StatusDisabled || s == StatusDeleted
+}
+
+// statusError error returned when a user in status s tries to authenticate
+func statusError(s UserStatus) error {
+    switch UserStatus(s.String()) {
+    case StatusActive:
+        return nil
+    case StatusPending:
+        return ErrAccountPending
+    case StatusLocked:
+        return ErrAccountLocked
+    case StatusDisabled:
+        return ErrAccountDisabled
+    default:
+        return ErrAccountInactive
+    }
+}
+
+// SetStatus move a user to a new status, tokens are revoked when the user can no longer authenticate
+func (s *service) SetStatus(c context.Context, userId string, status UserStatus) error {
+    if !status.Valid() {
+        return invalidf("status %q is invalid", status)
+    }
+
+    user, err := s.LoadUser(c, userId)
+    if err != nil {
+        return err
+    }
+    if user.Status.String() == status.String() {
+        return nil
+    }
+    if !user.Status.CanTransition(status) {
+        return invalidf("status can not change from %s to %s", user.Status, status)
+    }
+
+    return storeErr("SetStatus", s.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+        if err := tx.Model(&User{}).Where("id = ?", user.ID).Update("status", status).Error; err != nil {
+            return err
+        }
+        if status.revokes() {
+            return s.revokeUserTokens(tx, user.ID)
+        }
+        return nil
+    }))
+}
+
+// Authorize validate the request carries a first party credential: a live token or API key of an active
+// user without a scope claim. Restricted credentials are refused with ErrInsufficientScope, endpoints meant
+// for them use AuthorizeScopes.
+func (s *service) Authorize(r *http.Request) (*AccessDetails, error) {
+    metadata, err := s.authorize(r)
+    if err != nil {
+        return nil, err
+    }
+    if metadata.Restricted() {
+        return nil, ErrInsufficientScope
+    }
+    return metadata, nil
+}
+
+// AuthorizeScopes like Authorize but restricted credentials are accepted when they were granted every one
+// of scopes. Without scopes any live credential is accepted.
+func (s *service) AuthorizeScopes(r *http.Request, scopes ...string) (*AccessDetails, error) {
+    metadata, err := s.authorize(r)
+    if err != nil {
+        return nil, err
+    }
+    for _, scope := range scopes {
+        if !metadata.HasScope(scope) {
+            return nil, ErrInsufficientScope
+        }
+    }
+    return metadata, nil
+}
+
+// authorize validate the request token is live and belongs to an active user or an existing service account
+func (s *service) authorize(r *http.Request) (*AccessDetails, error) {
+    metadata, err := s.ExtractTokenMetadata(r)
+    if err != nil {
+        return nil, withReason("invalid", err)
+    }
+    // an API key was already looked up live by ExtractTokenMetadata
+    if metadata.KeyId == "" {
+        if _, err = s.FetchAuth(r.Context(), metadata.TokenUuid); err != nil {
+            if errors.Is(err, ErrNotFound) {
+                err = ErrTokenRevoked
+            }
+            return nil, withReason("revoked", err)
+        }
+    }
+    if metadata.Service() {
+        if _, err = s.loadServiceAccount(r.Context(), metadata.UserId); err != nil {
+            if errors.Is(err, ErrNotFound) {
+                err = ErrUnauthorized
+            }
+            return nil, withReason("unknown_user", err)
+        }
+        return metadata, nil
+    }
+
+    user, err := s.LoadUser(r.Context(), metadata.UserId)
+    if err != nil {
+        if errors.Is(err, ErrNotFound) {
+            err = ErrUnauthorized
+        }
+        return nil, withReason("unknown_user", err)
+    }
+    if err = statusError(user.Status); err != nil {
+        return nil, err
+    }
+    return metadata, nil
+}
@@ -0,0 +1,160 @@
+package authr
+
+import (
+    "context"
+    "errors"
+    "testing"
+)
+
+func TestUserStatusCanTransition(t *testing.T) {
+    tests := []struct {
+        from, to UserStatus
+        want     bool
+    }{
+        {"", StatusLocked, true},
+        {StatusPending, StatusActive, true},
+        {StatusPending, StatusLocked, false},
+        {StatusActive, StatusLocked, true},
+        {StatusActive, StatusPending, false},
+        {StatusLocked, StatusActive, true},
+        {StatusDisabled, StatusActive, true},
+        {StatusDisabled, StatusLocked, false},
+        {StatusDeleted, StatusActive, false},
+    }
+    for _, tt := range tests {
+        if got := tt.from.CanTransition(tt.to); got != tt.want {
+            t.Errorf("%q.CanTransition(%q) = %v, want %v", tt.from, tt.to, got, tt.want)
+        }
+    }
+}
+
+func TestSetStatus(t *testing.T) {
+    tests := []struct {
+        name     string
+        status   UserStatus
+        tokenErr error
+        loginErr error
+    }{
+        {"locked", StatusLocked, ErrTokenRevoked, ErrAccountLocked},
+        {"disabled", StatusDisabled, ErrTokenRevoked, ErrAccountDisabled},
+        {"deleted", StatusDeleted, ErrTokenRevoked, ErrAccountInactive},
+        {"active", StatusActive, nil, nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := newTestService(t)
+            c := context.Background()
+            user := newTestUser(t, s, "ann", "secret")
+            td := newTestLogin(t, s, user)
+            key, err := s.CreateAPIKey(c, user.ID, &APIKeyParams{Name: "ci"})
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            if err = s.SetStatus(c, user.ID, tt.status); err != nil {
+                t.Fatal(err)
+            }
+
+            if _, err = s.Authorize(bearerRequest(td.AccessToken)); !errors.Is(err, tt.tokenErr) {
+                t.Errorf("Authorize token = %v, want %v", err, tt.tokenErr)
+            }
+            keyErr := tt.tokenErr
+            if keyErr != nil {
+                keyErr = ErrTokenInvalid
+            }
+            if _, err = s.Authorize(bearerRequest(key.Key)); !errors.Is(err, keyErr) {
+                t.Errorf("Authorize API key = %v, want %v", err, keyErr)
+            }
+            if _, err = s.LoginUser(c, &LoginParams{Username: "ann", Password: "secret"}); !errors.Is(err, tt.loginErr) {
+                t.Errorf("LoginUser = %v, want %v", err, tt.loginErr)
+            }
+        })
+    }
+}
+
+func TestSetStatusInvalid(t *testing.T) {
+    tests := []struct {
+        name    string
+        current UserStatus
+        status  UserStatus
+    }{
+        {"unknown status", StatusActive, "suspended"},
+        {"disabled to locked", StatusDisabled, StatusLocked},
+        {"deleted is terminal", StatusDeleted, StatusActive},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := newTestService(t)
+            user := newTestUser(t, s, "ann", "secret")
+            if err := s.db.Model(user).Update("status", tt.current).Error; err != nil {
+                t.Fatal(err)
+            }
+
+            err := s.SetStatus(context.Background(), user.ID, tt.status)
+            if !errors.Is(err, ErrInvalidRequest) {
+                t.Fatalf("SetStatus = %v, want ErrInvalidRequest", err)
+            }
+            reloaded, err := s.LoadUser(context.Background(), user.ID)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if reloaded.Status != tt.current {
+                t.Errorf("status = %q, want %q", reloaded.Status, tt.current)
+            }
+        })
+    }
+}
+
+func TestEnableAfterLockKeepsOldTokensRevoked(t *testing.T) {
+    s := newTestService(t)
+    c := context.Background()
+    user := newTestUser(t, s, "ann", "secret")
+    td := newTestLogin(t, s, user)
+
+    if err := s.SetStatus(c, user.ID, StatusLocked); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.EnableUser(c, user.ID); err != nil {
+        t.Fatal(err)
+    }
+
+    if _, err := s.Authorize(bearerRequest(td.AccessToken)); !errors.Is(err, ErrTokenRevoked) {
+        t.Errorf("Authorize old token = %v, want ErrTokenRevoked", err)
+    }
+    if _, err := s.LoginUser(c, &LoginParams{Username: "ann", Password: "secret"}); err != nil {
+        t.Errorf("LoginUser = %v, want nil", err)
+    }
+}
+
+func TestPendingUserIsRefused(t *testing.T) {
+    s := newTestService(t)
+    user := newTestUser(t, s, "ann", "secret")
+    td := newTestLogin(t, s, user)
+    if err := s.db.Model(user).Update("status", StatusPending).Error; err != nil {
+        t.Fatal(err)
+    }
+
+    if _, err := s.Authorize(bearerRequest(td.AccessToken)); !errors.Is(err, ErrAccountPending) {
+        t.Errorf("Authorize = %v, want ErrAccountPending", err)
+    }
+    if _, err := s.LoginUser(context.Background(), &LoginParams{Username: "ann", Password: "secret"}); !errors.Is(err, ErrAccountPending) {
+        t.Errorf("LoginUser = %v, want ErrAccountPending", err)
+    }
+}
+
+func TestSetRolesRevokesTokens(t *testing.T) {
+    s := newTestService(t)
+    c := context.Background()
+    user := newTestUser(t, s, "ann", "secret", RoleAdmin.String())
+    td := newTestLogin(t, s, user)
+
+    if _, err := s.SetRoles(c, user.ID, []string{"ROLE_USER"}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := s.Authorize(bearerRequest(td.AccessToken)); !errors.Is(err, ErrTokenRevoked) {
+        t.Errorf("Authorize = %v, want ErrTokenRevoked", err)
+    }
+    if _, err := s.FetchAuth(c, td.RefreshUuid); !errors.Is(err, ErrNotFound) {
+        t.Errorf("FetchAuth refresh token = %v, want ErrNotFound", err)
+    }
+}
@@ -1,12 +1,10 @@
 package authr
 
 import (
-    "errors"
     "fmt"
     "github.com/dgrijalva/jwt-go"
     "github.com/twinj/uuid"
     "net/http"
-    "strings"
     "time"
 )
 
@@ -16,6 +14,13 @@ const (
     JwtRefreshUuid = "refresh_uuid"
     JwtExpires     = "exp"
     JwtRole        = "role"
+    JwtActor       = "act"
+    JwtScope       = "scope"
+    JwtClientId    = "client_id"
+    JwtAuthTime    = "auth_time"
+    JwtPrincipal   = "principal"
+    // JwtAuthBackend name of the Authenticator that checked the password of the login
+    JwtAuthBackend = "auth_backend"
 )
 
 type tokenService struct {
@@ -47,7 +52,7 @@ func (t *tokenService) CreateToken(u *User) (*TokenDetails, error) {
     td.ID = u.ID
     td.Email = u.Email
     td.Username = u.Username
-    td.Roles = strings.Split(u.Roles, ",")
+    td.Roles = splitRoles(u.Roles)
 
     td.AtExpires = time.Now().Add(time.Minute * 30).Unix() //expires after 30 min
     td.TokenUuid = uuid.NewV4().String()
@@ -104,7 +109,7 @@ func (t *tokenService) RefreshToken(u *User, claims jwt.MapClaims) (*TokenDetail
     td.ID = u.ID
     td.Email = u.Email
     td.Username = u.Username
-    td.Roles = strings.Split(u.Roles, ",")
+    td.Roles = splitRoles(u.Roles)
 
     td.AtExpires = time.Now().Add(time.Minute * 30).Unix() //expires after 30 min
     td.TokenUuid = uuid.NewV4().String()
@@ -124,6 +129,8 @@ func (t *tokenService) RefreshToken(u *User, claims jwt.MapClaims) (*TokenDetail
     atClaims[JwtAccessUuid] = td.TokenUuid
     atClaims[JwtUserId] = u.ID
     atClaims[JwtExpires] = td.AtExpires
+    //the roles of the stored user, never those of the previous token
+    atClaims[JwtRole] = u.Roles
 
     at := jwt.NewWithClaims(jwt.SigningMethodHS256, atClaims)
     td.AccessToken, err = at.SignedString([]byte(t.accessSecret))
@@ -145,6 +152,7 @@ func (t *tokenService) RefreshToken(u *User, claims jwt.MapClaims) (*TokenDetail
     rtClaims[JwtRefreshUuid] = td.RefreshUuid
     rtClaims[JwtUserId] = u.ID
     rtClaims[JwtExpires] = td.RtExpires
+    rtClaims[JwtRole] = u.Roles
 
     rt := jwt.NewWithClaims(jwt.SigningMethodHS256, rtClaims)
 
@@ -169,6 +177,9 @@ func (t *tokenService) TokenValid(r *http.Request) error {
 
 func (t *tokenService) verifyToken(r *http.Request) (*jwt.Token, error) {
     tokenString := t.extractToken(r)
+    if tokenString == "" {
+        return nil, ErrUnauthorized
+    }
     token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
         if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
             return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
@@ -176,46 +187,55 @@ func (t *tokenService) verifyToken(r *http.Request) (*jwt.Token, error) {
         return []byte(t.accessSecret), nil
     })
     if err != nil {
-        return nil, err
+        return nil, tokenErr(err)
     }
     return token, nil
 }
 
-//get the token from the request body
+//get the token from the Authorization: Bearer header
 func (t *tokenService) extractToken(r *http.Request) string {
-    bearToken := r.Header.Get("Authorization")
-    strArr := strings.Split(bearToken, " ")
-    if len(strArr) == 2 {
-        return strArr[1]
-    }
-    return ""
+    token, _ := bearerToken(r)
+    return token
 }
 
 func (t *tokenService) extract(token *jwt.Token) (*AccessDetails, error) {
 
     claims, ok := token.Claims.(jwt.MapClaims)
     if !ok || !token.Valid {
-        return nil, errors.New("something went wrong")
+        return nil, ErrTokenInvalid
     }
     accessUuid, ok := claims[JwtAccessUuid].(string)
     if !ok {
-        return nil, errors.New("something went wrong")
+        return nil, ErrTokenInvalid
     }
 
     userId, ok := claims[JwtUserId].(string)
     if !ok {
-        return nil, errors.New("unauthorized")
+        return nil, ErrTokenInvalid
     }
 
     role, ok := claims[JwtRole].(string)
     if !ok {
-        return nil, errors.New("unauthorized")
+        return nil, ErrTokenInvalid
+    }
+
+    // RFC 8693 actor claim, set on impersonated sessions
+    var actorId string
+    if act, ok := claims[JwtActor].(map[string]interface{}); ok {
+        actorId, _ = act["sub"].(string)
+    }
+
+    principal := PrincipalUser
+    if p, _ := claims[JwtPrincipal].(string); p == string(PrincipalService) {
+        principal = PrincipalService
     }
 
     return &AccessDetails{
         TokenUuid: accessUuid,
         UserId:    userId,
         Role:      role,
+        ActorId:   actorId,
+        Principal: principal,
         Claims:    claims,
     }, nil
 
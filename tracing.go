@@ -0,0 +1,66 @@
+package authr
+
+import (
+    "context"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    "go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/alexj212/authr"
+
+// span attribute keys, values never include passwords, hashes or tokens
+const (
+    attrAdapter = attribute.Key("authr.adapter")
+    attrOutcome = attribute.Key("authr.outcome")
+    attrReason  = attribute.Key("authr.failure_reason")
+    attrUserId  = attribute.Key("enduser.id")
+)
+
+// WithTracerProvider create spans with tp instead of the global otel provider
+func WithTracerProvider(tp trace.TracerProvider) Option {
+    return func(s *service) {
+        s.tracer = tp.Tracer(tracerName)
+    }
+}
+
+func defaultTracer() trace.Tracer {
+    return otel.Tracer(tracerName)
+}
+
+// Tracer used for the authr spans
+func (s *service) Tracer() trace.Tracer {
+    return s.tracer
+}
+
+func (s *service) startSpan(c context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+    return s.tracer.Start(c, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan record the auth outcome of the operation and end the span
+func endSpan(span trace.Span, err error) {
+    span.SetAttributes(attrOutcome.String(outcome(err)))
+    if err != nil {
+        span.SetAttributes(attrReason.String(failureReason(err)))
+        span.SetStatus(codes.Error, failureReason(err))
+    }
+    span.End()
+}
+
+// hashPassword GeneratePasswordHash under a span
+func (s *service) hashPassword(c context.Context, password string) (string, error) {
+    _, span := s.startSpan(c, "authr.GeneratePasswordHash")
+    hash, err := GeneratePasswordHash(password)
+    endSpan(span, err)
+    return hash, err
+}
+
+// checkPassword CheckPasswordHash under a span
+func (s *service) checkPassword(c context.Context, password, hash string) bool {
+    _, span := s.startSpan(c, "authr.CheckPasswordHash")
+    ok := CheckPasswordHash(password, hash)
+    span.SetAttributes(attribute.Bool("authr.password_match", ok))
+    span.End()
+    return ok
+}
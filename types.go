@@ -1,9 +1,13 @@
 package authr
 
 import (
+    "database/sql/driver"
+    "encoding/json"
+    "errors"
     "fmt"
     "github.com/dgrijalva/jwt-go"
     "gorm.io/gorm"
+    "strings"
     "time"
 )
 
@@ -20,12 +24,72 @@ type RegistrationParams struct {
 
 type User struct {
     gorm.Model
-    ID       string                 `json:"id"`
-    Username string                 `gorm:"unique" json:"username"`
-    Email    string                 `json:"email"`
-    Password string                 `json:"password"`
-    Roles    string                 `json:"roles"`
-    details  map[string]interface{} `json:"-"`
+    ID            string                 `json:"id"`
+    Username      string                 `gorm:"unique" json:"username"`
+    Email         string                 `json:"email"`
+    // EmailVerified set once the user confirmed a change to the current address
+    EmailVerified bool                   `json:"email_verified"`
+    Password      string                 `json:"password"`
+    Roles         string                 `json:"roles"`
+    Attributes    Attributes             `gorm:"type:text" json:"attributes"`
+    Status        UserStatus             `gorm:"default:active" json:"status"`
+    // Backend authentication backend that owns the user, empty for local users
+    Backend       string                 `json:"backend,omitempty"`
+    details       map[string]interface{} `json:"-"`
+    // authBackend the authenticator of this login, see JwtAuthBackend
+    authBackend   string
+}
+
+// Attributes custom user attributes, persisted as a json column
+type Attributes map[string]interface{}
+
+// Value implements driver.Valuer
+func (a Attributes) Value() (driver.Value, error) {
+    if a == nil {
+        return nil, nil
+    }
+    b, err := json.Marshal(a)
+    if err != nil {
+        return nil, err
+    }
+    return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (a *Attributes) Scan(value interface{}) error {
+    var b []byte
+    switch v := value.(type) {
+    case nil:
+        *a = nil
+        return nil
+    case []byte:
+        b = v
+    case string:
+        b = []byte(v)
+    default:
+        return errors.New("attributes: unsupported column type")
+    }
+    if len(b) == 0 {
+        *a = nil
+        return nil
+    }
+    return json.Unmarshal(b, a)
+}
+
+// Profile is the public view of a User, safe to return to the user themselves
+type Profile struct {
+    ID         string     `json:"id"`
+    Username   string     `json:"username"`
+    Email      string     `json:"email"`
+    Roles      []string   `json:"roles"`
+    Attributes Attributes `json:"attributes"`
+}
+
+// ProfileParams fields left nil are not changed, attributes with a nil value are removed
+type ProfileParams struct {
+    Username   *string                `json:"username,omitempty"`
+    Email      *string                `json:"email,omitempty"`
+    Attributes map[string]interface{} `json:"attributes,omitempty"`
 }
 
 type AuthTokens struct {
@@ -34,26 +98,83 @@ type AuthTokens struct {
     TokenUuid string `gorm:"unique"`
     TokenType uint
     UserId    string
+    ActorId   string
+    ClientId  string `gorm:"index"`
+    // Backend the authenticator of the login, restores the auth_backend claim of sessions
+    Backend   string
 }
 
 type AccessDetails struct {
     TokenUuid string
+    // UserId the user, or the client id of a service account
     UserId    string
     Role      string
+    ActorId   string
+    Principal PrincipalType
+    // KeyId the API key the request authenticated with, empty for tokens and sessions
+    KeyId     string
     Claims    jwt.MapClaims
 }
 
+// PrincipalType who a token was issued to
+type PrincipalType string
+
+const (
+    PrincipalUser    PrincipalType = "user"
+    PrincipalService PrincipalType = "service"
+)
+
+// Restricted the credential carries a scope claim: OAuth and service account tokens and scoped API keys.
+// Only unrestricted credentials are first party sessions, see Authorize.
+func (a *AccessDetails) Restricted() bool {
+    _, ok := a.Claims[JwtScope]
+    return ok
+}
+
+// HasScope tokens without a scope claim are unrestricted
+func (a *AccessDetails) HasScope(scope string) bool {
+    granted, ok := a.Claims[JwtScope].(string)
+    if !ok {
+        return true
+    }
+    return StringList(strings.Fields(granted)).Contains(scope)
+}
+
+// Service the token belongs to a service account rather than a user
+func (a *AccessDetails) Service() bool {
+    return a.Principal == PrincipalService
+}
+
+// Impersonated the token was issued to ActorId acting as UserId
+func (a *AccessDetails) Impersonated() bool {
+    return a.ActorId != ""
+}
+
+// HasRole check the role claim of the token
+func (a *AccessDetails) HasRole(role Role) bool {
+    for _, r := range strings.Split(a.Role, ",") {
+        if strings.TrimSpace(r) == role.String() {
+            return true
+        }
+    }
+    return false
+}
+
 type TokenDetails struct {
     ID           string   `json:"id"`
     Username     string   `json:"username"`
     Email        string   `json:"email"`
     Roles        []string `json:"roles"`
-    AccessToken  string   `json:"access_token"`
-    RefreshToken string   `json:"refresh_token"`
+    AccessToken  string   `json:"access_token,omitempty"`
+    RefreshToken string   `json:"refresh_token,omitempty"`
     TokenUuid    string   `json:"-"`
     RefreshUuid  string   `json:"-"`
     AtExpires    int64    `json:"-"`
     RtExpires    int64    `json:"-"`
+    actorId      string
+    clientId     string
+    session      bool
+    backend      string
 }
 
 type Role int64
@@ -73,3 +194,464 @@ func (s Role) String() string {
         return fmt.Sprintf("ROLE:%d", s)
     }
 }
+
+// EmailChange pending or completed email change of a user
+type EmailChange struct {
+    gorm.Model
+    UserId      string `gorm:"index"`
+    OldEmail    string
+    NewEmail    string
+    ConfirmHash string `gorm:"unique"`
+    RevertHash  string `gorm:"unique"`
+    Expires     time.Time
+    ConfirmedAt *time.Time
+    RevertedAt  *time.Time
+}
+
+type EmailChangeParams struct {
+    Email string `json:"email"`
+}
+
+// PasswordReset one time token to set a new password
+type PasswordReset struct {
+    gorm.Model
+    UserId    string `gorm:"index"`
+    TokenHash string `gorm:"unique"`
+    Expires   time.Time
+    UsedAt    *time.Time
+}
+
+type ChangePasswordParams struct {
+    CurrentPassword string `json:"current_password"`
+    NewPassword     string `json:"new_password"`
+}
+
+type PasswordResetParams struct {
+    Token    string `json:"token"`
+    Password string `json:"password"`
+}
+
+// UserQuery search and pagination of the user list
+type UserQuery struct {
+    Search   string `json:"search"`
+    Page     int    `json:"page"`
+    PageSize int    `json:"page_size"`
+}
+
+// UserRecord admin view of a user
+type UserRecord struct {
+    ID         string     `json:"id"`
+    Username   string     `json:"username"`
+    Email      string     `json:"email"`
+    Roles      []string   `json:"roles"`
+    Attributes Attributes `json:"attributes"`
+    Status     UserStatus `json:"status"`
+    CreatedAt  time.Time  `json:"created_at"`
+    UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+type UserPage struct {
+    Users    []*UserRecord `json:"users"`
+    Total    int64         `json:"total"`
+    Page     int           `json:"page"`
+    PageSize int           `json:"page_size"`
+}
+
+// APIKey long lived key of a user for scripts, the key itself is only stored hashed
+type APIKey struct {
+    ID         uint           `gorm:"primarykey" json:"-"`
+    UserId     string         `gorm:"index" json:"-"`
+    Prefix     string         `gorm:"unique" json:"id"`
+    KeyHash    string         `json:"-"`
+    Name       string         `json:"name"`
+    Scopes     StringList     `gorm:"type:text" json:"scopes"`
+    Expires    *time.Time     `json:"expires,omitempty"`
+    LastUsedAt *time.Time     `json:"last_used_at,omitempty"`
+    CreatedAt  time.Time      `json:"created_at"`
+    DeletedAt  gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// APIKeyParams ExpiresIn in seconds, 0 never expires. Without scopes the key can do what the user can,
+// except administration which needs ScopeAdmin.
+type APIKeyParams struct {
+    Name      string   `json:"name"`
+    Scopes    []string `json:"scopes"`
+    ExpiresIn int64    `json:"expires_in"`
+}
+
+// APIKeyCreated the key is only ever returned on creation
+type APIKeyCreated struct {
+    *APIKey
+    Key string `json:"key"`
+}
+
+// ExternalIdentity account of a user at an external identity provider, unlinking deletes the row
+type ExternalIdentity struct {
+    ID        uint      `gorm:"primarykey" json:"-"`
+    Provider  string    `gorm:"uniqueIndex:idx_identity_provider_subject" json:"provider"`
+    Subject   string    `gorm:"uniqueIndex:idx_identity_provider_subject" json:"subject"`
+    UserId    string    `gorm:"index" json:"-"`
+    Email     string    `json:"email"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// FederatedLogin redirect to an identity provider waiting for its callback
+type FederatedLogin struct {
+    gorm.Model
+    StateHash    string `gorm:"unique"`
+    Provider     string
+    Nonce        string
+    CodeVerifier string
+    // LinkUserId the identity is linked to this signed in user instead of signing in
+    LinkUserId string
+    Expires    time.Time
+    UsedAt     *time.Time
+}
+
+// FederatedRedirect where to send the browser, State must come back in the callback and in the state cookie
+type FederatedRedirect struct {
+    URL string `json:"url"`
+    // Form auto submitting HTML form of a POST binding, URL is empty then
+    Form  []byte `json:"-"`
+    State string `json:"-"`
+}
+
+// FederatedLoginResult Linked the callback of a link request, the user is already signed in
+type FederatedLoginResult struct {
+    User     *User
+    Identity *ExternalIdentity
+    Linked   bool
+    // Created the user was provisioned by this sign in
+    Created bool
+    // NewIdentity the identity was linked by this callback
+    NewIdentity bool
+}
+
+// FederatedCallbackParams query of the provider callback, BrowserState is the state cookie of the browser
+type FederatedCallbackParams struct {
+    State        string
+    Code         string
+    Error        string
+    BrowserState string
+}
+
+// SAMLResponseParams form posted to the ACS, BrowserState is the SAML state cookie of the browser
+type SAMLResponseParams struct {
+    SAMLResponse string
+    RelayState   string
+    BrowserState string
+}
+
+// Session admin view of an issued token
+type Session struct {
+    TokenUuid string    `json:"token_uuid"`
+    TokenType uint      `json:"token_type"`
+    Expires   time.Time `json:"expires"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+type StatusParams struct {
+    Status UserStatus `json:"status"`
+}
+
+type RolesParams struct {
+    Roles []string `json:"roles"`
+}
+
+// AttributesParams attributes with a nil value are removed, the others are set
+type AttributesParams struct {
+    Attributes map[string]interface{} `json:"attributes"`
+}
+
+// AuditEvent append-only record of an auth event
+type AuditEvent struct {
+    ID        uint           `gorm:"primarykey" json:"id"`
+    Time      time.Time      `gorm:"index" json:"time"`
+    Type      AuditEventType `gorm:"index" json:"type"`
+    ActorId   string         `gorm:"index" json:"actor_id,omitempty"`
+    TargetId  string         `gorm:"index" json:"target_id,omitempty"`
+    IP        string         `json:"ip,omitempty"`
+    UserAgent string         `json:"user_agent,omitempty"`
+    Detail    string         `json:"detail,omitempty"`
+}
+
+// AuditQuery filter of the audit log, UserId matches either the actor or the target
+type AuditQuery struct {
+    UserId string         `json:"user_id"`
+    Type   AuditEventType `json:"type"`
+    From   time.Time      `json:"from"`
+    To     time.Time      `json:"to"`
+    Limit  int            `json:"limit"`
+    Offset int            `json:"offset"`
+}
+
+// OAuthClient application registered with the authorization server, public clients have no secret
+type OAuthClient struct {
+    gorm.Model
+    ClientId     string     `gorm:"unique" json:"client_id"`
+    SecretHash   string     `json:"-"`
+    Name         string     `json:"name"`
+    RedirectURIs StringList `gorm:"type:text" json:"redirect_uris"`
+    Scopes       StringList `gorm:"type:text" json:"scopes"`
+    // FirstParty clients are trusted and skip the consent prompt
+    FirstParty bool `json:"first_party"`
+}
+
+// Public the client can not keep a secret, PKCE is its only proof
+func (c *OAuthClient) Public() bool {
+    return c.SecretHash == ""
+}
+
+// StringList persisted as a json array
+type StringList []string
+
+// Value implements driver.Valuer
+func (l StringList) Value() (driver.Value, error) {
+    if l == nil {
+        return nil, nil
+    }
+    b, err := json.Marshal(l)
+    if err != nil {
+        return nil, err
+    }
+    return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (l *StringList) Scan(value interface{}) error {
+    var b []byte
+    switch v := value.(type) {
+    case nil:
+        *l = nil
+        return nil
+    case []byte:
+        b = v
+    case string:
+        b = []byte(v)
+    default:
+        return errors.New("string list: unsupported column type")
+    }
+    if len(b) == 0 {
+        *l = nil
+        return nil
+    }
+    return json.Unmarshal(b, l)
+}
+
+// Contains exact match of v
+func (l StringList) Contains(v string) bool {
+    for _, s := range l {
+        if s == v {
+            return true
+        }
+    }
+    return false
+}
+
+type ClientParams struct {
+    Name         string   `json:"name"`
+    RedirectURIs []string `json:"redirect_uris"`
+    Scopes       []string `json:"scopes"`
+    Public       bool     `json:"public"`
+    FirstParty   bool     `json:"first_party"`
+}
+
+// ServiceAccount machine principal of backend jobs, authenticates with the client_credentials grant
+type ServiceAccount struct {
+    gorm.Model
+    ClientId   string     `gorm:"unique" json:"client_id"`
+    SecretHash string     `json:"-"`
+    Name       string     `json:"name"`
+    Roles      string     `json:"roles"`
+    Scopes     StringList `gorm:"type:text" json:"scopes"`
+}
+
+type ServiceAccountParams struct {
+    Name   string   `json:"name"`
+    Roles  []string `json:"roles"`
+    Scopes []string `json:"scopes"`
+}
+
+// ServiceAccountRegistration the secret is only ever returned on creation and rotation
+type ServiceAccountRegistration struct {
+    *ServiceAccount
+    ClientSecret string `json:"client_secret"`
+}
+
+// ClientRegistration the client secret is only ever returned here
+type ClientRegistration struct {
+    *OAuthClient
+    ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// OAuthCode authorization code issued by /authorize, redeemed once at /token
+type OAuthCode struct {
+    gorm.Model
+    CodeHash            string `gorm:"unique"`
+    ClientId            string `gorm:"index"`
+    UserId              string `gorm:"index"`
+    RedirectURI         string
+    Scope               string
+    CodeChallenge       string
+    CodeChallengeMethod string
+    // Nonce and AuthTime end up in the ID token of an openid request
+    Nonce               string
+    AuthTime            int64
+    Expires             time.Time
+    UsedAt              *time.Time
+}
+
+// OAuthDeviceCode pending device authorization, the user approves UserCode on another device while
+// the device polls with the device code
+type OAuthDeviceCode struct {
+    gorm.Model
+    DeviceCodeHash string `gorm:"unique"`
+    UserCode       string `gorm:"unique"`
+    ClientId       string `gorm:"index"`
+    Scope          string
+    // UserId and AuthTime are set once the user approved
+    UserId         string
+    AuthTime       int64
+    Denied         bool
+    Interval       int
+    Expires        time.Time
+    LastPolledAt   *time.Time
+    UsedAt         *time.Time
+}
+
+// OAuthConsent scopes a user granted to a client
+type OAuthConsent struct {
+    gorm.Model
+    UserId   string `gorm:"uniqueIndex:idx_consent_user_client"`
+    ClientId string `gorm:"uniqueIndex:idx_consent_user_client"`
+    Scope    string
+}
+
+// AuthorizeParams authorization request, Consent is "allow" or "deny" once the user answered the prompt
+type AuthorizeParams struct {
+    ResponseType        string `json:"response_type"`
+    ClientId            string `json:"client_id"`
+    RedirectURI         string `json:"redirect_uri"`
+    Scope               string `json:"scope"`
+    State               string `json:"state"`
+    CodeChallenge       string `json:"code_challenge"`
+    CodeChallengeMethod string `json:"code_challenge_method"`
+    Nonce               string `json:"nonce"`
+    Consent             string `json:"consent"`
+}
+
+// ConsentPrompt what the user is asked to approve
+type ConsentPrompt struct {
+    ClientId   string   `json:"client_id"`
+    ClientName string   `json:"client_name"`
+    Scopes     []string `json:"scopes"`
+}
+
+// AuthorizeResult either the consent prompt to show or the redirect back to the client
+type AuthorizeResult struct {
+    Consent  *ConsentPrompt `json:"consent,omitempty"`
+    Redirect string         `json:"redirect,omitempty"`
+}
+
+// DeviceAuthorizationParams RFC 8628 section 3.1 request
+type DeviceAuthorizationParams struct {
+    ClientId     string
+    ClientSecret string
+    Scope        string
+}
+
+// DeviceAuthorization RFC 8628 section 3.2 response
+type DeviceAuthorization struct {
+    DeviceCode              string `json:"device_code"`
+    UserCode                string `json:"user_code"`
+    VerificationURI         string `json:"verification_uri"`
+    VerificationURIComplete string `json:"verification_uri_complete"`
+    ExpiresIn               int64  `json:"expires_in"`
+    Interval                int    `json:"interval"`
+}
+
+// DeviceVerifyParams the user code entered by the user, Consent is "allow" or "deny" once the user answered the prompt
+type DeviceVerifyParams struct {
+    UserCode string `json:"user_code"`
+    Consent  string `json:"consent"`
+}
+
+// TokenParams token request of any grant type
+type TokenParams struct {
+    GrantType    string
+    Code         string
+    DeviceCode   string
+    RedirectURI  string
+    ClientId     string
+    ClientSecret string
+    CodeVerifier string
+    RefreshToken string
+    Scope        string
+}
+
+// OAuthToken RFC 6749 section 5.1 token response
+type OAuthToken struct {
+    AccessToken  string `json:"access_token"`
+    TokenType    string `json:"token_type"`
+    ExpiresIn    int64  `json:"expires_in"`
+    RefreshToken string `json:"refresh_token,omitempty"`
+    Scope        string `json:"scope,omitempty"`
+    IDToken      string `json:"id_token,omitempty"`
+    userId       string
+    details      *TokenDetails
+}
+
+// TokenLookupParams introspection (RFC 7662) and revocation (RFC 7009) request
+type TokenLookupParams struct {
+    Token         string
+    TokenTypeHint string
+    ClientId      string
+    ClientSecret  string
+}
+
+// TokenIntrospection RFC 7662 section 2.2 response, only Active is set for an inactive token
+type TokenIntrospection struct {
+    Active    bool                   `json:"active"`
+    Scope     string                 `json:"scope,omitempty"`
+    ClientId  string                 `json:"client_id,omitempty"`
+    TokenType string                 `json:"token_type,omitempty"`
+    Exp       int64                  `json:"exp,omitempty"`
+    Sub       string                 `json:"sub,omitempty"`
+    Act       map[string]interface{} `json:"act,omitempty"`
+    Principal PrincipalType          `json:"principal,omitempty"`
+}
+
+// OIDCDiscovery OpenID Provider metadata served at /.well-known/openid-configuration
+type OIDCDiscovery struct {
+    Issuer                            string   `json:"issuer"`
+    AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+    TokenEndpoint                     string   `json:"token_endpoint"`
+    UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+    JWKSURI                           string   `json:"jwks_uri"`
+    IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+    RevocationEndpoint                string   `json:"revocation_endpoint"`
+    DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+    ScopesSupported                   []string `json:"scopes_supported"`
+    ResponseTypesSupported            []string `json:"response_types_supported"`
+    GrantTypesSupported               []string `json:"grant_types_supported"`
+    SubjectTypesSupported             []string `json:"subject_types_supported"`
+    IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+    TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+    CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+    ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// JSONWebKey public RSA key of RFC 7517
+type JSONWebKey struct {
+    Kty string `json:"kty"`
+    Use string `json:"use"`
+    Alg string `json:"alg"`
+    Kid string `json:"kid"`
+    N   string `json:"n"`
+    E   string `json:"e"`
+}
+
+// JSONWebKeySet the document served at the jwks_uri
+type JSONWebKeySet struct {
+    Keys []JSONWebKey `json:"keys"`
+}